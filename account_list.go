@@ -0,0 +1,218 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultAccountSort = "-created_at"
+
+// the value an account is sorted by, ties are broken by id
+func accountSortKey(acc *Account, sort AccountSort) any {
+	switch sort {
+	case SortBalance:
+		return acc.Balance
+	case SortLastName:
+		return acc.LastName
+	case SortNumber:
+		return acc.Number
+	default:
+		return acc.CreatedAt
+	}
+}
+
+// orders accounts the way the postgres store does, for the memory store
+func compareAccounts(a *Account, b *Account, sort AccountSort) int {
+	var c int
+	switch sort {
+	case SortBalance:
+		c = cmp.Compare(a.Balance, b.Balance)
+	case SortLastName:
+		c = cmp.Compare(a.LastName, b.LastName)
+	case SortNumber:
+		c = cmp.Compare(a.Number, b.Number)
+	default:
+		c = a.CreatedAt.Compare(b.CreatedAt)
+	}
+	if c == 0 {
+		c = cmp.Compare(a.Id, b.Id)
+	}
+
+	return c
+}
+
+func (f *AccountFilter) matches(acc *Account) bool {
+	switch {
+	case f.Role != "" && acc.Role != f.Role:
+		return false
+	case f.Status != "" && acc.Status != f.Status:
+		return false
+	case !f.CreatedFrom.IsZero() && acc.CreatedAt.Before(f.CreatedFrom):
+		return false
+	case !f.CreatedTo.IsZero() && !acc.CreatedAt.Before(f.CreatedTo):
+		return false
+	case acc.Balance < f.MinBalance:
+		return false
+	case f.MaxBalance != nil && acc.Balance > *f.MaxBalance:
+		return false
+	}
+
+	if f.NamePrefix != "" {
+		prefix := strings.ToLower(f.NamePrefix)
+		if !strings.HasPrefix(strings.ToLower(acc.FirstName), prefix) &&
+			!strings.HasPrefix(strings.ToLower(acc.LastName), prefix) {
+			return false
+		}
+	}
+
+	if f.After != nil {
+		c := compareAccounts(acc, f.After, f.Sort)
+		if (f.Descending && c >= 0) || (!f.Descending && c <= 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// cursors carry the sort they were made for, so a page can't be continued
+// in a different order
+type accountCursor struct {
+	Sort string          `json:"s"`
+	Id   int             `json:"id"`
+	Key  json.RawMessage `json:"k"`
+}
+
+func encodeAccountCursor(acc *Account, sort string, by AccountSort) string {
+	key, _ := json.Marshal(accountSortKey(acc, by))
+	b, _ := json.Marshal(accountCursor{Sort: sort, Id: acc.Id, Key: key})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeAccountCursor(cursor string, sort string, by AccountSort) (*Account, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var c accountCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if c.Sort != sort {
+		return nil, fmt.Errorf("cursor is for sort %q", c.Sort)
+	}
+
+	after := &Account{Id: c.Id}
+	switch by {
+	case SortBalance:
+		if err = json.Unmarshal(c.Key, &after.Balance); err == nil && after.Balance > math.MaxInt64 {
+			err = fmt.Errorf("cursor balance out of range")
+		}
+	case SortLastName:
+		err = json.Unmarshal(c.Key, &after.LastName)
+	case SortNumber:
+		err = json.Unmarshal(c.Key, &after.Number)
+	default:
+		err = json.Unmarshal(c.Key, &after.CreatedAt)
+	}
+
+	return after, err
+}
+
+// sort is a field name, with a leading - for descending
+func parseAccountSort(sort string) (AccountSort, bool, error) {
+	by := AccountSort(strings.TrimPrefix(sort, "-"))
+	switch by {
+	case SortCreatedAt, SortBalance, SortLastName, SortNumber:
+		return by, strings.HasPrefix(sort, "-"), nil
+	}
+
+	return "", false, fmt.Errorf("sort must be one of created_at, balance, last_name, number, with a leading - for descending")
+}
+
+func parseAccountFilter(r *http.Request) (AccountFilter, string, error) {
+	query := r.URL.Query()
+	filter := AccountFilter{
+		Role:       query.Get("role"),
+		NamePrefix: strings.TrimSpace(query.Get("name")),
+		Limit:      defaultHistoryPageSize,
+	}
+
+	if status := query.Get("status"); status != "" {
+		switch AccountStatus(status) {
+		case AccountActive, AccountFrozen, AccountClosed:
+			filter.Status = AccountStatus(status)
+		default:
+			return filter, "", fmt.Errorf("status must be one of active, frozen, closed")
+		}
+	}
+
+	if from := query.Get("created_from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return filter, "", fmt.Errorf("created_from must be an RFC3339 timestamp")
+		}
+		filter.CreatedFrom = t
+	}
+
+	if to := query.Get("created_to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return filter, "", fmt.Errorf("created_to must be an RFC3339 timestamp")
+		}
+		filter.CreatedTo = t
+	}
+
+	// balances are a bigint in postgres, anything past it can't match anyway
+	if minBalance := query.Get("min_balance"); minBalance != "" {
+		n, err := strconv.ParseUint(minBalance, 10, 63)
+		if err != nil {
+			return filter, "", fmt.Errorf("min_balance must be a whole number of minor units up to %d", math.MaxInt64)
+		}
+		filter.MinBalance = n
+	}
+
+	if maxBalance := query.Get("max_balance"); maxBalance != "" {
+		n, err := strconv.ParseUint(maxBalance, 10, 63)
+		if err != nil {
+			return filter, "", fmt.Errorf("max_balance must be a whole number of minor units up to %d", math.MaxInt64)
+		}
+		filter.MaxBalance = &n
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxHistoryPageSize {
+			return filter, "", fmt.Errorf("limit must be between 1 and %d", maxHistoryPageSize)
+		}
+		filter.Limit = n
+	}
+
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = defaultAccountSort
+	}
+	by, descending, err := parseAccountSort(sort)
+	if err != nil {
+		return filter, "", err
+	}
+	filter.Sort, filter.Descending = by, descending
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeAccountCursor(cursor, sort, by)
+		if err != nil {
+			return filter, "", fmt.Errorf("invalid cursor")
+		}
+		filter.After = after
+	}
+
+	return filter, sort, nil
+}
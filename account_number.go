@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// account numbers are 9 random digits followed by a Luhn check digit, so a
+// mistyped digit or most swapped pairs are caught before money moves
+const (
+	minAccountPayload = 100_000_000
+	maxAccountPayload = 999_999_999
+
+	// numbers handed out before check digits were added
+	legacyAccountNumberLimit = 10_000
+)
+
+func generateAccountNumber() (int64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(maxAccountPayload-minAccountPayload+1))
+	if err != nil {
+		return 0, err
+	}
+
+	payload := n.Int64() + minAccountPayload
+	return payload*10 + luhnCheckDigit(payload), nil
+}
+
+func luhnCheckDigit(payload int64) int64 {
+	// the check digit will be appended on the right, so doubling starts
+	// with the rightmost digit of the payload
+	var sum int64
+	double := true
+	for ; payload > 0; payload /= 10 {
+		digit := payload % 10
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+
+	return (10 - sum%10) % 10
+}
+
+// accounts opened before check digits have numbers below 10000 that were
+// never renumbered, those can only be checked by looking them up
+func validAccountNumber(number int64) bool {
+	if number <= 0 {
+		return false
+	}
+	if number < legacyAccountNumberLimit {
+		return true
+	}
+
+	return luhnCheckDigit(number/10) == number%10
+}
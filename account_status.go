@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+var (
+	ErrAccountFrozen        = errors.New("account is frozen")
+	ErrAccountClosed        = errors.New("account is closed")
+	ErrBalanceNotZero       = errors.New("account balance is not zero")
+	ErrInvalidPayoutAccount = errors.New("invalid payout account")
+)
+
+// accounts are never deleted, closing one keeps it and its history around
+type AccountStatus string
+
+const (
+	AccountActive AccountStatus = "active"
+	// can't send or receive money until it is unfrozen
+	AccountFrozen AccountStatus = "frozen"
+	// final, only staff can still look at it
+	AccountClosed AccountStatus = "closed"
+)
+
+// money only moves between active accounts
+func checkTransferable(from AccountStatus, to AccountStatus) error {
+	switch {
+	case from == AccountClosed || to == AccountClosed:
+		return ErrAccountClosed
+	case from == AccountFrozen || to == AccountFrozen:
+		return ErrAccountFrozen
+	}
+
+	return nil
+}
+
+// the payout transfer that empties an account before it is closed
+func payoutTransfer(acc *Account, payout *Account) (*Transfer, error) {
+	// reversals still have a claim on the money
+	if acc.Held > 0 {
+		return nil, ErrFundsHeld
+	}
+	if acc.Balance == 0 {
+		return nil, nil
+	}
+	if payout == nil {
+		return nil, ErrBalanceNotZero
+	}
+	if payout.Number == acc.Number || payout.Status != AccountActive {
+		return nil, ErrInvalidPayoutAccount
+	}
+	if payout.Currency != acc.Currency {
+		return nil, fmt.Errorf("payout account holds %s: %w", payout.Currency, ErrCurrencyMismatch)
+	}
+
+	return &Transfer{
+		FromNumber: acc.Number,
+		ToNumber:   payout.Number,
+		Money:      Money{Amount: acc.Balance, Currency: acc.Currency},
+	}, nil
+}
+
+// what an account.close audit entry records
+type closeSnapshot struct {
+	Account *Account  `json:"account"`
+	Payout  *Transfer `json:"payout,omitempty"`
+}
+
+func accountNumberParameter(r *http.Request) (int64, error) {
+	parameter, err := getParameter(r, "number")
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(parameter, 10, 64)
+}
+
+func (s *ApiServer) handleFreezeAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.setAccountStatus(w, r, AccountFrozen, auditAccountFreeze)
+}
+
+func (s *ApiServer) handleUnfreezeAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.setAccountStatus(w, r, AccountActive, auditAccountUnfreeze)
+}
+
+func (s *ApiServer) setAccountStatus(w http.ResponseWriter, r *http.Request, status AccountStatus, action string) error {
+	if _, err := decodeAndValidateRequest[AccountStatusRequest](r); err != nil {
+		fmt.Println("Error decoding account status request")
+		return writeStaffRequestError(w, err)
+	}
+
+	number, err := accountNumberParameter(r)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
+
+	if err := s.store.SetAccountStatus(number, status, s.auditEntry(r, action)); err != nil {
+		switch {
+		case errors.Is(err, ErrAccountNotFound):
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "account not found"})
+		case errors.Is(err, ErrAccountClosed):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "account is closed"})
+		}
+		fmt.Println("Error setting account status")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, map[string]any{"number": number, "status": status})
+}
+
+// closes an account for good, whatever it still holds goes to the payout
+// account in the same transaction
+func (s *ApiServer) handleCloseAccount(w http.ResponseWriter, r *http.Request) error {
+	req, err := decodeAndValidateRequest[CloseAccountRequest](r)
+	if err != nil {
+		fmt.Println("Error decoding close request")
+		return writeStaffRequestError(w, err)
+	}
+
+	number, err := accountNumberParameter(r)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
+
+	payout, err := s.store.CloseAccount(number, req.PayoutAccount, s.auditEntry(r, auditAccountClose))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrAccountNotFound):
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "account not found"})
+		case errors.Is(err, ErrAccountClosed):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "account is already closed"})
+		case errors.Is(err, ErrFundsHeld):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "account still owes a reversal, collect it before closing"})
+		case errors.Is(err, ErrBalanceNotZero):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "account still holds money, pass a payout_account"})
+		case errors.Is(err, ErrInvalidPayoutAccount):
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "payout account must be another active account"})
+		case errors.Is(err, ErrCurrencyMismatch):
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "payout account holds a different currency"})
+		}
+		fmt.Println("Error closing account")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	acc, err := s.store.GetAccountByNumber(number)
+	if err != nil {
+		fmt.Println("Error retrieving closed account")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, CloseAccountResponse{Account: acc, Payout: payout})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// the account changed since the caller read it
+	ErrVersionConflict = errors.New("account has been changed")
+	// the update didn't say which version it was made against
+	ErrIfMatchMissing = errors.New("send the ETag of the account in If-Match")
+)
+
+const maxNameLength = 100
+
+// the version is all that matters, the quotes keep it a valid ETag
+func accountETag(acc *Account) string {
+	return fmt.Sprintf(`"%d"`, acc.Version)
+}
+
+// updates have to say which version they were made against. Browsers and
+// proxies may send the ETag back as a weak validator, the version is the same.
+func parseIfMatch(r *http.Request) (int64, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return 0, ErrIfMatchMissing
+	}
+
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(header, "W/"), `"`), 10, 64)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid If-Match header")
+	}
+
+	return version, nil
+}
+
+func validName(name string) bool {
+	name = strings.TrimSpace(name)
+	return name != "" && len(name) <= maxNameLength
+}
+
+// owners can fix their own names, anything else is up to staff. Closing has
+// its own endpoint because the balance has to go somewhere.
+func (s *ApiServer) checkAccountUpdate(r *http.Request, number int64, req *UpdateAccountRequest) (int, string) {
+	authorizedAccountNumber, _ := r.Context().Value("authorizedAccountNumber").(int64)
+	self := authorizedAccountNumber == number
+
+	if req.FirstName == nil && req.LastName == nil && req.Role == nil && req.Status == nil {
+		return http.StatusBadRequest, "nothing to update"
+	}
+
+	if req.FirstName != nil || req.LastName != nil {
+		if !self && !hasPermission(r, PermAccountsUpdate) {
+			return http.StatusForbidden, fmt.Sprintf("permission denied: %s required", PermAccountsUpdate)
+		}
+		if (req.FirstName != nil && !validName(*req.FirstName)) || (req.LastName != nil && !validName(*req.LastName)) {
+			return http.StatusBadRequest, fmt.Sprintf("names must be between 1 and %d characters", maxNameLength)
+		}
+	}
+
+	if req.Role != nil {
+		if !hasPermission(r, PermRolesManage) {
+			return http.StatusForbidden, fmt.Sprintf("permission denied: %s required", PermRolesManage)
+		}
+		if self {
+			return http.StatusForbidden, "you can't change your own role"
+		}
+	}
+
+	if req.Status != nil {
+		if !hasPermission(r, PermAccountsFreeze) {
+			return http.StatusForbidden, fmt.Sprintf("permission denied: %s required", PermAccountsFreeze)
+		}
+		if self {
+			return http.StatusForbidden, "you can't change your own status"
+		}
+		switch *req.Status {
+		case AccountActive, AccountFrozen:
+		case AccountClosed:
+			return http.StatusBadRequest, fmt.Sprintf("close accounts with POST /account/%d/close", number)
+		default:
+			return http.StatusBadRequest, "status must be active or frozen"
+		}
+	}
+
+	return 0, ""
+}
+
+func (s *ApiServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request) error {
+	number, err := accountNumberParameter(r)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
+
+	var req UpdateAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
+
+	if status, message := s.checkAccountUpdate(r, number, &req); status != 0 {
+		return WriteJson(w, status, ApiError{Error: message})
+	}
+
+	version, err := parseIfMatch(r)
+	if errors.Is(err, ErrIfMatchMissing) {
+		return WriteJson(w, http.StatusPreconditionRequired, ApiError{Error: err.Error()})
+	}
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+	}
+
+	acc, err := s.store.GetAccountByNumber(number)
+	if err != nil {
+		if errors.Is(err, ErrAccountNotFound) {
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "account not found"})
+		}
+		fmt.Println("Error retrieving account")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	// the store checks the version again while it holds the row
+	if acc.Version != version {
+		w.Header().Set("ETag", accountETag(acc))
+		return WriteJson(w, http.StatusPreconditionFailed, ApiError{Error: "account has been changed, fetch it again"})
+	}
+
+	if req.FirstName != nil {
+		acc.FirstName = strings.TrimSpace(*req.FirstName)
+	}
+	if req.LastName != nil {
+		acc.LastName = strings.TrimSpace(*req.LastName)
+	}
+	if req.Role != nil {
+		acc.Role = *req.Role
+	}
+	if req.Status != nil {
+		acc.Status = *req.Status
+	}
+
+	if err := s.store.UpdateAccount(acc, s.auditEntry(r, auditAccountUpdate)); err != nil {
+		switch {
+		case errors.Is(err, ErrVersionConflict):
+			return WriteJson(w, http.StatusPreconditionFailed, ApiError{Error: "account has been changed, fetch it again"})
+		case errors.Is(err, ErrAccountNotFound):
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "account not found"})
+		case errors.Is(err, ErrAccountClosed):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "account is closed"})
+		case errors.Is(err, ErrRoleNotFound):
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "unknown role"})
+		}
+		fmt.Println("Error updating account")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	w.Header().Set("ETag", accountETag(acc))
+	return WriteJson(w, http.StatusOK, acc)
+}
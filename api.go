@@ -1,8 +1,8 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,43 +11,127 @@ import (
 
 	"time"
 
-	jwt "github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 )
 
 type ApiServer struct {
-	listenAddr string
-	store      Storage
+	listenAddr      string
+	store           Storage
+	idempotencyTTL  time.Duration
+	fx              *FXService
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	jwtIssuer       string
+	jwtAudience     string
+	jwtLeeway       time.Duration
+	keys            *KeySet
+	login           LoginConfig
+	mfaSecrets      *SecretBox
+	stepUp          StepUpConfig
+	passwords       PasswordConfig
+	withdrawals     WithdrawalConfig
 }
 
 func NewApiServer(listenAddr string, store Storage) *ApiServer {
 	return &ApiServer{
-		listenAddr: listenAddr,
-		store:      store,
+		listenAddr:      listenAddr,
+		store:           store,
+		idempotencyTTL:  defaultIdempotencyTTL,
+		fx:              NewFXService(NewStaticRateProvider(nil), 0, defaultFXQuoteTTL),
+		accessTokenTTL:  defaultAccessTokenTTL,
+		refreshTokenTTL: defaultRefreshTokenTTL,
+		jwtIssuer:       defaultJWTIssuer,
+		jwtAudience:     defaultJWTAudience,
+		jwtLeeway:       defaultJWTClockSkew,
+		keys:            NewHMACKeySet([]byte(os.Getenv("JWT_SECRET"))),
+		login:           defaultLoginConfig(),
+		mfaSecrets:      devSecretBox(),
+		stepUp:          defaultStepUpConfig(),
+		passwords:       defaultPasswordConfig(),
+		withdrawals:     defaultWithdrawalConfig(),
 	}
 }
 
 func (s *ApiServer) Run() {
+	router := s.newRouter()
+
+	go s.purgeIdempotencyKeys()
+	go s.purgeExpiredTokens()
+	go s.purgeLoginAttempts()
+
+	//start server
+	log.Println("Starting the server port: ", s.listenAddr)
+	http.ListenAndServe(s.listenAddr, router)
+}
+
+// every authenticated route declares the permission it needs, routes without
+// one are open to any logged in account for its own data
+func (s *ApiServer) newRouter() *mux.Router {
 	router := mux.NewRouter()
+	router.Use(s.requestIdMiddleware)
 
-	//admin endpoints
+	//staff endpoints
 	router.HandleFunc("/accounts",
-		jwtAuthMiddleware(makeHttpHandleFunc(s.handleGetAccounts))).Methods("POST")
+		s.jwtAuthMiddleware(s.requirePermission(PermAccountsRead, makeHttpHandleFunc(s.handleGetAccounts)))).Methods("GET")
 	router.HandleFunc("/account",
-		jwtAuthMiddleware(makeHttpHandleFunc(s.handleCreateAccount))).Methods("POST")
-	router.HandleFunc("/account/{id}",
-		jwtAuthMiddleware(makeHttpHandleFunc(s.handleDeleteAccount))).Methods("DELETE")
+		s.jwtAuthMiddleware(s.requirePermission(PermAccountsCreate, s.idempotencyMiddleware(makeHttpHandleFunc(s.handleCreateAccount))))).Methods("POST")
+	router.HandleFunc("/account/{number}/freeze",
+		s.jwtAuthMiddleware(s.requirePermission(PermAccountsFreeze, makeHttpHandleFunc(s.handleFreezeAccount)))).Methods("POST")
+	router.HandleFunc("/account/{number}/unfreeze",
+		s.jwtAuthMiddleware(s.requirePermission(PermAccountsFreeze, makeHttpHandleFunc(s.handleUnfreezeAccount)))).Methods("POST")
+	router.HandleFunc("/account/{number}/close",
+		s.jwtAuthMiddleware(s.requirePermission(PermAccountsClose, makeHttpHandleFunc(s.handleCloseAccount)))).Methods("POST")
+	router.HandleFunc("/account/{number}/deposit",
+		s.jwtAuthMiddleware(s.requirePermission(PermCashDeposit, s.idempotencyMiddleware(makeHttpHandleFunc(s.handleDeposit))))).Methods("POST")
+	router.HandleFunc("/account/{number}/withdraw",
+		s.jwtAuthMiddleware(s.requirePermission(PermCashWithdraw, s.idempotencyMiddleware(makeHttpHandleFunc(s.handleWithdraw))))).Methods("POST")
+	router.HandleFunc("/account/{number}/unlock",
+		s.jwtAuthMiddleware(s.requirePermission(PermAccountsUnlock, makeHttpHandleFunc(s.handleUnlockAccount)))).Methods("POST")
+	router.HandleFunc("/account/{number}/password/reset",
+		s.jwtAuthMiddleware(s.requirePermission(PermPasswordsReset, makeHttpHandleFunc(s.handleCreatePasswordReset)))).Methods("POST")
+	router.HandleFunc("/account/{number}/role",
+		s.jwtAuthMiddleware(s.requirePermission(PermRolesManage, makeHttpHandleFunc(s.handleSetAccountRole)))).Methods("PUT")
+	router.HandleFunc("/transfer/{id}/reverse",
+		s.jwtAuthMiddleware(s.requirePermission(PermTransfersReverse, s.idempotencyMiddleware(makeHttpHandleFunc(s.handleReverseTransfer))))).Methods("POST")
+	router.HandleFunc("/audit",
+		s.jwtAuthMiddleware(s.requirePermission(PermAuditRead, makeHttpHandleFunc(s.handleGetAuditLog)))).Methods("GET")
+	router.HandleFunc("/audit/verify",
+		s.jwtAuthMiddleware(s.requirePermission(PermAuditRead, makeHttpHandleFunc(s.handleVerifyAuditLog)))).Methods("GET")
+	router.HandleFunc("/roles",
+		s.jwtAuthMiddleware(s.requirePermission(PermRolesManage, makeHttpHandleFunc(s.handleGetRoles)))).Methods("GET")
+	router.HandleFunc("/roles/{name}",
+		s.jwtAuthMiddleware(s.requirePermission(PermRolesManage, makeHttpHandleFunc(s.handleSaveRole)))).Methods("PUT")
+	router.HandleFunc("/roles/{name}",
+		s.jwtAuthMiddleware(s.requirePermission(PermRolesManage, makeHttpHandleFunc(s.handleDeleteRole)))).Methods("DELETE")
 
 	//user endpoints
+	router.HandleFunc("/account/password",
+		s.jwtAuthMiddleware(makeHttpHandleFunc(s.handleChangePassword))).Methods("POST")
+	router.HandleFunc("/password/reset", makeHttpHandleFunc(s.handleResetPassword)).Methods("POST")
 	router.HandleFunc("/login", makeHttpHandleFunc(s.handleLogin)).Methods("POST")
+	router.HandleFunc("/login/mfa", makeHttpHandleFunc(s.handleMFALogin)).Methods("POST")
+	router.HandleFunc("/account/mfa/enroll",
+		s.mfaEnrollmentMiddleware(makeHttpHandleFunc(s.handleMFAEnroll))).Methods("POST")
+	router.HandleFunc("/account/mfa/verify",
+		s.mfaEnrollmentMiddleware(makeHttpHandleFunc(s.handleMFAVerify))).Methods("POST")
+	router.HandleFunc("/auth/step-up",
+		s.jwtAuthMiddleware(makeHttpHandleFunc(s.handleStepUp))).Methods("POST")
+	router.HandleFunc("/token/refresh", makeHttpHandleFunc(s.handleRefreshToken)).Methods("POST")
+	router.HandleFunc("/.well-known/jwks.json", makeHttpHandleFunc(s.handleJWKS)).Methods("GET")
+	router.HandleFunc("/logout", s.jwtAuthMiddleware(makeHttpHandleFunc(s.handleLogout))).Methods("POST")
 	router.HandleFunc("/account/get",
-		jwtAuthMiddleware(makeHttpHandleFunc(s.handleGetAccountByNumber))).Methods("POST")
+		s.jwtAuthMiddleware(makeHttpHandleFunc(s.handleGetAccountByNumber))).Methods("POST")
+	// which fields need which permission is checked per field
+	router.HandleFunc("/account/{number}",
+		s.jwtAuthMiddleware(makeHttpHandleFunc(s.handleUpdateAccount))).Methods("PATCH")
 	router.HandleFunc("/transfer",
-		jwtAuthMiddleware(makeHttpHandleFunc(s.handleTransfer))).Methods("POST")
+		s.jwtAuthMiddleware(s.requirePermission(PermTransfersCreate, s.idempotencyMiddleware(makeHttpHandleFunc(s.handleTransfer))))).Methods("POST")
+	router.HandleFunc("/account/{number}/transactions",
+		s.jwtAuthMiddleware(makeHttpHandleFunc(s.handleGetTransactions))).Methods("GET")
+	router.HandleFunc("/fx/quote",
+		s.jwtAuthMiddleware(s.requirePermission(PermTransfersCreate, makeHttpHandleFunc(s.handleFXQuote)))).Methods("POST")
 
-	//start server
-	log.Println("Starting the server port: ", s.listenAddr)
-	http.ListenAndServe(s.listenAddr, router)
+	return router
 }
 
 func (s *ApiServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
@@ -58,67 +142,116 @@ func (s *ApiServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
 		return fmt.Errorf("Not Authenticated")
 	}
 
+	// checked before the account is looked up so unknown numbers are
+	// throttled the same way as real ones
+	ip := clientIP(r)
+	now := time.Now().UTC()
+	wait, err := s.loginBlocked(req.Number, ip, now)
+	if err != nil {
+		fmt.Println("Error checking login attempts")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+	if wait > 0 {
+		return writeTooManyAttempts(w, wait)
+	}
+
 	//handle acc
 	acc, err := s.store.GetAccountByNumber(req.Number)
 
 	if err != nil {
 		fmt.Println("Error retrieving account")
+		s.recordLoginFailure(req.Number, ip, now)
 		return fmt.Errorf("Not Authenticated")
 
 	}
 
-	//verify that the passwords match
-	if err := acc.ValidatePassword(req.Password); err != nil {
+	//verify that the passwords match, closed accounts can't log in at all
+	if err := acc.ValidatePassword(req.Password); err != nil || acc.Status == AccountClosed {
+		s.recordLoginFailure(req.Number, ip, now)
 		return fmt.Errorf("Not Authenticated")
 	}
+	s.rehashPassword(acc, req.Password)
 
-	token, err := createJwt(acc)
-	if err != nil {
-		fmt.Println("Error creating JWT")
-		return fmt.Errorf("Not Authenticated")
+	// the failed attempts are only cleared once the code has been checked
+	mfa, err := s.store.GetMFASecret(acc.Number)
+	if err != nil && !errors.Is(err, ErrMFANotEnrolled) {
+		fmt.Println("Error retrieving mfa secret")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+	if mfa != nil && mfa.EnabledAt != nil {
+		challenge, err := s.createMFAChallenge(acc)
+		if err != nil {
+			fmt.Println("Error creating mfa challenge")
+			return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+		}
+		return WriteJson(w, http.StatusOK, challenge)
 	}
 
-	resp := LoginResponse{
-		Number: acc.Number,
-		Token:  token,
+	if err := s.store.ResetLoginAttempts(accountLoginKey(acc.Number), nil); err != nil {
+		fmt.Println("Error resetting login attempts")
+	}
+
+	resp, err := s.issueTokens(acc, []string{authMethodPassword})
+	if err != nil {
+		fmt.Println("Error creating tokens")
+		return fmt.Errorf("Not Authenticated")
 	}
 
 	return WriteJson(w, http.StatusOK, resp)
 }
 
 func (s *ApiServer) handleGetAccounts(w http.ResponseWriter, r *http.Request) error {
-	_, err := decodeAndValidateRequest[GetAccountRequest](r, "admin")
+	// listing is never about the caller's own account
+	reason, err := actionReason(r)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+	}
 
+	// rejected requests read nothing, so they aren't recorded
+	filter, sort, err := parseAccountFilter(r)
 	if err != nil {
-		fmt.Println("Error validating request")
-		return WriteJson(w, http.StatusBadRequest, err)
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
 	}
 
-	accounts, err := s.store.GetAccounts()
+	if err := s.recordStaffAction(r, staffActionListAccounts, 0, 0, reason); err != nil {
+		fmt.Println("Error recording staff action")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	// fetch one extra row to know whether there is a next page
+	limit := filter.Limit
+	filter.Limit = limit + 1
+
+	accounts, err := s.store.GetAccounts(filter)
 	if err != nil {
 		fmt.Println("Error retrieving accounts")
-		return err
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	resp := AccountListResponse{Accounts: accounts}
+	if len(accounts) > limit {
+		resp.Accounts = accounts[:limit]
+		resp.NextCursor = encodeAccountCursor(resp.Accounts[limit-1], sort, filter.Sort)
 	}
 
-	return WriteJson(w, http.StatusOK, accounts)
+	return WriteJson(w, http.StatusOK, resp)
 }
 
-func decodeAndValidateRequest[T any](r *http.Request, requestType string) (*T, error) {
+var (
+	ErrInvalidRequestBody = errors.New("invalid request body")
+	ErrAccountMismatch    = errors.New("access denied: account numbers do not match")
+)
+
+// decodes the body and checks it is about the caller's own account, what the
+// caller may do at all is declared on the route
+func decodeAndValidateRequest[T any](r *http.Request) (*T, error) {
 	// Create a new instance of the request type
 	req := new(T)
 	authorizedAccountNumber := r.Context().Value("authorizedAccountNumber").(int64)
-	role, ok := r.Context().Value("role").(string)
-
-	// handle admin request
-	if requestType == "admin" {
-		if !ok || role != "admin" {
-			return nil, fmt.Errorf("Insufficient permissions: admin role required")
-		}
-	}
 
 	// Decode the request body
 	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRequestBody, err)
 	}
 	defer r.Body.Close()
 
@@ -129,47 +262,78 @@ func decodeAndValidateRequest[T any](r *http.Request, requestType string) (*T, e
 	}
 
 	if reqWithAccount.GetAccountNumber() != authorizedAccountNumber {
-		return nil, fmt.Errorf("access denied: account numbers do not match")
+		return nil, ErrAccountMismatch
 	}
 
 	return req, nil
 }
 
+// staff requests name the caller in admin_account, a body that can't be read
+// is the client's mistake rather than a permission problem
+func writeStaffRequestError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, ErrInvalidRequestBody) {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid request body"})
+	}
+	return WriteJson(w, http.StatusForbidden, ApiError{Error: "permission denied"})
+}
+
 func (s *ApiServer) handleGetAccountByNumber(w http.ResponseWriter, r *http.Request) error {
-	getAccountRequest, err := decodeAndValidateRequest[GetAccountRequest](r, "user")
+	var getAccountRequest GetAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&getAccountRequest); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
 
-	if err != nil {
-		fmt.Println("Error validating request")
-		return fmt.Errorf("Error processing request")
+	if ok, err := s.authorizeAccountAccess(w, r, getAccountRequest.Number, PermAccountsRead, staffActionReadAccount); !ok {
+		return err
 	}
 
 	account, err := s.store.GetAccountByNumber(getAccountRequest.Number)
 	if err != nil {
+		if errors.Is(err, ErrAccountNotFound) {
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "account not found"})
+		}
 		fmt.Println("Error retrieving account from db")
 		return fmt.Errorf("Error processing request")
 	}
 
+	w.Header().Set("ETag", accountETag(account))
 	return WriteJson(w, http.StatusOK, account)
 }
 
 func (s *ApiServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
-	//todo check that it's admin
-	accRequest, err := decodeAndValidateRequest[CreateAccountRequest](r, "admin")
+	accRequest, err := decodeAndValidateRequest[CreateAccountRequest](r)
 	if err != nil {
 		return err
 	}
 
 	//default the role to user
 	if accRequest.Role == "" {
-		accRequest.Role = "user"
+		accRequest.Role = roleUser
 	}
 
-	account, err := NewAccount(accRequest.FirstName, accRequest.LastName, accRequest.Password, accRequest.Role, accRequest.Balance)
+	// a teller can open accounts but not hand out staff roles
+	if accRequest.Role != roleUser && !hasPermission(r, PermRolesManage) {
+		return WriteJson(w, http.StatusForbidden, ApiError{Error: fmt.Sprintf("permission denied: %s required", PermRolesManage)})
+	}
+
+	currency := DefaultCurrency
+	if accRequest.Currency != "" {
+		if currency, err = ParseCurrency(accRequest.Currency); err != nil {
+			return err
+		}
+	}
+
+	// accounts open empty, money only comes in through a deposit
+	account, err := NewAccount(accRequest.FirstName, accRequest.LastName, accRequest.Password, accRequest.Role, 0, s.passwords.BcryptCost)
 	if err != nil {
 		return err
 	}
+	account.Currency = currency
 
-	if err := s.store.CreateAccount(account); err != nil {
+	if err := s.store.CreateAccount(account, s.auditEntry(r, auditAccountCreate)); err != nil {
+		if errors.Is(err, ErrRoleNotFound) {
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "unknown role"})
+		}
 		fmt.Println("Error creating account")
 		return err
 	}
@@ -177,61 +341,125 @@ func (s *ApiServer) handleCreateAccount(w http.ResponseWriter, r *http.Request)
 	return WriteJson(w, http.StatusOK, account)
 }
 
-func (s *ApiServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
-	_, err := decodeAndValidateRequest[DeleteAccountRequest](r, "admin")
-
+func (s *ApiServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
+	getTransferRequest, err := decodeAndValidateRequest[TransferRequest](r)
 	if err != nil {
-		fmt.Println("Error decoding delete request")
-		return WriteJson(w, http.StatusBadRequest, fmt.Errorf("Unable to delete account"))
+		fmt.Println("Error decoding into transfer request")
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
 	}
 
-	parameter, err := getParameter(r, "id")
-	if err != nil {
-		fmt.Println("Error retrieving parameter")
-		return WriteJson(w, http.StatusBadRequest, fmt.Errorf("Unable to delete account"))
+	if getTransferRequest.FromNumber == getTransferRequest.ToNumber {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+
 	}
 
-	id, err := strconv.Atoi(parameter)
-	if err != nil {
-		fmt.Printf("Unable to convert parameter %s", parameter)
-		return WriteJson(w, http.StatusBadRequest, fmt.Errorf("Unable to delete account"))
+	if getTransferRequest.Amount == 0 {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
 	}
 
-	if err := s.store.DeleteAccount(id); err != nil {
-		return WriteJson(w, http.StatusBadRequest, fmt.Errorf("Unable to delete account"))
+	// catches typos in the destination before we look anything up
+	if !validAccountNumber(getTransferRequest.ToNumber) {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid destination account number"})
 	}
 
-	return WriteJson(w, http.StatusOK, map[string]int{"deleted": id})
-}
+	if getTransferRequest.Currency != "" {
+		currency, err := ParseCurrency(string(getTransferRequest.Currency))
+		if err != nil {
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+		}
+		getTransferRequest.Currency = currency
+	}
 
-func (s *ApiServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
-	getTransferRequest, err := decodeAndValidateRequest[TransferRequest](r, "user")
-	if err != nil {
-		fmt.Println("Error decoding into transfer request")
-		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	// the balance check happens inside the transfer transaction, checking it
+	// here would race with other transfers from the same account
+	transfer := &Transfer{
+		FromNumber: getTransferRequest.FromNumber,
+		ToNumber:   getTransferRequest.ToNumber,
+		Money: Money{
+			Amount:   getTransferRequest.Amount,
+			Currency: getTransferRequest.Currency,
+		},
 	}
 
-	if getTransferRequest.FromNumber == getTransferRequest.ToNumber {
-		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	switch {
+	case getTransferRequest.QuoteId != "":
+		quote, err := s.store.GetFXQuote(getTransferRequest.QuoteId)
+		if err != nil {
+			if errors.Is(err, ErrQuoteNotFound) {
+				return WriteJson(w, http.StatusBadRequest, ApiError{Error: "unknown quote"})
+			}
+			fmt.Println("Could not retrieve fx quote")
+			return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+		}
 
-	}
+		if quote.FromNumber != transfer.FromNumber || quote.ToNumber != transfer.ToNumber || quote.Amount != transfer.Amount {
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "quote does not match the transfer"})
+		}
+		if !time.Now().Before(quote.ExpiresAt) {
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "quote has expired"})
+		}
+		if quote.UsedAt != nil {
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "quote has already been used"})
+		}
 
-	fromAccount, err := s.store.GetAccountByNumber(getTransferRequest.FromNumber)
-	if err != nil {
-		fmt.Println("Error retrieving source account")
-		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
-	}
-	if fromAccount.Balance < getTransferRequest.Amount {
-		fmt.Println("Insufficient funds in source account")
-		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+		transfer.Money = quote.Money
+		transfer.FX = &FXDetails{Rate: quote.Rate, Converted: quote.Converted, QuoteId: quote.Id}
+
+	case getTransferRequest.Convert:
+		// priced at the current rate, clients that want a guaranteed rate
+		// ask for a quote first
+		fromAccount, err := s.store.GetAccountByNumber(transfer.FromNumber)
+		if err != nil {
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+		}
+		toAccount, err := s.store.GetAccountByNumber(transfer.ToNumber)
+		if err != nil {
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+		}
+
+		if transfer.Currency == "" {
+			transfer.Currency = fromAccount.Currency
+		}
+		if transfer.Currency != fromAccount.Currency {
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "accounts hold different currencies"})
+		}
+
+		if fromAccount.Currency != toAccount.Currency {
+			fx, err := s.fx.Convert(transfer.Money, toAccount.Currency)
+			if err != nil {
+				return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+			}
+			transfer.FX = fx
+		}
 	}
 
-	toAccount, err := s.store.GetAccountByNumber(getTransferRequest.ToNumber)
+	// checked last, the amount can come from the quote
+	transfer.AuthFactor, err = s.authorizeTransferAmount(w, r, transfer.Amount)
 	if err != nil {
-		fmt.Println("Could not retrieve destination account")
+		fmt.Println("Error checking step-up token")
 		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
 	}
-	if err := s.store.TransferMoney(fromAccount, toAccount, getTransferRequest.Amount); err != nil {
+	if transfer.AuthFactor == "" {
+		return nil
+	}
+
+	if err := s.store.TransferMoney(transfer, s.auditEntry(r, auditTransferCreate)); err != nil {
+		switch {
+		case errors.Is(err, ErrCurrencyMismatch):
+			fmt.Println("Transfer between accounts in different currencies")
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "accounts hold different currencies"})
+		case errors.Is(err, ErrInsufficientFunds):
+			fmt.Println("Insufficient funds in source account")
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+		case errors.Is(err, ErrAccountNotFound):
+			fmt.Println("Could not retrieve transfer accounts")
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+		case errors.Is(err, ErrQuoteUsed), errors.Is(err, ErrQuoteNotFound):
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "quote has already been used"})
+		case errors.Is(err, ErrAccountFrozen), errors.Is(err, ErrAccountClosed), errors.Is(err, ErrFundsHeld):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: err.Error()})
+		}
+
 		fmt.Println("Could complete the transfer")
 		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
 	}
@@ -245,93 +473,154 @@ func (s *ApiServer) handleTransfer(w http.ResponseWriter, r *http.Request) error
 	return WriteJson(w, http.StatusOK, fromAccountUpdated)
 }
 
-// least important functions should go to the bottom
-func WriteJson(w http.ResponseWriter, status int, v any) error {
-	w.WriteHeader(status)
-	w.Header().Set("Content-Type", "application/json")
-	return json.NewEncoder(w).Encode(v)
-}
+// prices a cross-currency transfer, the quote id can be passed to /transfer
+// to get exactly this rate until the quote expires
+func (s *ApiServer) handleFXQuote(w http.ResponseWriter, r *http.Request) error {
+	quoteRequest, err := decodeAndValidateRequest[FXQuoteRequest](r)
+	if err != nil {
+		fmt.Println("Error decoding into fx quote request")
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
 
-// todo - needs to be corrected, redundant to call WriteJson
-func getClaimsMap(w http.ResponseWriter, r *http.Request) (jwt.MapClaims, error) {
-	tokenString := r.Header.Get("x-jwt-token")
-	if tokenString == "" {
-		WriteJson(w, http.StatusUnauthorized, ApiError{Error: "authentication required"})
-		return nil, fmt.Errorf("Not logged in.")
+	if quoteRequest.Amount == 0 || quoteRequest.FromNumber == quoteRequest.ToNumber {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
 	}
 
-	token, err := validateJwt(tokenString)
-	if err != nil || !token.Valid {
-		WriteJson(w, http.StatusForbidden, ApiError{Error: "permission denied"})
-		return nil, fmt.Errorf("Can't validate token.")
+	if !validAccountNumber(quoteRequest.ToNumber) {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid destination account number"})
 	}
 
-	//check the claims
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		fmt.Println("Invalid claims")
+	fromAccount, err := s.store.GetAccountByNumber(quoteRequest.FromNumber)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
+	toAccount, err := s.store.GetAccountByNumber(quoteRequest.ToNumber)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
+
+	if fromAccount.Currency == toAccount.Currency {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "accounts hold the same currency"})
+	}
+
+	quote, err := s.fx.Quote(fromAccount, toAccount, quoteRequest.Amount)
+	if err != nil {
+		if errors.Is(err, ErrNoRate) || errors.Is(err, ErrAmountTooSmall) {
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+		}
+		fmt.Println("Could not price fx quote")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
 
-		return nil, WriteJson(w, http.StatusUnauthorized, ApiError{Error: "permission denied"})
+	if err := s.store.CreateFXQuote(quote); err != nil {
+		fmt.Println("Could not store fx quote")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
 	}
 
-	return claims, nil
+	return WriteJson(w, http.StatusOK, quote)
 }
 
-// this will only check for user claims
-func jwtAuthMiddleware(handlerFunc http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		claims, err := getClaimsMap(w, r)
-		if err != nil {
-			fmt.Println("Invalid claims format")
-			return
-		}
+const (
+	defaultHistoryPageSize = 50
+	maxHistoryPageSize     = 200
+)
 
-		role, ok := claims["role"].(string)
-		if !ok {
-			fmt.Println("Role not specified, defaulting to user")
-			role = "user"
-		}
+func (s *ApiServer) handleGetTransactions(w http.ResponseWriter, r *http.Request) error {
+	parameter, err := getParameter(r, "number")
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
 
-		claimAccountNumber, ok := claims["accountNumber"].(float64)
-		if !ok {
-			fmt.Println("Invalid claim type for accountNumber")
-			WriteJson(w, http.StatusForbidden, ApiError{Error: "permission denied"})
-			return
-		}
+	number, err := strconv.ParseInt(parameter, 10, 64)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
 
-		ctx := context.WithValue(r.Context(), "role", string(role))
-		ctx = context.WithValue(ctx, "authorizedAccountNumber", int64(claimAccountNumber))
+	if ok, err := s.authorizeAccountAccess(w, r, number, PermTransfersRead, staffActionReadTransfers); !ok {
+		return err
+	}
 
-		handlerFunc(w, r.WithContext(ctx))
+	filter, err := parseTransferFilter(r)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+	}
+	filter.AccountNumber = number
+
+	// fetch one extra row to know whether there is a next page
+	limit := filter.Limit
+	filter.Limit = limit + 1
+
+	transfers, err := s.store.GetTransfers(filter)
+	if err != nil {
+		fmt.Println("Error retrieving transfers")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	resp := TransactionHistoryResponse{Transactions: transfers}
+	if len(transfers) > limit {
+		resp.Transactions = transfers[:limit]
+		resp.NextCursor = resp.Transactions[limit-1].Id
 	}
+
+	return WriteJson(w, http.StatusOK, resp)
 }
 
-func validateJwt(tokenString string) (*jwt.Token, error) {
-	secret := os.Getenv("JWT_SECRET")
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+func parseTransferFilter(r *http.Request) (TransferFilter, error) {
+	query := r.URL.Query()
+	filter := TransferFilter{
+		Direction: DirectionAll,
+		Limit:     defaultHistoryPageSize,
+	}
+
+	if direction := query.Get("direction"); direction != "" {
+		switch TransferDirection(direction) {
+		case DirectionAll, DirectionIncoming, DirectionOutgoing:
+			filter.Direction = TransferDirection(direction)
+		default:
+			return filter, fmt.Errorf("direction must be one of all, in, out")
 		}
+	}
 
-		return []byte(secret), nil
-	})
-}
+	if from := query.Get("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return filter, fmt.Errorf("from must be an RFC3339 timestamp")
+		}
+		filter.From = t
+	}
+
+	if to := query.Get("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return filter, fmt.Errorf("to must be an RFC3339 timestamp")
+		}
+		filter.To = t
+	}
 
-func createJwt(account *Account) (string, error) {
-	// Create the Claims
-	claims := &jwt.MapClaims{
-		"role":          account.Role,
-		"expiresAt":     jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		"accountNumber": account.Number,
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxHistoryPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxHistoryPageSize)
+		}
+		filter.Limit = n
 	}
 
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		return "", fmt.Errorf("JWT_SECRET environment variable not set")
+	if cursor := query.Get("cursor"); cursor != "" {
+		id, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || id < 1 {
+			return filter, fmt.Errorf("invalid cursor")
+		}
+		filter.BeforeId = id
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	return token.SignedString([]byte(secret))
+	return filter, nil
+}
+
+// least important functions should go to the bottom
+func WriteJson(w http.ResponseWriter, status int, v any) error {
+	w.WriteHeader(status)
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
 }
 
 // my functions are of this type by virtue of the signature
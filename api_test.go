@@ -3,9 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -21,47 +23,72 @@ import (
 // this line is needed by the go generate command to generate gomock files
 //go:generate mockgen -destination=mock_storage.go -package=main . Storage
 
+func TestMain(m *testing.M) {
+	// the handlers sign and validate tokens with JWT_SECRET
+	if os.Getenv("JWT_SECRET") == "" {
+		os.Setenv("JWT_SECRET", "gobank-test-secret")
+	}
+
+	os.Exit(m.Run())
+}
+
 func TestHandleGetAccount(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockStore := NewMockStorage(ctrl)
 	server := NewApiServer(":3000", mockStore)
+	expectTokenAccount(mockStore, "admin", 1001)
 
 	//need to set a mock due to api.go:96 03-18-25
 	mockStore.EXPECT().
-		GetAccounts().
-		Return([]*Account{
-			{Id: 1, FirstName: "John", LastName: "Doe", Number: 1001, Role: "admin"},
-		}, nil)
+		GetAccounts(gomock.Any()).
+		DoAndReturn(func(filter AccountFilter) ([]*Account, error) {
+			assert.Equal(t, "admin", filter.Role)
+			assert.Equal(t, SortBalance, filter.Sort)
+			assert.True(t, filter.Descending)
+			assert.Equal(t, 2, filter.Limit)
+			return []*Account{
+				{Id: 1, FirstName: "John", LastName: "Doe", Number: 1001, Role: "admin", Balance: 20},
+			}, nil
+		})
+	mockStore.EXPECT().
+		RecordStaffAction(gomock.Any()).
+		DoAndReturn(func(action *StaffAction) error {
+			assert.Equal(t, int64(1001), action.ActorNumber)
+			assert.Equal(t, staffActionListAccounts, action.Action)
+			assert.Equal(t, "monthly review", action.Reason)
+			return nil
+		})
 
-	requestBodyJson := `{"number": 1001}`
-	req := httptest.NewRequest("GET", "/accounts", strings.NewReader(requestBodyJson))
-	req.Header.Set("Content-Type", "application/json")
+	req := httptest.NewRequest("GET", "/accounts?role=admin&sort=-balance&limit=1", nil)
 	req.Header.Set("x-jwt-token", createTestJWT(t, 1001, "admin"))
+	req.Header.Set(actionReasonHeader, "monthly review")
 
 	recorder := httptest.NewRecorder()
 
 	router := mux.NewRouter()
-	router.HandleFunc("/accounts", jwtAuthMiddleware(makeHttpHandleFunc(server.handleGetAccounts))).Methods("GET")
+	router.HandleFunc("/accounts", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleGetAccounts))).Methods("GET")
 
 	router.ServeHTTP(recorder, req)
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
-	var accounts []*Account
-	err := json.Unmarshal(recorder.Body.Bytes(), &accounts)
+	var resp AccountListResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &resp)
 	require.NoError(t, err)
-	assert.Len(t, accounts, 1)
-	assert.Equal(t, int64(1001), accounts[0].Number)
-	assert.Equal(t, "John", accounts[0].FirstName)
-	assert.Equal(t, "Doe", accounts[0].LastName)
+	assert.Len(t, resp.Accounts, 1)
+	assert.Equal(t, int64(1001), resp.Accounts[0].Number)
+	assert.Equal(t, "John", resp.Accounts[0].FirstName)
+	assert.Equal(t, "Doe", resp.Accounts[0].LastName)
+	assert.Empty(t, resp.NextCursor)
 }
 
 func TestHandleCreateAccount(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockStore := NewMockStorage(ctrl)
 	server := NewApiServer(":3000", mockStore)
+	expectTokenAccount(mockStore, "admin", 1337)
 
 	mockStore.EXPECT().
-		CreateAccount(gomock.Any()).
+		CreateAccount(gomock.Any(), gomock.Any()).
 		Return(nil).
 		Times(1)
 
@@ -80,7 +107,7 @@ func TestHandleCreateAccount(t *testing.T) {
 	recorder := httptest.NewRecorder()
 
 	router := mux.NewRouter()
-	router.HandleFunc("/account", jwtAuthMiddleware(makeHttpHandleFunc(server.handleCreateAccount))).Methods("POST")
+	router.HandleFunc("/account", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleCreateAccount))).Methods("POST")
 
 	router.ServeHTTP(recorder, req)
 	assert.Equal(t, http.StatusOK, recorder.Code)
@@ -88,38 +115,52 @@ func TestHandleCreateAccount(t *testing.T) {
 	account := new(Account)
 	err := json.Unmarshal(recorder.Body.Bytes(), &account)
 	require.NoError(t, err)
-	assert.Equal(t, account.Balance, uint64(20))
+	//a balance in the request is ignored, money only comes in through a deposit
+	assert.Equal(t, account.Balance, uint64(0))
 	assert.Equal(t, account.Role, "user")
+	assert.Equal(t, account.Currency, DefaultCurrency)
 	assert.Equal(t, account.FirstName, "tars")
 	assert.Equal(t, account.LastName, "robo")
 }
 
-func TestHandleDeleteAccount(t *testing.T) {
+func TestHandleCloseAccount(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockStore := NewMockStorage(ctrl)
 	server := NewApiServer(":3000", mockStore)
+	expectTokenAccount(mockStore, "admin", 1337)
 
+	payout := &Transfer{Id: 7, FromNumber: 4242, ToNumber: 1337, Money: Money{Amount: 50, Currency: DefaultCurrency}}
 	mockStore.EXPECT().
-		DeleteAccount(gomock.Any()).
-		Return(nil).
+		CloseAccount(int64(4242), int64(1337), gomock.Any()).
+		Return(payout, nil).
+		Times(1)
+	mockStore.EXPECT().
+		GetAccountByNumber(int64(4242)).
+		Return(&Account{Number: 4242, Status: AccountClosed}, nil).
 		Times(1)
 
 	requestBodyJson := `{
-	        "admin_account": 1337
+	        "admin_account": 1337,
+	        "payout_account": 1337
 	}`
 
-	endpoint := fmt.Sprintf("/account/%d", 1337)
-	req := httptest.NewRequest("DELETE", endpoint, strings.NewReader(requestBodyJson))
+	endpoint := fmt.Sprintf("/account/%d/close", 4242)
+	req := httptest.NewRequest("POST", endpoint, strings.NewReader(requestBodyJson))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("x-jwt-token", createTestJWT(t, 1337, "admin"))
 
 	recorder := httptest.NewRecorder()
 
 	router := mux.NewRouter()
-	router.HandleFunc("/account/{id}", jwtAuthMiddleware(makeHttpHandleFunc(server.handleDeleteAccount))).Methods("DELETE")
+	router.HandleFunc("/account/{number}/close", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleCloseAccount))).Methods("POST")
 
 	router.ServeHTTP(recorder, req)
 	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var resp CloseAccountResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	assert.Equal(t, AccountClosed, resp.Account.Status)
+	assert.Equal(t, uint64(50), resp.Payout.Amount)
 }
 
 func TestHandleLogin(t *testing.T) {
@@ -143,6 +184,22 @@ func TestHandleLogin(t *testing.T) {
 		GetAccountByNumber(account.Number).
 		Return(account, nil).
 		Times(1)
+	mockStore.EXPECT().
+		CreateRefreshToken(gomock.Any()).
+		Return(nil).
+		Times(1)
+	mockStore.EXPECT().
+		GetLoginAttempts(gomock.Any()).
+		Return(&LoginAttempts{}, nil).
+		Times(2)
+	mockStore.EXPECT().
+		ResetLoginAttempts("account:9966", nil).
+		Return(nil).
+		Times(1)
+	mockStore.EXPECT().
+		GetMFASecret(int64(9966)).
+		Return(nil, ErrMFANotEnrolled).
+		Times(1)
 
 	requestBodyJson := `{
 	        "number": 9966,
@@ -163,6 +220,8 @@ func TestHandleLogin(t *testing.T) {
 	err := json.Unmarshal(recorder.Body.Bytes(), &loginResponse)
 	require.NoError(t, err)
 	assert.Equal(t, int64(9966), loginResponse.Number)
+	assert.NotEmpty(t, loginResponse.RefreshToken)
+	assert.WithinDuration(t, time.Now().Add(defaultAccessTokenTTL), loginResponse.ExpiresAt, time.Minute)
 
 }
 
@@ -170,6 +229,7 @@ func TestHandleGetAccountByNumber(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockStore := NewMockStorage(ctrl)
 	server := NewApiServer(":3000", mockStore)
+	expectTokenNotRevoked(mockStore)
 
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("secret123"), bcrypt.DefaultCost)
 	account := &Account{
@@ -186,7 +246,7 @@ func TestHandleGetAccountByNumber(t *testing.T) {
 	mockStore.EXPECT().
 		GetAccountByNumber(account.Number).
 		Return(account, nil).
-		Times(1)
+		Times(2)
 
 	requestBodyJson := `{
 	        "number": 9966
@@ -199,7 +259,7 @@ func TestHandleGetAccountByNumber(t *testing.T) {
 	recorder := httptest.NewRecorder()
 
 	router := mux.NewRouter()
-	router.HandleFunc("/account", jwtAuthMiddleware(makeHttpHandleFunc(server.handleGetAccountByNumber))).Methods("GET")
+	router.HandleFunc("/account", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleGetAccountByNumber))).Methods("GET")
 	router.ServeHTTP(recorder, req)
 	assert.Equal(t, http.StatusOK, recorder.Code)
 
@@ -218,6 +278,7 @@ func TestHandleTransfer(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mockStore := NewMockStorage(ctrl)
 	server := NewApiServer(":3000", mockStore)
+	expectTokenNotRevoked(mockStore)
 
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("secret123"), bcrypt.DefaultCost)
 	fromAccount := &Account{
@@ -246,11 +307,7 @@ func TestHandleTransfer(t *testing.T) {
 		Return(fromAccount, nil).
 		Times(2)
 	mockStore.EXPECT().
-		GetAccountByNumber(toAccount.Number).
-		Return(toAccount, nil).
-		Times(1)
-	mockStore.EXPECT().
-		TransferMoney(fromAccount, toAccount, uint64(500)).
+		TransferMoney(&Transfer{FromNumber: fromAccount.Number, ToNumber: toAccount.Number, Money: Money{Amount: 500}, AuthFactor: authFactorSession}, gomock.Any()).
 		Return(nil).
 		Times(1)
 
@@ -267,7 +324,7 @@ func TestHandleTransfer(t *testing.T) {
 	recorder := httptest.NewRecorder()
 
 	router := mux.NewRouter()
-	router.HandleFunc("/transfer", jwtAuthMiddleware(makeHttpHandleFunc(server.handleTransfer))).Methods("POST")
+	router.HandleFunc("/transfer", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleTransfer))).Methods("POST")
 
 	router.ServeHTTP(recorder, req)
 	assert.Equal(t, http.StatusOK, recorder.Code)
@@ -281,18 +338,1335 @@ func TestHandleTransfer(t *testing.T) {
 	assert.Equal(t, fromAccount.LastName, returnedAcc.LastName)
 }
 
-func createTestJWT(t *testing.T, accountNumber int64, role string) string {
-	secret := os.Getenv("JWT_SECRET")
+func TestHandleTransferInsufficientFunds(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockStore := NewMockStorage(ctrl)
+	server := NewApiServer(":3000", mockStore)
+	expectTokenAccount(mockStore, "user", 9901)
+
+	mockStore.EXPECT().
+		TransferMoney(gomock.Any(), gomock.Any()).
+		Return(fmt.Errorf("transfer failed: %w", ErrInsufficientFunds)).
+		Times(1)
+
+	requestBodyJson := `{
+	   "from_number": 9901,
+	   "to_number": 9902,
+	   "amount": 5000
+	}`
+
+	req := httptest.NewRequest("POST", "/transfer", strings.NewReader(requestBodyJson))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-jwt-token", createTestJWT(t, 9901, "user"))
+
+	recorder := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/transfer", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleTransfer))).Methods("POST")
+
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestHandleTransferExpiredQuote(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockStore := NewMockStorage(ctrl)
+	server := NewApiServer(":3000", mockStore)
+	expectTokenAccount(mockStore, "user", 9901)
+
+	mockStore.EXPECT().
+		GetFXQuote("abc123").
+		Return(&FXQuote{
+			Id:         "abc123",
+			FromNumber: 9901,
+			ToNumber:   9902,
+			Money:      Money{Amount: 5000, Currency: "USD"},
+			Rate:       Rate(920_000_000),
+			Converted:  Money{Amount: 4600, Currency: "EUR"},
+			ExpiresAt:  time.Now().Add(-time.Second),
+		}, nil).
+		Times(1)
+	mockStore.EXPECT().TransferMoney(gomock.Any(), gomock.Any()).Times(0)
+
+	requestBodyJson := `{
+	   "from_number": 9901,
+	   "to_number": 9902,
+	   "amount": 5000,
+	   "quote_id": "abc123"
+	}`
+
+	req := httptest.NewRequest("POST", "/transfer", strings.NewReader(requestBodyJson))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-jwt-token", createTestJWT(t, 9901, "user"))
+
+	recorder := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/transfer", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleTransfer))).Methods("POST")
+
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "quote has expired")
+}
+
+func TestHandleGetTransactions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockStore := NewMockStorage(ctrl)
+	server := NewApiServer(":3000", mockStore)
+	expectTokenAccount(mockStore, "user", 9901, 9902)
+
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	mockStore.EXPECT().
+		GetTransfers(TransferFilter{
+			AccountNumber: 9901,
+			Direction:     DirectionOutgoing,
+			From:          from,
+			Limit:         3,
+		}).
+		Return([]*Transfer{
+			{Id: 12, FromNumber: 9901, ToNumber: 9902, Money: Money{Amount: 5}, Status: TransferCompleted},
+			{Id: 11, FromNumber: 9901, ToNumber: 9902, Money: Money{Amount: 4}, Status: TransferCompleted},
+			{Id: 10, FromNumber: 9901, ToNumber: 9902, Money: Money{Amount: 3}, Status: TransferCompleted},
+		}, nil).
+		Times(1)
+
+	req := httptest.NewRequest("GET", "/account/9901/transactions?direction=out&limit=2&from=2025-01-01T00:00:00Z", nil)
+	req.Header.Set("x-jwt-token", createTestJWT(t, 9901, "user"))
+
+	recorder := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/account/{number}/transactions", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleGetTransactions))).Methods("GET")
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var history TransactionHistoryResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &history)
+	require.NoError(t, err)
+	assert.Len(t, history.Transactions, 2)
+	assert.Equal(t, int64(11), history.NextCursor)
+
+	//other users can't read the history
+	req = httptest.NewRequest("GET", "/account/9901/transactions", nil)
+	req.Header.Set("x-jwt-token", createTestJWT(t, 9902, "user"))
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestIdempotentCreateAccount(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockStore := NewMockStorage(ctrl)
+	server := NewApiServer(":3000", mockStore)
+	expectTokenAccount(mockStore, "admin", 1337)
+
+	var stored *IdempotencyRecord
+	mockStore.EXPECT().
+		ReserveIdempotencyKey(gomock.Any()).
+		DoAndReturn(func(rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+			if stored != nil {
+				return stored, nil
+			}
+			assert.Equal(t, "1337:abc-123", rec.Key)
+			return nil, nil
+		}).
+		Times(3)
+	mockStore.EXPECT().
+		CompleteIdempotencyKey(gomock.Any()).
+		DoAndReturn(func(rec *IdempotencyRecord) error {
+			stored = rec
+			return nil
+		}).
+		Times(1)
+	mockStore.EXPECT().
+		CreateAccount(gomock.Any(), gomock.Any()).
+		Return(nil).
+		Times(1)
 
-	claims := &jwt.MapClaims{
-		"role":          role,
-		"expiresAt":     jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		"accountNumber": float64(accountNumber),
+	router := mux.NewRouter()
+	router.HandleFunc("/account", server.jwtAuthMiddleware(server.idempotencyMiddleware(makeHttpHandleFunc(server.handleCreateAccount)))).Methods("POST")
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/account", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "abc-123")
+		req.Header.Set("x-jwt-token", createTestJWT(t, 1337, "admin"))
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	requestBodyJson := `{"firstName": "tars", "lastName": "robo", "password": "gobank", "admin_account": 1337}`
+	first := send(requestBodyJson)
+	assert.Equal(t, http.StatusOK, first.Code)
+
+	//a retry gets the same response without creating a second account
+	second := send(requestBodyJson)
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+
+	//same key, different body
+	conflict := send(`{"firstName": "case", "lastName": "robo", "password": "gobank", "admin_account": 1337}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, conflict.Code)
+}
+
+func TestValidateJwtClaims(t *testing.T) {
+	server := NewApiServer(":3000", NewMemoryStore())
+	now := time.Now()
+
+	valid := func() *TokenClaims {
+		return &TokenClaims{
+			Role: "user",
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    defaultJWTIssuer,
+				Subject:   "9901",
+				Audience:  jwt.ClaimStrings{defaultJWTAudience},
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+				NotBefore: jwt.NewNumericDate(now),
+				IssuedAt:  jwt.NewNumericDate(now),
+				ID:        "abc",
+			},
+		}
+	}
+
+	claims, err := server.validateJwt(signTestClaims(t, valid()))
+	require.NoError(t, err)
+	number, err := claims.AccountNumber()
+	require.NoError(t, err)
+	assert.Equal(t, int64(9901), number)
+
+	//expired a moment ago is still within the clock skew
+	skewed := valid()
+	skewed.ExpiresAt = jwt.NewNumericDate(now.Add(-5 * time.Second))
+	_, err = server.validateJwt(signTestClaims(t, skewed))
+	assert.NoError(t, err)
+
+	invalid := map[string]func(c *TokenClaims){
+		"expired":        func(c *TokenClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Hour)) },
+		"no expiry":      func(c *TokenClaims) { c.ExpiresAt = nil },
+		"not yet valid":  func(c *TokenClaims) { c.NotBefore = jwt.NewNumericDate(now.Add(time.Hour)) },
+		"issued later":   func(c *TokenClaims) { c.IssuedAt = jwt.NewNumericDate(now.Add(time.Hour)) },
+		"wrong issuer":   func(c *TokenClaims) { c.Issuer = "someone-else" },
+		"wrong audience": func(c *TokenClaims) { c.Audience = jwt.ClaimStrings{"other-api"} },
+		"no token id":    func(c *TokenClaims) { c.ID = "" },
+		"no subject":     func(c *TokenClaims) { c.Subject = "" },
+		"no not before":  func(c *TokenClaims) { c.NotBefore = nil },
+		"no issued at":   func(c *TokenClaims) { c.IssuedAt = nil },
+	}
+	for name, mutate := range invalid {
+		claims := valid()
+		mutate(claims)
+		_, err := server.validateJwt(signTestClaims(t, claims))
+		assert.Error(t, err, name)
 	}
+}
+
+func TestJwtAuthDeletedAccount(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockStore := NewMockStorage(ctrl)
+	server := NewApiServer(":3000", mockStore)
+	expectTokenNotRevoked(mockStore)
+
+	mockStore.EXPECT().
+		GetAccountByNumber(int64(9901)).
+		Return(nil, fmt.Errorf("account number not found for number %d: %w", 9901, ErrAccountNotFound)).
+		Times(1)
+
+	req := httptest.NewRequest("GET", "/account/9901/transactions", nil)
+	req.Header.Set("x-jwt-token", createTestJWT(t, 9901, "user"))
+
+	recorder := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/account/{number}/transactions", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleGetTransactions))).Methods("GET")
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestLoginLockout(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	server.login = LoginConfig{
+		MaxAccountFailures: 3,
+		MaxIPFailures:      100,
+		Lockout:            Duration(time.Hour),
+		BackoffBase:        Duration(time.Nanosecond),
+		BackoffMax:         Duration(time.Nanosecond),
+	}
+
+	acc, err := NewAccount("John", "Doe", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(acc, nil))
+	admin, err := NewAccount("Ad", "Min", "secret123", "admin", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(admin, nil))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", makeHttpHandleFunc(server.handleLogin)).Methods("POST")
+	router.HandleFunc("/account/{number}/unlock", server.jwtAuthMiddleware(server.requirePermission(PermAccountsUnlock, makeHttpHandleFunc(server.handleUnlockAccount)))).Methods("POST")
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"number": %d, "password": %q}`, acc.Number, password)
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusBadRequest, login("wrong").Code)
+	}
+
+	//locked now, even with the right password
+	recorder := login("secret123")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get("Retry-After"))
+
+	attempts, err := store.GetLoginAttempts(accountLoginKey(acc.Number))
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts.Failures)
+
+	req := httptest.NewRequest("POST", fmt.Sprintf("/account/%d/unlock", acc.Number),
+		strings.NewReader(fmt.Sprintf(`{"admin_account": %d}`, admin.Number)))
+	req.Header.Set("x-jwt-token", createTestJWT(t, admin.Number, "admin"))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
 
+	assert.Equal(t, http.StatusOK, login("secret123").Code)
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+
+	acc, err := NewAccount("John", "Doe", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(acc, nil))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", makeHttpHandleFunc(server.handleLogin)).Methods("POST")
+	router.HandleFunc("/token/refresh", makeHttpHandleFunc(server.handleRefreshToken)).Methods("POST")
+	router.HandleFunc("/logout", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleLogout))).Methods("POST")
+	router.HandleFunc("/account/{number}/transactions", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleGetTransactions))).Methods("GET")
+
+	send := func(path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("x-jwt-token", token)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	tokens := func(recorder *httptest.ResponseRecorder) *LoginResponse {
+		var resp LoginResponse
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+		return &resp
+	}
+
+	recorder := send("/login", fmt.Sprintf(`{"number": %d, "password": "secret123"}`, acc.Number), "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	login := tokens(recorder)
+
+	recorder = send("/token/refresh", fmt.Sprintf(`{"refresh_token": %q}`, login.RefreshToken), "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	refreshed := tokens(recorder)
+	assert.NotEqual(t, login.RefreshToken, refreshed.RefreshToken)
+
+	//replaying the rotated token revokes the refreshed one as well
+	recorder = send("/token/refresh", fmt.Sprintf(`{"refresh_token": %q}`, login.RefreshToken), "")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	recorder = send("/token/refresh", fmt.Sprintf(`{"refresh_token": %q}`, refreshed.RefreshToken), "")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+	recorder = send("/logout", "", refreshed.Token)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/account/%d/transactions", acc.Number), nil)
+	req.Header.Set("x-jwt-token", refreshed.Token)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+}
+
+func TestMFALogin(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	//wrong codes count as failed logins, don't wait out the backoff
+	server.login.BackoffBase = Duration(time.Nanosecond)
+	server.login.BackoffMax = Duration(time.Nanosecond)
+
+	admin, err := NewAccount("Ad", "Min", "secret123", "admin", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(admin, nil))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", makeHttpHandleFunc(server.handleLogin)).Methods("POST")
+	router.HandleFunc("/login/mfa", makeHttpHandleFunc(server.handleMFALogin)).Methods("POST")
+	router.HandleFunc("/account/mfa/enroll", server.mfaEnrollmentMiddleware(makeHttpHandleFunc(server.handleMFAEnroll))).Methods("POST")
+	router.HandleFunc("/account/mfa/verify", server.mfaEnrollmentMiddleware(makeHttpHandleFunc(server.handleMFAVerify))).Methods("POST")
+	router.HandleFunc("/account/{number}/transactions", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleGetTransactions))).Methods("GET")
+
+	send := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("x-jwt-token", token)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	transactions := fmt.Sprintf("/account/%d/transactions", admin.Number)
+	loginBody := fmt.Sprintf(`{"number": %d, "password": "secret123"}`, admin.Number)
+
+	//an admin without mfa can log in but only reach the enrollment endpoints
+	recorder := send("POST", "/login", loginBody, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var login LoginResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &login))
+	assert.Equal(t, http.StatusForbidden, send("GET", transactions, "", login.Token).Code)
+
+	recorder = send("POST", "/account/mfa/enroll", "", login.Token)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var enroll MFAEnrollResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &enroll))
+	assert.True(t, strings.HasPrefix(enroll.URI, "otpauth://totp/"))
+	secret, err := totpEncoding.DecodeString(enroll.Secret)
+	require.NoError(t, err)
+
+	step := totpStep(time.Now())
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/account/mfa/verify", `{"code": "000000x"}`, login.Token).Code)
+	recorder = send("POST", "/account/mfa/verify", fmt.Sprintf(`{"code": %q}`, totpCode(secret, step)), login.Token)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &login))
+	assert.Equal(t, http.StatusOK, send("GET", transactions, "", login.Token).Code)
+
+	//the password alone isn't enough anymore
+	recorder = send("POST", "/login", loginBody, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var challenge MFAChallengeResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &challenge))
+	assert.True(t, challenge.MFARequired)
+	assert.Equal(t, http.StatusForbidden, send("GET", transactions, "", challenge.ChallengeToken).Code)
+
+	//the code used to verify can't be used again
+	body := fmt.Sprintf(`{"challenge_token": %q, "code": %q}`, challenge.ChallengeToken, totpCode(secret, step))
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/login/mfa", body, "").Code)
+
+	body = fmt.Sprintf(`{"challenge_token": %q, "code": %q}`, challenge.ChallengeToken, totpCode(secret, step+1))
+	recorder = send("POST", "/login/mfa", body, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &login))
+	assert.Equal(t, http.StatusOK, send("GET", transactions, "", login.Token).Code)
+
+	//a challenge only works once
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/login/mfa", body, "").Code)
+
+	//an account closed after its password was checked gets no tokens
+	user, err := NewAccount("Jo", "Doe", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(user, nil))
+	sealed, err := server.mfaSecrets.Seal(secret)
+	require.NoError(t, err)
+	require.NoError(t, store.SaveMFASecret(&MFASecret{AccountNumber: user.Number, EncryptedSecret: sealed, CreatedAt: time.Now().UTC()}, nil))
+	require.NoError(t, store.EnableMFA(user.Number, 0, nil))
+
+	recorder = send("POST", "/login", fmt.Sprintf(`{"number": %d, "password": "secret123"}`, user.Number), "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &challenge))
+	require.True(t, challenge.MFARequired)
+	_, err = store.CloseAccount(user.Number, 0, nil)
+	require.NoError(t, err)
+	body = fmt.Sprintf(`{"challenge_token": %q, "code": %q}`, challenge.ChallengeToken, totpCode(secret, totpStep(time.Now())))
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/login/mfa", body, "").Code)
+}
+
+func TestTransferStepUp(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	server.stepUp = StepUpConfig{Threshold: 1000, Window: Duration(time.Minute)}
+	server.login.BackoffBase = Duration(time.Nanosecond)
+	server.login.BackoffMax = Duration(time.Nanosecond)
+
+	from, err := NewAccount("John", "Doe", "secret123", "user", 5000, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(from, nil))
+	to, err := NewAccount("Jane", "Doe", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(to, nil))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/auth/step-up", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleStepUp))).Methods("POST")
+	router.HandleFunc("/transfer", server.jwtAuthMiddleware(server.idempotencyMiddleware(makeHttpHandleFunc(server.handleTransfer)))).Methods("POST")
+
+	token := createTestJWT(t, from.Number, "user")
+	key := "transfer-1"
+	send := func(path, body, stepUp string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("x-jwt-token", token)
+		req.Header.Set(idempotencyHeader, key)
+		if stepUp != "" {
+			req.Header.Set(stepUpHeader, stepUp)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	transfer := func(amount int, stepUp string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"from_number": %d, "to_number": %d, "amount": %d}`, from.Number, to.Number, amount)
+		return send("/transfer", body, stepUp)
+	}
+
+	recorder := transfer(2000, "")
+	require.Equal(t, http.StatusUnauthorized, recorder.Code)
+	var required StepUpRequiredResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &required))
+	assert.True(t, required.StepUpRequired)
+	assert.Equal(t, []string{authMethodPassword}, required.Methods)
+
+	assert.Equal(t, http.StatusUnauthorized, send("/auth/step-up", `{"password": "wrong"}`, "").Code)
+	recorder = send("/auth/step-up", `{"password": "secret123"}`, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var stepUp StepUpResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &stepUp))
+	assert.Equal(t, authMethodPassword, stepUp.AuthMethod)
+
+	//the retry goes through with the same idempotency key
+	require.Equal(t, http.StatusOK, transfer(2000, stepUp.Token).Code)
+
+	transfers, err := store.GetTransfers(TransferFilter{AccountNumber: from.Number})
+	require.NoError(t, err)
+	require.Len(t, transfers, 1)
+	assert.Equal(t, authMethodPassword, transfers[0].AuthFactor)
+
+	//a step-up is good for one transfer
+	key = "transfer-2"
+	assert.Equal(t, http.StatusUnauthorized, transfer(1500, stepUp.Token).Code)
+	assert.Equal(t, http.StatusOK, transfer(500, "").Code)
+}
+
+func TestChangeAndResetPassword(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	server.login.BackoffBase = Duration(time.Nanosecond)
+	server.login.BackoffMax = Duration(time.Nanosecond)
+
+	acc, err := NewAccount("John", "Doe", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(acc, nil))
+	admin, err := NewAccount("Ad", "Min", "secret123", "admin", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(admin, nil))
+	other, err := NewAccount("Jane", "Doe", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(other, nil))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", makeHttpHandleFunc(server.handleLogin)).Methods("POST")
+	router.HandleFunc("/token/refresh", makeHttpHandleFunc(server.handleRefreshToken)).Methods("POST")
+	router.HandleFunc("/account/password", server.jwtAuthMiddleware(makeHttpHandleFunc(server.handleChangePassword))).Methods("POST")
+	router.HandleFunc("/account/{number}/password/reset", server.jwtAuthMiddleware(server.requirePermission(PermPasswordsReset, makeHttpHandleFunc(server.handleCreatePasswordReset)))).Methods("POST")
+	router.HandleFunc("/password/reset", makeHttpHandleFunc(server.handleResetPassword)).Methods("POST")
+
+	send := func(path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("x-jwt-token", token)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	login := func(password string) *httptest.ResponseRecorder {
+		return send("/login", fmt.Sprintf(`{"number": %d, "password": %q}`, acc.Number, password), "")
+	}
+
+	recorder := login("secret123")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var tokens LoginResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &tokens))
+
+	change := func(current, next string) int {
+		body := fmt.Sprintf(`{"current_password": %q, "new_password": %q}`, current, next)
+		return send("/account/password", body, tokens.Token).Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, change("wrong", "newsecret456"))
+	assert.Equal(t, http.StatusBadRequest, change("secret123", "short"))
+	assert.Equal(t, http.StatusBadRequest, change("secret123", "secret123"))
+	require.Equal(t, http.StatusNoContent, change("secret123", "newsecret456"))
+
+	//everything issued with the old password is dead
+	assert.Equal(t, http.StatusUnauthorized, change("newsecret456", "newsecret789"))
+	recorder = send("/token/refresh", fmt.Sprintf(`{"refresh_token": %q}`, tokens.RefreshToken), "")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, http.StatusBadRequest, login("secret123").Code)
+	assert.Equal(t, http.StatusOK, login("newsecret456").Code)
+
+	//only admins hand out reset tokens
+	resetPath := fmt.Sprintf("/account/%d/password/reset", acc.Number)
+	recorder = send(resetPath, fmt.Sprintf(`{"admin_account": %d}`, other.Number), createTestJWT(t, other.Number, "user"))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	recorder = send(resetPath, fmt.Sprintf(`{"admin_account": %d}`, admin.Number), createTestJWT(t, admin.Number, "admin"))
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var reset PasswordResetResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &reset))
+
+	resetBody := func(password string) string {
+		return fmt.Sprintf(`{"reset_token": %q, "new_password": %q}`, reset.ResetToken, password)
+	}
+	assert.Equal(t, http.StatusBadRequest, send("/password/reset", resetBody("short"), "").Code)
+	assert.Equal(t, http.StatusNoContent, send("/password/reset", resetBody("resetsecret1"), "").Code)
+	assert.Equal(t, http.StatusUnauthorized, send("/password/reset", resetBody("resetsecret2"), "").Code)
+	assert.Equal(t, http.StatusOK, login("resetsecret1").Code)
+}
+
+func TestLoginRehashesPassword(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	server.passwords.BcryptCost = bcrypt.MinCost
+
+	acc, err := NewAccount("John", "Doe", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(acc, nil))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/login", makeHttpHandleFunc(server.handleLogin)).Methods("POST")
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(fmt.Sprintf(`{"number": %d, "password": "secret123"}`, acc.Number)))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	stored, err := store.GetAccountByNumber(acc.Number)
+	require.NoError(t, err)
+	cost, err := bcrypt.Cost([]byte(stored.EncryptedPassword))
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.MinCost, cost)
+	assert.NoError(t, stored.ValidatePassword("secret123"))
+}
+
+func TestRolePermissions(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	router := server.newRouter()
+
+	newAccount := func(role string) *Account {
+		acc, err := NewAccount("John", "Doe", "secret123", role, 0, bcrypt.DefaultCost)
+		require.NoError(t, err)
+		require.NoError(t, store.CreateAccount(acc, nil))
+		return acc
+	}
+	admin, teller, auditor, customer := newAccount("admin"), newAccount("teller"), newAccount("auditor"), newAccount("user")
+
+	send := func(method, path, body string, acc *Account) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("x-jwt-token", createTestJWT(t, acc.Number, acc.Role))
+		req.Header.Set(actionReasonHeader, "role test")
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	listAccounts := func(acc *Account) int {
+		return send("GET", "/accounts", "", acc).Code
+	}
+	createAccount := func(acc *Account, role string) int {
+		body := fmt.Sprintf(`{"firstName": "New", "lastName": "Customer", "password": "secret123", "role": %q, "admin_account": %d}`, role, acc.Number)
+		return send("POST", "/account", body, acc).Code
+	}
+
+	assert.Equal(t, http.StatusOK, listAccounts(auditor))
+	assert.Equal(t, http.StatusOK, listAccounts(teller))
+	assert.Equal(t, http.StatusForbidden, listAccounts(customer))
+
+	//tellers open customer accounts but can't make staff
+	assert.Equal(t, http.StatusOK, createAccount(teller, ""))
+	assert.Equal(t, http.StatusForbidden, createAccount(teller, "admin"))
+	assert.Equal(t, http.StatusForbidden, createAccount(auditor, ""))
+	assert.Equal(t, http.StatusBadRequest, createAccount(admin, "no-such-role"))
+
+	//auditors read anyone's history
+	transactions := fmt.Sprintf("/account/%d/transactions", customer.Number)
+	assert.Equal(t, http.StatusOK, send("GET", transactions, "", auditor).Code)
+	assert.Equal(t, http.StatusForbidden, send("GET", fmt.Sprintf("/account/%d/transactions", teller.Number), "", customer).Code)
+
+	//only admins manage roles
+	assert.Equal(t, http.StatusForbidden, send("GET", "/roles", "", teller).Code)
+	recorder := send("GET", "/roles", "", admin)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var roles []Role
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &roles))
+	assert.Len(t, roles, len(defaultRoles()))
+
+	assert.Equal(t, http.StatusBadRequest, send("PUT", "/roles/viewer", `{"permissions": ["accounts:fly"]}`, admin).Code)
+	assert.Equal(t, http.StatusForbidden, send("PUT", "/roles/admin", `{"permissions": []}`, admin).Code)
+	assert.Equal(t, http.StatusOK, send("PUT", "/roles/viewer", `{"description": "lists accounts", "permissions": ["accounts:read"]}`, admin).Code)
+
+	//a new role applies on the next request, no new token needed
+	setRole := func(acc *Account, role string) int {
+		return send("PUT", fmt.Sprintf("/account/%d/role", acc.Number), fmt.Sprintf(`{"role": %q}`, role), admin).Code
+	}
+	assert.Equal(t, http.StatusBadRequest, setRole(customer, "no-such-role"))
+	require.Equal(t, http.StatusOK, setRole(customer, "viewer"))
+	assert.Equal(t, http.StatusOK, listAccounts(customer))
+	assert.Equal(t, http.StatusForbidden, send("PUT", fmt.Sprintf("/account/%d/role", admin.Number), `{"role": "user"}`, admin).Code)
+
+	assert.Equal(t, http.StatusConflict, send("DELETE", "/roles/viewer", "", admin).Code)
+	assert.Equal(t, http.StatusForbidden, send("DELETE", "/roles/teller", "", admin).Code)
+	require.Equal(t, http.StatusOK, setRole(customer, "user"))
+	assert.Equal(t, http.StatusNoContent, send("DELETE", "/roles/viewer", "", admin).Code)
+	assert.Equal(t, http.StatusForbidden, listAccounts(customer))
+}
+
+func TestListAccounts(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	router := server.newRouter()
+
+	auditor, err := NewAccount("Au", "Ditor", "secret123", "auditor", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(auditor, nil))
+	for i := range 5 {
+		acc, err := NewAccount("Customer", fmt.Sprintf("Number%d", i), "secret123", "user", uint64(i*100), bcrypt.DefaultCost)
+		require.NoError(t, err)
+		require.NoError(t, store.CreateAccount(acc, nil))
+	}
+
+	list := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/accounts?"+query, nil)
+		req.Header.Set("x-jwt-token", createTestJWT(t, auditor.Number, auditor.Role))
+		req.Header.Set(actionReasonHeader, "quarterly audit")
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	//walk the pages until there is no cursor left
+	var balances []uint64
+	query := "name=cust&sort=-balance&limit=2"
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3)
+		recorder := list(query)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var resp AccountListResponse
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+		for _, acc := range resp.Accounts {
+			balances = append(balances, acc.Balance)
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		query = "name=cust&sort=-balance&limit=2&cursor=" + resp.NextCursor
+
+		//a cursor only continues the order it was made for
+		assert.Equal(t, http.StatusBadRequest, list("sort=balance&cursor="+resp.NextCursor).Code)
+	}
+	assert.Equal(t, []uint64{400, 300, 200, 100, 0}, balances)
+
+	recorder := list("role=user&min_balance=100&max_balance=300&status=active")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var resp AccountListResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	assert.Len(t, resp.Accounts, 3)
+
+	//balances past a bigint are rejected instead of reaching the database
+	assert.Equal(t, http.StatusOK, list("max_balance=9223372036854775807").Code)
+	tooRich := encodeAccountCursor(&Account{Id: 1, Balance: math.MaxInt64 + 1}, "balance", SortBalance)
+
+	//rejected queries read nothing and aren't recorded
+	recorded := len(store.staffActions)
+	for _, query := range []string{"sort=password", "status=gone", "created_from=yesterday", "min_balance=-1", "min_balance=9223372036854775808", "max_balance=18446744073709551615", "limit=0", "cursor=nope", "sort=balance&cursor=" + tooRich} {
+		assert.Equal(t, http.StatusBadRequest, list(query).Code, query)
+	}
+	assert.Len(t, store.staffActions, recorded)
+}
+
+func TestStaffActions(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	router := server.newRouter()
+
+	newAccount := func(role string, balance uint64) *Account {
+		acc, err := NewAccount("John", "Doe", "secret123", role, balance, bcrypt.DefaultCost)
+		require.NoError(t, err)
+		require.NoError(t, store.CreateAccount(acc, nil))
+		return acc
+	}
+	support, auditor := newAccount("support", 0), newAccount("auditor", 0)
+	from, to := newAccount("user", 500), newAccount("user", 0)
+
+	send := func(method, path, body string, acc *Account, reason string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("x-jwt-token", createTestJWT(t, acc.Number, acc.Role))
+		if reason != "" {
+			req.Header.Set(actionReasonHeader, reason)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	getAccount := func(acc *Account, number int64, reason string) int {
+		return send("POST", "/account/get", fmt.Sprintf(`{"number": %d}`, number), acc, reason).Code
+	}
+
+	//owners need no reason, staff always do
+	assert.Equal(t, http.StatusOK, getAccount(from, from.Number, ""))
+	assert.Equal(t, http.StatusForbidden, getAccount(from, to.Number, "curious"))
+	assert.Equal(t, http.StatusBadRequest, getAccount(support, from.Number, ""))
+	assert.Equal(t, http.StatusOK, getAccount(support, from.Number, "customer called about a card"))
+	assert.Equal(t, http.StatusNotFound, getAccount(support, -1, "typo"))
+
+	history := fmt.Sprintf("/account/%d/transactions", from.Number)
+	assert.Equal(t, http.StatusBadRequest, send("GET", history, "", auditor, "").Code)
+	assert.Equal(t, http.StatusOK, send("GET", history, "", auditor, "quarterly audit").Code)
+
+	transfer := &Transfer{FromNumber: from.Number, ToNumber: to.Number, Money: Money{Amount: 200}}
+	require.NoError(t, store.TransferMoney(transfer, nil))
+	reversePath := fmt.Sprintf("/transfer/%d/reverse", transfer.Id)
+
+	assert.Equal(t, http.StatusForbidden, send("POST", reversePath, "", auditor, "sent by mistake").Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", reversePath, "", support, "").Code)
+	assert.Equal(t, http.StatusNotFound, send("POST", "/transfer/999999/reverse", "", support, "sent by mistake").Code)
+
+	recorder := send("POST", reversePath, "", support, "sent by mistake")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var resp ReverseTransferResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	reversal := resp.Reversal
+	require.NotNil(t, reversal)
+	assert.Zero(t, resp.Remaining)
+	assert.Equal(t, transfer.Id, reversal.ReversalOf)
+	assert.Equal(t, to.Number, reversal.FromNumber)
+	assert.Equal(t, uint64(200), reversal.Amount)
+
+	stored, _ := store.GetAccountByNumber(from.Number)
+	assert.Equal(t, uint64(500), stored.Balance)
+
+	assert.Equal(t, http.StatusConflict, send("POST", reversePath, "", support, "again").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, send("POST", fmt.Sprintf("/transfer/%d/reverse", reversal.Id), "", support, "undo").Code)
+
+	//every look at someone else's account is on record
+	actions := []string{}
+	for _, action := range store.staffActions {
+		actions = append(actions, action.Action)
+		assert.NotEmpty(t, action.Reason)
+	}
+	assert.Equal(t, []string{staffActionReadAccount, staffActionReadAccount, staffActionReadTransfers, staffActionReverseTransfer}, actions)
+	last := store.staffActions[len(store.staffActions)-1]
+	assert.Equal(t, support.Number, last.ActorNumber)
+	assert.Equal(t, "support", last.ActorRole)
+	assert.Equal(t, transfer.Id, last.TransferId)
+	assert.Equal(t, "sent by mistake", last.Reason)
+}
+
+func TestPartialReversals(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	router := server.newRouter()
+
+	newAccount := func(role string, balance uint64) *Account {
+		acc, err := NewAccount("John", "Doe", "secret123", role, balance, bcrypt.DefaultCost)
+		require.NoError(t, err)
+		require.NoError(t, store.CreateAccount(acc, nil))
+		return acc
+	}
+	admin := newAccount("admin", 0)
+	from, to, other := newAccount("user", 500), newAccount("user", 0), newAccount("user", 0)
+
+	transfer := &Transfer{FromNumber: from.Number, ToNumber: to.Number, Money: Money{Amount: 300, Currency: from.Currency}}
+	require.NoError(t, store.TransferMoney(transfer, nil))
+	reversePath := fmt.Sprintf("/transfer/%d/reverse", transfer.Id)
+
+	reverse := func(body string) (*httptest.ResponseRecorder, ReverseTransferResponse) {
+		req := httptest.NewRequest("POST", reversePath, strings.NewReader(body))
+		req.Header.Set("x-jwt-token", createTestJWT(t, admin.Number, admin.Role))
+		req.Header.Set(actionReasonHeader, "refund")
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		var resp ReverseTransferResponse
+		if recorder.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+		}
+		return recorder, resp
+	}
+
+	recorder, _ := reverse(`{"policy": "maybe"}`)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	recorder, _ = reverse(`{"amount": 301}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+
+	recorder, resp := reverse(`{"amount": 100}`)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, uint64(100), resp.Reversal.Amount)
+	assert.Equal(t, uint64(200), resp.Remaining)
+
+	recorder, _ = reverse(`{"amount": 201}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+
+	//the recipient spent most of it, failing is the default
+	require.NoError(t, store.TransferMoney(&Transfer{FromNumber: to.Number, ToNumber: other.Number, Money: Money{Amount: 150, Currency: from.Currency}}, nil))
+	recorder, _ = reverse(`{}`)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	//the reason is only on record for reversals that happened
+	assert.Len(t, store.staffActions, 1)
+
+	//holding needs its own permission
+	require.NoError(t, store.SaveRole(&Role{Name: "reverser", Permissions: []Permission{PermTransfersReverse}}, nil))
+	reverser := newAccount("reverser", 0)
+	req := httptest.NewRequest("POST", reversePath, strings.NewReader(`{"policy": "hold"}`))
+	req.Header.Set("x-jwt-token", createTestJWT(t, reverser.Number, reverser.Role))
+	req.Header.Set(actionReasonHeader, "refund")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), string(PermTransfersHold))
+
+	//holding takes what is left and holds the rest on the account
+	recorder, resp = reverse(`{"policy": "hold"}`)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, uint64(50), resp.Reversal.Amount)
+	assert.Equal(t, uint64(150), resp.Shortfall)
+	assert.True(t, resp.Held)
+	assert.Equal(t, uint64(150), resp.Remaining)
+
+	recipient, _ := store.GetAccountByNumber(to.Number)
+	assert.Equal(t, AccountActive, recipient.Status)
+	assert.Zero(t, recipient.Balance)
+	assert.Equal(t, uint64(150), recipient.Held)
+	sender, _ := store.GetAccountByNumber(from.Number)
+	assert.Equal(t, uint64(350), sender.Balance)
+
+	found, err := store.GetTransfer(transfer.Id)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(150), found.Reversed)
+
+	//money still comes in, but what is held can't leave
+	require.NoError(t, store.TransferMoney(&Transfer{FromNumber: other.Number, ToNumber: to.Number, Money: Money{Amount: 100, Currency: from.Currency}}, nil))
+	body := fmt.Sprintf(`{"admin_account": %d, "amount": 100, "reason_code": %q}`, admin.Number, reasonCash)
+	req = httptest.NewRequest("POST", fmt.Sprintf("/account/%d/deposit", to.Number), strings.NewReader(body))
+	req.Header.Set("x-jwt-token", createTestJWT(t, admin.Number, admin.Role))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	err = store.TransferMoney(&Transfer{FromNumber: to.Number, ToNumber: other.Number, Money: Money{Amount: 100, Currency: from.Currency}}, nil)
+	assert.ErrorIs(t, err, ErrFundsHeld)
+	req = httptest.NewRequest("POST", fmt.Sprintf("/account/%d/withdraw", to.Number), strings.NewReader(body))
+	req.Header.Set("x-jwt-token", createTestJWT(t, admin.Number, admin.Role))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+
+	//the next reversal collects the rest and lifts the hold
+	recorder, resp = reverse(`{}`)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, uint64(150), resp.Reversal.Amount)
+	assert.False(t, resp.Held)
+	assert.Zero(t, resp.Remaining)
+
+	recipient, _ = store.GetAccountByNumber(to.Number)
+	assert.Equal(t, uint64(50), recipient.Balance)
+	assert.Zero(t, recipient.Held)
+	sender, _ = store.GetAccountByNumber(from.Number)
+	assert.Equal(t, uint64(500), sender.Balance)
+	require.NoError(t, store.TransferMoney(&Transfer{FromNumber: to.Number, ToNumber: other.Number, Money: Money{Amount: 50, Currency: from.Currency}}, nil))
+
+	entries, err := store.GetAuditLog(AuditFilter{Action: auditTransferReverse, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, admin.Number, entries[0].ActorNumber)
+
+	//a retried reversal is answered from the idempotency key, not booked twice
+	second := &Transfer{FromNumber: from.Number, ToNumber: to.Number, Money: Money{Amount: 40, Currency: from.Currency}}
+	require.NoError(t, store.TransferMoney(second, nil))
+	retry := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/transfer/%d/reverse", second.Id), strings.NewReader(`{"amount": 10}`))
+		req.Header.Set("x-jwt-token", createTestJWT(t, admin.Number, admin.Role))
+		req.Header.Set(actionReasonHeader, "refund")
+		req.Header.Set(idempotencyHeader, "reverse-once")
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	first := retry()
+	require.Equal(t, http.StatusOK, first.Code)
+	replayed := retry()
+	assert.Equal(t, http.StatusOK, replayed.Code)
+	assert.Equal(t, first.Body.String(), replayed.Body.String())
+
+	found, err = store.GetTransfer(second.Id)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), found.Reversed)
+}
+
+func TestAccountLifecycle(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	router := server.newRouter()
+
+	newAccount := func(role string, balance uint64) *Account {
+		acc, err := NewAccount("John", "Doe", "secret123", role, balance, bcrypt.DefaultCost)
+		require.NoError(t, err)
+		require.NoError(t, store.CreateAccount(acc, nil))
+		return acc
+	}
+	admin, support := newAccount("admin", 0), newAccount("support", 0)
+	from, to := newAccount("user", 500), newAccount("user", 0)
+
+	send := func(method, path, body string, acc *Account) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("x-jwt-token", createTestJWT(t, acc.Number, acc.Role))
+		req.Header.Set(actionReasonHeader, "account review")
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	staffBody := func(acc *Account, payout int64) string {
+		return fmt.Sprintf(`{"admin_account": %d, "payout_account": %d}`, acc.Number, payout)
+	}
+	transfer := func() int {
+		body := fmt.Sprintf(`{"from_number": %d, "to_number": %d, "amount": 10}`, from.Number, to.Number)
+		return send("POST", "/transfer", body, from).Code
+	}
+
+	//support can freeze but not close
+	freeze := fmt.Sprintf("/account/%d/freeze", to.Number)
+	assert.Equal(t, http.StatusForbidden, send("POST", freeze, staffBody(from, 0), from).Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", freeze, "{", support).Code)
+	assert.Equal(t, http.StatusOK, send("POST", freeze, staffBody(support, 0), support).Code)
+	assert.Equal(t, http.StatusConflict, transfer())
+
+	unfreeze := fmt.Sprintf("/account/%d/unfreeze", to.Number)
+	assert.Equal(t, http.StatusOK, send("POST", unfreeze, staffBody(support, 0), support).Code)
+	assert.Equal(t, http.StatusOK, transfer())
+
+	closePath := fmt.Sprintf("/account/%d/close", from.Number)
+	assert.Equal(t, http.StatusForbidden, send("POST", closePath, staffBody(support, to.Number), support).Code)
+	assert.Equal(t, http.StatusConflict, send("POST", closePath, staffBody(admin, 0), admin).Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", closePath, staffBody(admin, from.Number), admin).Code)
+
+	recorder := send("POST", closePath, staffBody(admin, to.Number), admin)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var closed CloseAccountResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &closed))
+	assert.Equal(t, AccountClosed, closed.Account.Status)
+	assert.Zero(t, closed.Account.Balance)
+	assert.Equal(t, uint64(490), closed.Payout.Amount)
+	assert.Equal(t, http.StatusConflict, send("POST", closePath, staffBody(admin, to.Number), admin).Code)
+
+	//the owner is locked out, staff can still look
+	assert.Equal(t, http.StatusUnauthorized, transfer())
+	recorder = send("POST", "/account/get", fmt.Sprintf(`{"number": %d}`, from.Number), support)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"status":"closed"`)
+
+	stored, _ := store.GetAccountByNumber(to.Number)
+	assert.Equal(t, uint64(500), stored.Balance)
+}
+
+func TestUpdateAccount(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	router := server.newRouter()
+
+	newAccount := func(role string) *Account {
+		acc, err := NewAccount("John", "Doe", "secret123", role, 0, bcrypt.DefaultCost)
+		require.NoError(t, err)
+		require.NoError(t, store.CreateAccount(acc, nil))
+		return acc
+	}
+	admin, support, user, other := newAccount("admin"), newAccount("support"), newAccount("user"), newAccount("user")
+
+	patch := func(acc *Account, number int64, body string, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", fmt.Sprintf("/account/%d", number), strings.NewReader(body))
+		req.Header.Set("x-jwt-token", createTestJWT(t, acc.Number, acc.Role))
+		if etag != "" {
+			req.Header.Set("If-Match", etag)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	//the etag comes with the account
+	req := httptest.NewRequest("POST", "/account/get", strings.NewReader(fmt.Sprintf(`{"number": %d}`, user.Number)))
+	req.Header.Set("x-jwt-token", createTestJWT(t, user.Number, user.Role))
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	etag := recorder.Header().Get("ETag")
+	assert.Equal(t, `"1"`, etag)
+
+	assert.Equal(t, http.StatusPreconditionRequired, patch(user, user.Number, `{"firstName": "Jane"}`, "").Code)
+	assert.Equal(t, http.StatusBadRequest, patch(user, user.Number, `{"firstName": "Jane"}`, `"one"`).Code)
+	assert.Equal(t, http.StatusBadRequest, patch(user, user.Number, `{}`, etag).Code)
+	assert.Equal(t, http.StatusBadRequest, patch(user, user.Number, `{"lastName": " "}`, etag).Code)
+
+	//weak validators name the same version
+	recorder = patch(user, user.Number, `{"firstName": "Jane"}`, "W/"+etag)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `"2"`, recorder.Header().Get("ETag"))
+	var updated Account
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &updated))
+	assert.Equal(t, "Jane", updated.FirstName)
+	assert.Equal(t, "Doe", updated.LastName)
+
+	//a stale etag loses
+	recorder = patch(user, user.Number, `{"lastName": "Smith"}`, etag)
+	assert.Equal(t, http.StatusPreconditionFailed, recorder.Code)
+	assert.Equal(t, `"2"`, recorder.Header().Get("ETag"))
+
+	//users only edit their own names, never roles or status
+	assert.Equal(t, http.StatusForbidden, patch(user, other.Number, `{"firstName": "Mallory"}`, `"1"`).Code)
+	assert.Equal(t, http.StatusForbidden, patch(user, user.Number, `{"role": "admin"}`, `"2"`).Code)
+	assert.Equal(t, http.StatusForbidden, patch(user, user.Number, `{"status": "active"}`, `"2"`).Code)
+
+	//support can freeze but not rename or change roles
+	assert.Equal(t, http.StatusForbidden, patch(support, other.Number, `{"firstName": "Mallory"}`, `"1"`).Code)
+	assert.Equal(t, http.StatusForbidden, patch(support, other.Number, `{"role": "teller"}`, `"1"`).Code)
+	assert.Equal(t, http.StatusOK, patch(support, other.Number, `{"status": "frozen"}`, `"1"`).Code)
+
+	assert.Equal(t, http.StatusBadRequest, patch(admin, other.Number, `{"status": "closed"}`, `"2"`).Code)
+	assert.Equal(t, http.StatusBadRequest, patch(admin, other.Number, `{"role": "no-such-role"}`, `"2"`).Code)
+	assert.Equal(t, http.StatusForbidden, patch(admin, admin.Number, `{"role": "user"}`, `"1"`).Code)
+	assert.Equal(t, http.StatusNotFound, patch(admin, -1, `{"firstName": "Nobody"}`, `"1"`).Code)
+
+	recorder = patch(admin, other.Number, `{"lastName": "Teller", "role": "teller", "status": "active"}`, `"2"`)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	stored, _ := store.GetAccountByNumber(other.Number)
+	assert.Equal(t, "Teller", stored.LastName)
+	assert.Equal(t, "teller", stored.Role)
+	assert.Equal(t, AccountActive, stored.Status)
+	assert.Equal(t, int64(3), stored.Version)
+
+	log, err := store.GetAuditLog(AuditFilter{Action: auditAccountUpdate})
+	require.NoError(t, err)
+	require.Len(t, log, 3)
+	assert.Equal(t, admin.Number, log[0].ActorNumber)
+	assert.Equal(t, support.Number, log[1].ActorNumber)
+	assert.Equal(t, user.Number, log[2].ActorNumber)
+}
+
+func TestCashMovements(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	server.withdrawals = WithdrawalConfig{MaxAmount: 300, DailyLimit: 400}
+	router := server.newRouter()
+
+	newAccount := func(role string, balance uint64) *Account {
+		acc, err := NewAccount("John", "Doe", "secret123", role, balance, bcrypt.DefaultCost)
+		require.NoError(t, err)
+		require.NoError(t, store.CreateAccount(acc, nil))
+		return acc
+	}
+	teller, support, customer := newAccount("teller", 0), newAccount("support", 0), newAccount("user", 0)
+
+	send := func(path string, acc *Account, amount uint64, reason string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"admin_account": %d, "amount": %d, "reason_code": %q}`, acc.Number, amount, reason)
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("x-jwt-token", createTestJWT(t, acc.Number, acc.Role))
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+	deposit := fmt.Sprintf("/account/%d/deposit", customer.Number)
+	withdraw := fmt.Sprintf("/account/%d/withdraw", customer.Number)
+
+	assert.Equal(t, http.StatusForbidden, send(deposit, support, 100, reasonCash).Code)
+	assert.Equal(t, http.StatusForbidden, send(deposit, customer, 100, reasonCash).Code)
+
+	//a body that can't be read isn't a permission problem
+	req := httptest.NewRequest("POST", deposit, strings.NewReader(`{"amount": "lots"`))
+	req.Header.Set("x-jwt-token", createTestJWT(t, teller.Number, teller.Role))
+	malformed := httptest.NewRecorder()
+	router.ServeHTTP(malformed, req)
+	assert.Equal(t, http.StatusBadRequest, malformed.Code)
+
+	assert.Equal(t, http.StatusBadRequest, send(deposit, teller, 0, reasonCash).Code)
+	assert.Equal(t, http.StatusBadRequest, send(deposit, teller, 100, "gift").Code)
+	assert.Equal(t, http.StatusBadRequest, send(deposit, teller, 100, reasonFee).Code)
+	assert.Equal(t, http.StatusNotFound, send("/account/1/deposit", teller, 100, reasonCash).Code)
+
+	recorder := send(deposit, teller, 1000, reasonCheque)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var resp CashResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+	assert.Equal(t, uint64(1000), resp.Balance)
+	assert.Equal(t, cashAccountNumber, resp.Transfer.FromNumber)
+	assert.Equal(t, reasonCheque, resp.Transfer.ReasonCode)
+
+	//one withdrawal can't go over the max, all of them over the daily limit
+	assert.Equal(t, http.StatusBadRequest, send(withdraw, teller, 100, reasonCheque).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, send(withdraw, teller, 301, reasonCash).Code)
+	assert.Equal(t, http.StatusOK, send(withdraw, teller, 300, reasonCash).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, send(withdraw, teller, 101, reasonCash).Code)
+	assert.Equal(t, http.StatusOK, send(withdraw, teller, 100, reasonFee).Code)
+
+	admin := newAccount("admin", 0)
+	require.NoError(t, store.SetAccountStatus(customer.Number, AccountFrozen, nil))
+	assert.Equal(t, http.StatusConflict, send(deposit, admin, 100, reasonCash).Code)
+
+	stored, _ := store.GetAccountByNumber(customer.Number)
+	assert.Equal(t, uint64(600), stored.Balance)
+
+	entries, err := store.GetAuditLog(AuditFilter{Action: auditAccountWithdraw, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, teller.Number, entries[0].ActorNumber)
+	assert.Equal(t, accountTarget(customer.Number), entries[0].Target)
+}
+
+func TestAuditLog(t *testing.T) {
+	store := NewMemoryStore()
+	server := NewApiServer(":3000", store)
+	router := server.newRouter()
+
+	admin, err := NewAccount("Ad", "Min", "secret123", "admin", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(admin, nil))
+	auditor, err := NewAccount("Au", "Ditor", "secret123", "auditor", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(auditor, nil))
+
+	send := func(method, path, body string, acc *Account, requestId string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("x-jwt-token", createTestJWT(t, acc.Number, acc.Role))
+		if requestId != "" {
+			req.Header.Set(requestIdHeader, requestId)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	body := fmt.Sprintf(`{"firstName": "John", "lastName": "Doe", "password": "secret123", "admin_account": %d}`, admin.Number)
+	recorder := send("POST", "/account", body, admin, "create-1")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "create-1", recorder.Header().Get(requestIdHeader))
+	var customer Account
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &customer))
+	customer.Role = roleUser
+	require.NoError(t, store.Deposit(&Transfer{FromNumber: cashAccountNumber, ToNumber: customer.Number, Money: Money{Amount: 500, Currency: customer.Currency}, ReasonCode: reasonCash}, nil))
+
+	body = fmt.Sprintf(`{"from_number": %d, "to_number": %d, "amount": 200}`, customer.Number, admin.Number)
+	recorder = send("POST", "/transfer", body, &customer, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get(requestIdHeader))
+
+	recorder = send("POST", fmt.Sprintf("/account/%d/close", auditor.Number), fmt.Sprintf(`{"admin_account": %d}`, admin.Number), admin, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	//only audit:read gets to see the log
+	assert.Equal(t, http.StatusForbidden, send("GET", "/audit", "", &customer, "").Code)
+
+	recorder = send("GET", fmt.Sprintf("/audit?actor=%d", admin.Number), "", admin, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var log AuditLogResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &log))
+	require.Len(t, log.Entries, 2)
+	assert.Equal(t, auditAccountClose, log.Entries[0].Action)
+	assert.Equal(t, accountTarget(auditor.Number), log.Entries[0].Target)
+	assert.Equal(t, auditAccountCreate, log.Entries[1].Action)
+	assert.Equal(t, "create-1", log.Entries[1].RequestId)
+	assert.Equal(t, "admin", log.Entries[1].ActorRole)
+	assert.Equal(t, "192.0.2.1", log.Entries[1].IP)
+
+	recorder = send("GET", "/audit?action=transfer.create&limit=1", "", admin, "")
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &log))
+	require.Len(t, log.Entries, 1)
+	assert.Equal(t, customer.Number, log.Entries[0].ActorNumber)
+	assert.Contains(t, string(log.Entries[0].After), `"amount":200`)
+
+	verify := func() AuditVerifyResponse {
+		recorder := send("GET", "/audit/verify", "", admin, "")
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var resp AuditVerifyResponse
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+		return resp
+	}
+	assert.Equal(t, AuditVerifyResponse{Valid: true, Checked: 3}, verify())
+
+	//rewriting history shows up
+	store.auditLog[1].After = json.RawMessage(`{"balances": {}}`)
+	assert.Equal(t, AuditVerifyResponse{Valid: false, BrokenAt: store.auditLog[1].Id}, verify())
+}
+
+func createTestJWT(t *testing.T, accountNumber int64, role string) string {
+	now := time.Now()
+	//staff are only let in with a second factor
+	authMethods := []string{authMethodPassword}
+	if role != roleUser {
+		authMethods = append(authMethods, authMethodOTP)
+	}
+
+	return signTestClaims(t, &TokenClaims{
+		Role:        role,
+		AuthMethods: authMethods,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    defaultJWTIssuer,
+			Subject:   strconv.FormatInt(accountNumber, 10),
+			Audience:  jwt.ClaimStrings{defaultJWTAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        fmt.Sprintf("test-%d", accountNumber),
+		},
+	})
+}
+
+func signTestClaims(t *testing.T, claims *TokenClaims) string {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(secret))
+	token.Header["kid"] = "hmac"
+	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
 	require.NoError(t, err)
 
 	return tokenString
 }
+
+func expectTokenNotRevoked(mockStore *MockStorage) {
+	mockStore.EXPECT().
+		IsTokenRevoked(gomock.Any()).
+		Return(false, nil).
+		AnyTimes()
+	mockStore.EXPECT().
+		GetRole(gomock.Any()).
+		DoAndReturn(func(name string) (*Role, error) {
+			for _, role := range defaultRoles() {
+				if role.Name == name {
+					return role, nil
+				}
+			}
+			return nil, ErrRoleNotFound
+		}).
+		AnyTimes()
+}
+
+// for tests whose handler doesn't look up the token's account itself
+func expectTokenAccount(mockStore *MockStorage, role string, numbers ...int64) {
+	expectTokenNotRevoked(mockStore)
+	for _, number := range numbers {
+		mockStore.EXPECT().
+			GetAccountByNumber(number).
+			Return(&Account{Number: number, Role: role}, nil).
+			AnyTimes()
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	requestIdHeader = "x-request-id"
+	// serializes writers of the audit log so the hash chain has no forks
+	auditLockId = 7_451_204
+)
+
+// values for AuditEntry.Action
+const (
+	auditAccountCreate   = "account.create"
+	auditAccountUpdate   = "account.update"
+	auditAccountFreeze   = "account.freeze"
+	auditAccountUnfreeze = "account.unfreeze"
+	auditAccountClose    = "account.close"
+	auditAccountDeposit  = "account.deposit"
+	auditAccountWithdraw = "account.withdraw"
+	auditAccountRole     = "account.role"
+	auditAccountUnlock   = "account.unlock"
+	auditPasswordChange  = "account.password_change"
+	auditPasswordReset   = "account.password_reset"
+	auditResetToken      = "account.reset_token"
+	auditMFAEnroll       = "account.mfa_enroll"
+	auditMFAEnable       = "account.mfa_enable"
+	auditRoleSave        = "role.save"
+	auditRoleDelete      = "role.delete"
+	auditTransferCreate  = "transfer.create"
+	auditTransferReverse = "transfer.reverse"
+)
+
+func accountTarget(number int64) string {
+	return fmt.Sprintf("account:%d", number)
+}
+
+func transferTarget(id int64) string {
+	return fmt.Sprintf("transfer:%d", id)
+}
+
+func roleTarget(name string) string {
+	return fmt.Sprintf("role:%s", name)
+}
+
+// a password reset only records when it happened and who issued the token,
+// never the hash
+type passwordSnapshot struct {
+	PasswordChangedAt *time.Time `json:"passwordChangedAt"`
+	ResetBy           int64      `json:"resetBy,omitempty"`
+}
+
+// issuing a reset token cancels the pending ones, the token itself is never
+// recorded
+type resetTokenSnapshot struct {
+	Pending   int64      `json:"pending"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// unlocking clears the failures counted against an account or ip
+type loginAttemptsSnapshot struct {
+	Failures int `json:"failures"`
+}
+
+// the secret stays out of the log, only when it was enrolled and enabled
+type mfaSnapshot struct {
+	EnrolledAt *time.Time `json:"enrolledAt"`
+	EnabledAt  *time.Time `json:"enabledAt"`
+}
+
+// what a transfer entry records before and after the money moved
+type transferSnapshot struct {
+	Transfer *Transfer        `json:"transfer,omitempty"`
+	Balances map[int64]uint64 `json:"balances"`
+	// what a reversal under the hold policy left to collect
+	Held uint64 `json:"held,omitempty"`
+}
+
+// snapshots are only ever plain structs, they always marshal
+func snapshot(v any) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// the fields covered by the hash, in the order they are hashed
+type auditHashInput struct {
+	PrevHash    string          `json:"prevHash"`
+	ActorNumber int64           `json:"actorNumber"`
+	ActorRole   string          `json:"actorRole"`
+	Action      string          `json:"action"`
+	Target      string          `json:"target"`
+	RequestId   string          `json:"requestId"`
+	Before      json.RawMessage `json:"before"`
+	After       json.RawMessage `json:"after"`
+	IP          string          `json:"ip"`
+	CreatedAt   string          `json:"createdAt"`
+}
+
+func (e *AuditEntry) computeHash() string {
+	b, _ := json.Marshal(auditHashInput{
+		PrevHash:    e.PrevHash,
+		ActorNumber: e.ActorNumber,
+		ActorRole:   e.ActorRole,
+		Action:      e.Action,
+		Target:      e.Target,
+		RequestId:   e.RequestId,
+		Before:      e.Before,
+		After:       e.After,
+		IP:          e.IP,
+		CreatedAt:   e.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// links the entry to the one before it, stores call this right before the
+// insert while they hold the audit lock
+func (e *AuditEntry) seal(prevHash string) {
+	// postgres keeps microseconds, the hash has to survive the round trip
+	e.CreatedAt = e.CreatedAt.UTC().Truncate(time.Microsecond)
+	e.PrevHash = prevHash
+	e.Hash = e.computeHash()
+}
+
+// checks entries given newest first, as GetAuditLog returns them. Returns the
+// id of the first entry that doesn't match its hash or its neighbour, or 0.
+func verifyAuditChain(entries []*AuditEntry, newer *AuditEntry) int64 {
+	for _, e := range entries {
+		if e.computeHash() != e.Hash {
+			return e.Id
+		}
+		if newer != nil && newer.PrevHash != e.Hash {
+			return newer.Id
+		}
+		newer = e
+	}
+
+	return 0
+}
+
+// a state-changing request is audited with the caller, the store fills in
+// the target and the snapshots
+func (s *ApiServer) auditEntry(r *http.Request, action string) *AuditEntry {
+	actor, _ := r.Context().Value("authorizedAccountNumber").(int64)
+	role, _ := r.Context().Value("role").(string)
+	requestId, _ := r.Context().Value("requestId").(string)
+
+	return &AuditEntry{
+		ActorNumber: actor,
+		ActorRole:   role,
+		Action:      action,
+		RequestId:   requestId,
+		IP:          clientIP(r),
+		CreatedAt:   time.Now().UTC(),
+	}
+}
+
+// takes the caller's request id or makes one up, either way it is sent back
+// so a response can be matched to its audit entry
+func (s *ApiServer) requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(requestIdHeader)
+		if requestId == "" || len(requestId) > 100 {
+			var err error
+			if requestId, err = randomToken(12); err != nil {
+				fmt.Println("Error creating request id")
+				WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+				return
+			}
+		}
+
+		w.Header().Set(requestIdHeader, requestId)
+		ctx := context.WithValue(r.Context(), "requestId", requestId)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func parseAuditFilter(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Action: query.Get("action"),
+		Target: query.Get("target"),
+		Limit:  defaultHistoryPageSize,
+	}
+
+	if actor := query.Get("actor"); actor != "" {
+		n, err := strconv.ParseInt(actor, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("actor must be an account number")
+		}
+		filter.ActorNumber = n
+	}
+
+	if from := query.Get("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return filter, fmt.Errorf("from must be an RFC3339 timestamp")
+		}
+		filter.From = t
+	}
+
+	if to := query.Get("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return filter, fmt.Errorf("to must be an RFC3339 timestamp")
+		}
+		filter.To = t
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxHistoryPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxHistoryPageSize)
+		}
+		filter.Limit = n
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		n, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil || n < 1 {
+			return filter, fmt.Errorf("invalid cursor")
+		}
+		filter.BeforeId = n
+	}
+
+	return filter, nil
+}
+
+func (s *ApiServer) handleGetAuditLog(w http.ResponseWriter, r *http.Request) error {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+	}
+
+	// fetch one extra row to know whether there is a next page
+	limit := filter.Limit
+	filter.Limit = limit + 1
+
+	entries, err := s.store.GetAuditLog(filter)
+	if err != nil {
+		fmt.Println("Error retrieving audit log")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	resp := AuditLogResponse{Entries: entries}
+	if len(entries) > limit {
+		resp.Entries = entries[:limit]
+		resp.NextCursor = resp.Entries[limit-1].Id
+	}
+
+	return WriteJson(w, http.StatusOK, resp)
+}
+
+// walks the whole chain from the newest entry back to the first one
+func (s *ApiServer) handleVerifyAuditLog(w http.ResponseWriter, r *http.Request) error {
+	resp := AuditVerifyResponse{Valid: true}
+	filter := AuditFilter{Limit: maxHistoryPageSize}
+
+	var newer *AuditEntry
+	for {
+		entries, err := s.store.GetAuditLog(filter)
+		if err != nil {
+			fmt.Println("Error retrieving audit log")
+			return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		if brokenAt := verifyAuditChain(entries, newer); brokenAt != 0 {
+			resp.Valid = false
+			resp.BrokenAt = brokenAt
+			break
+		}
+
+		resp.Checked += len(entries)
+		newer = entries[len(entries)-1]
+		filter.BeforeId = newer.Id
+	}
+
+	// the oldest entry starts the chain
+	if resp.Valid && newer != nil && newer.PrevHash != "" {
+		resp.Valid = false
+		resp.BrokenAt = newer.Id
+	}
+
+	return WriteJson(w, http.StatusOK, resp)
+}
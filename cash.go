@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+var ErrWithdrawalLimit = errors.New("daily withdrawal limit reached")
+
+// why money came in over the counter or went out, stored on the transfer
+const (
+	reasonCash       = "cash"
+	reasonCheque     = "cheque"
+	reasonWire       = "wire"
+	reasonFee        = "fee"
+	reasonCorrection = "correction"
+)
+
+var (
+	depositReasons    = []string{reasonCash, reasonCheque, reasonWire, reasonCorrection}
+	withdrawalReasons = []string{reasonCash, reasonWire, reasonFee, reasonCorrection}
+)
+
+// the daily limit is a rolling window rather than a calendar day, so it
+// doesn't depend on anyone's time zone
+const withdrawalLimitWindow = 24 * time.Hour
+
+// WithdrawalConfig caps what staff can pay out of an account, in minor units
+// of the account's currency. A zero limit turns it off.
+type WithdrawalConfig struct {
+	MaxAmount  uint64 `json:"max_amount"`
+	DailyLimit uint64 `json:"daily_limit"`
+}
+
+func defaultWithdrawalConfig() WithdrawalConfig {
+	return WithdrawalConfig{
+		MaxAmount:  1_000_000,
+		DailyLimit: 2_500_000,
+	}
+}
+
+func (s *ApiServer) handleDeposit(w http.ResponseWriter, r *http.Request) error {
+	return s.moveCash(w, r, true)
+}
+
+func (s *ApiServer) handleWithdraw(w http.ResponseWriter, r *http.Request) error {
+	return s.moveCash(w, r, false)
+}
+
+// deposits and withdrawals are transfers from and to the cash account, so
+// they show up in the account's history and the ledger stays balanced
+func (s *ApiServer) moveCash(w http.ResponseWriter, r *http.Request, deposit bool) error {
+	req, err := decodeAndValidateRequest[CashRequest](r)
+	if err != nil {
+		fmt.Println("Error decoding cash request")
+		return writeStaffRequestError(w, err)
+	}
+
+	number, err := accountNumberParameter(r)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
+
+	// staff can't pay themselves
+	if number == req.AdminAccount {
+		return WriteJson(w, http.StatusForbidden, ApiError{Error: "you can't deposit to or withdraw from your own account"})
+	}
+
+	if req.Amount == 0 {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "amount must be positive"})
+	}
+
+	reasons := withdrawalReasons
+	if deposit {
+		reasons = depositReasons
+	}
+	if !slices.Contains(reasons, req.ReasonCode) {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: fmt.Sprintf("reason_code must be one of %s", strings.Join(reasons, ", "))})
+	}
+
+	if !deposit && s.withdrawals.MaxAmount > 0 && req.Amount > s.withdrawals.MaxAmount {
+		return WriteJson(w, http.StatusUnprocessableEntity, ApiError{Error: fmt.Sprintf("a single withdrawal can be at most %d", s.withdrawals.MaxAmount)})
+	}
+
+	acc, err := s.store.GetAccountByNumber(number)
+	if err != nil {
+		if errors.Is(err, ErrAccountNotFound) {
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "account not found"})
+		}
+		fmt.Println("Error retrieving account")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	if req.Currency != "" && req.Currency != acc.Currency {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: fmt.Sprintf("account holds %s", acc.Currency)})
+	}
+
+	transfer := &Transfer{
+		Money:      Money{Amount: req.Amount, Currency: acc.Currency},
+		ReasonCode: req.ReasonCode,
+	}
+	if deposit {
+		transfer.FromNumber, transfer.ToNumber = cashAccountNumber, number
+		err = s.store.Deposit(transfer, s.auditEntry(r, auditAccountDeposit))
+	} else {
+		transfer.FromNumber, transfer.ToNumber = number, cashAccountNumber
+		err = s.store.Withdraw(transfer, s.withdrawals.DailyLimit, s.auditEntry(r, auditAccountWithdraw))
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrAccountNotFound):
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "account not found"})
+		case errors.Is(err, ErrAccountFrozen), errors.Is(err, ErrAccountClosed):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: err.Error()})
+		case errors.Is(err, ErrInsufficientFunds):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "insufficient funds"})
+		case errors.Is(err, ErrFundsHeld):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "funds are held for a reversal"})
+		case errors.Is(err, ErrWithdrawalLimit):
+			return WriteJson(w, http.StatusUnprocessableEntity, ApiError{Error: fmt.Sprintf("withdrawals can add up to at most %d a day", s.withdrawals.DailyLimit)})
+		case errors.Is(err, ErrCurrencyMismatch):
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "account holds a different currency"})
+		}
+		fmt.Println("Error moving cash")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	updated, err := s.store.GetAccountByNumber(number)
+	if err != nil {
+		fmt.Println("Error retrieving updated account")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, CashResponse{Transfer: transfer, Balance: updated.Balance})
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config is built from defaults, then an optional JSON config file, then
+// environment variables and finally command line flags, each one overriding
+// the previous.
+type Config struct {
+	ListenAddr     string           `json:"listen_addr"`
+	Store          string           `json:"store"`
+	IdempotencyTTL Duration         `json:"idempotency_ttl"`
+	Database       DatabaseConfig   `json:"database"`
+	FX             FXConfig         `json:"fx"`
+	Auth           AuthConfig       `json:"auth"`
+	Login          LoginConfig      `json:"login"`
+	StepUp         StepUpConfig     `json:"step_up"`
+	Password       PasswordConfig   `json:"password"`
+	Withdrawal     WithdrawalConfig `json:"withdrawal"`
+}
+
+type DatabaseConfig struct {
+	DSN          string `json:"dsn"`
+	SSLMode      string `json:"ssl_mode"`
+	MaxOpenConns int    `json:"max_open_conns"`
+	// nil keeps up to defaultMaxIdleConns idle, never more than MaxOpenConns
+	MaxIdleConns    *int     `json:"max_idle_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime"`
+	PingTimeout     Duration `json:"ping_timeout"`
+}
+
+type FXConfig struct {
+	RatesFile string   `json:"rates_file"`
+	SpreadBps int      `json:"spread_bps"`
+	QuoteTTL  Duration `json:"quote_ttl"`
+}
+
+type AuthConfig struct {
+	AccessTokenTTL  Duration `json:"access_token_ttl"`
+	RefreshTokenTTL Duration `json:"refresh_token_ttl"`
+	Issuer          string   `json:"issuer"`
+	Audience        string   `json:"audience"`
+	ClockSkew       Duration `json:"clock_skew"`
+	// without a signing key tokens are signed with JWT_SECRET
+	SigningKeyFile       string   `json:"signing_key_file"`
+	VerificationKeyFiles []string `json:"verification_key_files"`
+	// base64 encoded 32 byte key mfa secrets are encrypted with
+	MFAKey string `json:"mfa_key"`
+}
+
+func (c AuthConfig) MFAKeyBytes() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(c.MFAKey)
+	if err != nil {
+		return nil, fmt.Errorf("mfa key must be base64 encoded: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("mfa key must be 32 bytes, got %d", len(key))
+	}
+
+	return key, nil
+}
+
+// Duration reads "30s" style strings from the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+const defaultMaxIdleConns = 25
+
+// IdleConns is the idle pool size, when it wasn't set it follows MaxOpenConns
+// so lowering only the open connections still gives a valid config
+func (c DatabaseConfig) IdleConns() int {
+	if c.MaxIdleConns != nil {
+		return *c.MaxIdleConns
+	}
+
+	if c.MaxOpenConns > 0 && c.MaxOpenConns < defaultMaxIdleConns {
+		return c.MaxOpenConns
+	}
+
+	return defaultMaxIdleConns
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:     ":3000",
+		Store:          "postgres",
+		IdempotencyTTL: Duration(defaultIdempotencyTTL),
+		Database: DatabaseConfig{
+			DSN:             "user=postgres dbname=postgres password=gobank",
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			ConnMaxLifetime: Duration(5 * time.Minute),
+			PingTimeout:     Duration(5 * time.Second),
+		},
+		FX: FXConfig{
+			QuoteTTL: Duration(defaultFXQuoteTTL),
+		},
+		Auth: AuthConfig{
+			AccessTokenTTL:  Duration(defaultAccessTokenTTL),
+			RefreshTokenTTL: Duration(defaultRefreshTokenTTL),
+			Issuer:          defaultJWTIssuer,
+			Audience:        defaultJWTAudience,
+			ClockSkew:       Duration(defaultJWTClockSkew),
+		},
+		Login:      defaultLoginConfig(),
+		StepUp:     defaultStepUpConfig(),
+		Password:   defaultPasswordConfig(),
+		Withdrawal: defaultWithdrawalConfig(),
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.ListenAddr == "" {
+		return fmt.Errorf("listen address is required")
+	}
+
+	if c.Store != "postgres" && c.Store != "memory" {
+		return fmt.Errorf("unknown store %q, expected postgres or memory", c.Store)
+	}
+
+	if c.IdempotencyTTL <= 0 {
+		return fmt.Errorf("idempotency ttl must be positive")
+	}
+
+	db := c.Database
+	if c.Store == "postgres" && db.DSN == "" {
+		return fmt.Errorf("database dsn is required")
+	}
+
+	if db.MaxOpenConns < 0 || db.IdleConns() < 0 {
+		return fmt.Errorf("connection pool sizes can't be negative")
+	}
+
+	if db.MaxOpenConns > 0 && db.IdleConns() > db.MaxOpenConns {
+		return fmt.Errorf("max idle connections (%d) can't exceed max open connections (%d)",
+			db.IdleConns(), db.MaxOpenConns)
+	}
+
+	if db.PingTimeout <= 0 {
+		return fmt.Errorf("database ping timeout must be positive")
+	}
+
+	if c.FX.SpreadBps < 0 || c.FX.SpreadBps >= basisPointsPerUnit {
+		return fmt.Errorf("fx spread must be between 0 and %d basis points", basisPointsPerUnit-1)
+	}
+
+	if c.FX.QuoteTTL <= 0 {
+		return fmt.Errorf("fx quote ttl must be positive")
+	}
+
+	if c.Auth.AccessTokenTTL <= 0 || c.Auth.RefreshTokenTTL <= 0 {
+		return fmt.Errorf("token ttls must be positive")
+	}
+
+	if c.Auth.AccessTokenTTL >= c.Auth.RefreshTokenTTL {
+		return fmt.Errorf("access token ttl must be shorter than the refresh token ttl")
+	}
+
+	if c.Auth.Issuer == "" || c.Auth.Audience == "" {
+		return fmt.Errorf("jwt issuer and audience are required")
+	}
+
+	if c.Auth.ClockSkew < 0 {
+		return fmt.Errorf("jwt clock skew can't be negative")
+	}
+
+	if c.Auth.SigningKeyFile == "" && len(c.Auth.VerificationKeyFiles) > 0 {
+		return fmt.Errorf("jwt verification keys need a signing key")
+	}
+
+	if c.Auth.MFAKey != "" {
+		if _, err := c.Auth.MFAKeyBytes(); err != nil {
+			return err
+		}
+	}
+
+	login := c.Login
+	if login.MaxAccountFailures <= 0 || login.MaxIPFailures <= 0 {
+		return fmt.Errorf("login failure limits must be positive")
+	}
+
+	if login.Lockout <= 0 || login.BackoffBase <= 0 || login.BackoffMax < login.BackoffBase {
+		return fmt.Errorf("login lockout and backoff must be positive, with backoff max at least backoff base")
+	}
+
+	if c.StepUp.Window <= 0 {
+		return fmt.Errorf("step-up window must be positive")
+	}
+
+	if c.Password.MinLength < 1 || c.Password.MinLength > maxPasswordBytes {
+		return fmt.Errorf("password min length must be between 1 and %d", maxPasswordBytes)
+	}
+
+	if c.Password.BcryptCost < bcrypt.MinCost || c.Password.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	if c.Password.ResetTokenTTL <= 0 {
+		return fmt.Errorf("password reset token ttl must be positive")
+	}
+
+	withdrawal := c.Withdrawal
+	if withdrawal.MaxAmount > 0 && withdrawal.DailyLimit > 0 && withdrawal.MaxAmount > withdrawal.DailyLimit {
+		return fmt.Errorf("withdrawal max amount can't exceed the daily limit")
+	}
+
+	return nil
+}
+
+// ConnString adds the configured sslmode to the DSN unless the DSN already
+// sets one. Both URL and key=value DSNs are supported.
+func (c DatabaseConfig) ConnString() (string, error) {
+	if c.SSLMode == "" {
+		return c.DSN, nil
+	}
+
+	if strings.HasPrefix(c.DSN, "postgres://") || strings.HasPrefix(c.DSN, "postgresql://") {
+		u, err := url.Parse(c.DSN)
+		if err != nil {
+			return "", fmt.Errorf("invalid database url: %w", err)
+		}
+
+		query := u.Query()
+		if query.Get("sslmode") == "" {
+			query.Set("sslmode", c.SSLMode)
+			u.RawQuery = query.Encode()
+		}
+
+		return u.String(), nil
+	}
+
+	if strings.Contains(c.DSN, "sslmode=") {
+		return c.DSN, nil
+	}
+
+	return strings.TrimSpace(c.DSN + " sslmode=" + c.SSLMode), nil
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("unable to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// every setting can be overridden from the environment
+var configEnv = map[string]func(*Config, string) error{
+	"GOBANK_LISTEN_ADDR": func(c *Config, v string) error {
+		c.ListenAddr = v
+		return nil
+	},
+	"GOBANK_STORE": func(c *Config, v string) error {
+		c.Store = v
+		return nil
+	},
+	"GOBANK_IDEMPOTENCY_TTL": func(c *Config, v string) error {
+		return setDuration(&c.IdempotencyTTL, v)
+	},
+	"DATABASE_URL": func(c *Config, v string) error {
+		c.Database.DSN = v
+		return nil
+	},
+	"GOBANK_DB_SSLMODE": func(c *Config, v string) error {
+		c.Database.SSLMode = v
+		return nil
+	},
+	"GOBANK_DB_MAX_OPEN_CONNS": func(c *Config, v string) error {
+		return setInt(&c.Database.MaxOpenConns, v)
+	},
+	"GOBANK_DB_MAX_IDLE_CONNS": func(c *Config, v string) error {
+		var idle int
+		if err := setInt(&idle, v); err != nil {
+			return err
+		}
+
+		c.Database.MaxIdleConns = &idle
+		return nil
+	},
+	"GOBANK_DB_CONN_MAX_LIFETIME": func(c *Config, v string) error {
+		return setDuration(&c.Database.ConnMaxLifetime, v)
+	},
+	"GOBANK_DB_PING_TIMEOUT": func(c *Config, v string) error {
+		return setDuration(&c.Database.PingTimeout, v)
+	},
+	"GOBANK_FX_RATES_FILE": func(c *Config, v string) error {
+		c.FX.RatesFile = v
+		return nil
+	},
+	"GOBANK_FX_SPREAD_BPS": func(c *Config, v string) error {
+		return setInt(&c.FX.SpreadBps, v)
+	},
+	"GOBANK_FX_QUOTE_TTL": func(c *Config, v string) error {
+		return setDuration(&c.FX.QuoteTTL, v)
+	},
+	"GOBANK_ACCESS_TOKEN_TTL": func(c *Config, v string) error {
+		return setDuration(&c.Auth.AccessTokenTTL, v)
+	},
+	"GOBANK_REFRESH_TOKEN_TTL": func(c *Config, v string) error {
+		return setDuration(&c.Auth.RefreshTokenTTL, v)
+	},
+	"GOBANK_JWT_ISSUER": func(c *Config, v string) error {
+		c.Auth.Issuer = v
+		return nil
+	},
+	"GOBANK_JWT_AUDIENCE": func(c *Config, v string) error {
+		c.Auth.Audience = v
+		return nil
+	},
+	"GOBANK_JWT_CLOCK_SKEW": func(c *Config, v string) error {
+		return setDuration(&c.Auth.ClockSkew, v)
+	},
+	"GOBANK_JWT_SIGNING_KEY": func(c *Config, v string) error {
+		c.Auth.SigningKeyFile = v
+		return nil
+	},
+	"GOBANK_JWT_VERIFICATION_KEYS": func(c *Config, v string) error {
+		c.Auth.VerificationKeyFiles = nil
+		for _, path := range strings.Split(v, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				c.Auth.VerificationKeyFiles = append(c.Auth.VerificationKeyFiles, path)
+			}
+		}
+		return nil
+	},
+	"GOBANK_MFA_KEY": func(c *Config, v string) error {
+		c.Auth.MFAKey = v
+		return nil
+	},
+	"GOBANK_LOGIN_MAX_ACCOUNT_FAILURES": func(c *Config, v string) error {
+		return setInt(&c.Login.MaxAccountFailures, v)
+	},
+	"GOBANK_LOGIN_MAX_IP_FAILURES": func(c *Config, v string) error {
+		return setInt(&c.Login.MaxIPFailures, v)
+	},
+	"GOBANK_LOGIN_LOCKOUT": func(c *Config, v string) error {
+		return setDuration(&c.Login.Lockout, v)
+	},
+	"GOBANK_LOGIN_BACKOFF_BASE": func(c *Config, v string) error {
+		return setDuration(&c.Login.BackoffBase, v)
+	},
+	"GOBANK_LOGIN_BACKOFF_MAX": func(c *Config, v string) error {
+		return setDuration(&c.Login.BackoffMax, v)
+	},
+	"GOBANK_STEP_UP_THRESHOLD": func(c *Config, v string) error {
+		return setUint(&c.StepUp.Threshold, v)
+	},
+	"GOBANK_STEP_UP_WINDOW": func(c *Config, v string) error {
+		return setDuration(&c.StepUp.Window, v)
+	},
+	"GOBANK_PASSWORD_MIN_LENGTH": func(c *Config, v string) error {
+		return setInt(&c.Password.MinLength, v)
+	},
+	"GOBANK_PASSWORD_REQUIRE_UPPER": func(c *Config, v string) error {
+		return setBool(&c.Password.RequireUpper, v)
+	},
+	"GOBANK_PASSWORD_REQUIRE_LOWER": func(c *Config, v string) error {
+		return setBool(&c.Password.RequireLower, v)
+	},
+	"GOBANK_PASSWORD_REQUIRE_DIGIT": func(c *Config, v string) error {
+		return setBool(&c.Password.RequireDigit, v)
+	},
+	"GOBANK_PASSWORD_REQUIRE_SYMBOL": func(c *Config, v string) error {
+		return setBool(&c.Password.RequireSymbol, v)
+	},
+	"GOBANK_BCRYPT_COST": func(c *Config, v string) error {
+		return setInt(&c.Password.BcryptCost, v)
+	},
+	"GOBANK_PASSWORD_RESET_TTL": func(c *Config, v string) error {
+		return setDuration(&c.Password.ResetTokenTTL, v)
+	},
+	"GOBANK_WITHDRAWAL_MAX": func(c *Config, v string) error {
+		return setUint(&c.Withdrawal.MaxAmount, v)
+	},
+	"GOBANK_WITHDRAWAL_DAILY_LIMIT": func(c *Config, v string) error {
+		return setUint(&c.Withdrawal.DailyLimit, v)
+	},
+}
+
+func applyConfigEnv(cfg *Config) error {
+	for name, set := range configEnv {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := set(cfg, value); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// ConfigFlags registers the config flags on a FlagSet, only the flags that
+// were actually passed override the file and environment
+type ConfigFlags struct {
+	fs   *flag.FlagSet
+	path *string
+	set  map[string]func(*Config, string) error
+}
+
+func BindConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	f := &ConfigFlags{
+		fs:   fs,
+		path: fs.String("config", "", "path to a JSON config file (or GOBANK_CONFIG)"),
+		set:  map[string]func(*Config, string) error{},
+	}
+
+	f.bind("listen-addr", "address the api listens on", configEnv["GOBANK_LISTEN_ADDR"])
+	f.bind("store", "storage backend: postgres or memory", configEnv["GOBANK_STORE"])
+	f.bind("idempotency-ttl", "how long idempotency keys are remembered", configEnv["GOBANK_IDEMPOTENCY_TTL"])
+	f.bind("database-url", "postgres DSN (or DATABASE_URL)", configEnv["DATABASE_URL"])
+	f.bind("db-sslmode", "postgres sslmode", configEnv["GOBANK_DB_SSLMODE"])
+	f.bind("db-max-open-conns", "max open database connections", configEnv["GOBANK_DB_MAX_OPEN_CONNS"])
+	f.bind("db-max-idle-conns", "max idle database connections", configEnv["GOBANK_DB_MAX_IDLE_CONNS"])
+	f.bind("db-conn-max-lifetime", "max lifetime of a database connection", configEnv["GOBANK_DB_CONN_MAX_LIFETIME"])
+	f.bind("db-ping-timeout", "timeout for the startup database ping", configEnv["GOBANK_DB_PING_TIMEOUT"])
+	f.bind("fx-rates-file", "JSON file with exchange rates", configEnv["GOBANK_FX_RATES_FILE"])
+	f.bind("fx-spread-bps", "spread applied to exchange rates, in basis points", configEnv["GOBANK_FX_SPREAD_BPS"])
+	f.bind("fx-quote-ttl", "how long an fx quote can be used", configEnv["GOBANK_FX_QUOTE_TTL"])
+	f.bind("access-token-ttl", "lifetime of access tokens", configEnv["GOBANK_ACCESS_TOKEN_TTL"])
+	f.bind("refresh-token-ttl", "lifetime of refresh tokens", configEnv["GOBANK_REFRESH_TOKEN_TTL"])
+	f.bind("jwt-issuer", "iss claim of issued tokens", configEnv["GOBANK_JWT_ISSUER"])
+	f.bind("jwt-audience", "aud claim of issued tokens", configEnv["GOBANK_JWT_AUDIENCE"])
+	f.bind("jwt-clock-skew", "leeway when checking token times", configEnv["GOBANK_JWT_CLOCK_SKEW"])
+	f.bind("jwt-signing-key", "PEM file with the RSA or Ed25519 key tokens are signed with", configEnv["GOBANK_JWT_SIGNING_KEY"])
+	f.bind("jwt-verification-keys", "comma separated PEM files with keys of older tokens", configEnv["GOBANK_JWT_VERIFICATION_KEYS"])
+	f.bind("mfa-key", "base64 encoded 32 byte key mfa secrets are encrypted with", configEnv["GOBANK_MFA_KEY"])
+	f.bind("login-max-account-failures", "failed logins before an account is locked", configEnv["GOBANK_LOGIN_MAX_ACCOUNT_FAILURES"])
+	f.bind("login-max-ip-failures", "failed logins before a client ip is locked", configEnv["GOBANK_LOGIN_MAX_IP_FAILURES"])
+	f.bind("login-lockout", "how long a lockout lasts", configEnv["GOBANK_LOGIN_LOCKOUT"])
+	f.bind("login-backoff-base", "wait after the first failed login, doubled on every failure", configEnv["GOBANK_LOGIN_BACKOFF_BASE"])
+	f.bind("login-backoff-max", "longest wait between failed logins", configEnv["GOBANK_LOGIN_BACKOFF_MAX"])
+	f.bind("step-up-threshold", "transfers above this amount need a fresh password or code, 0 turns it off", configEnv["GOBANK_STEP_UP_THRESHOLD"])
+	f.bind("step-up-window", "how long a step-up is good for", configEnv["GOBANK_STEP_UP_WINDOW"])
+	f.bind("password-min-length", "shortest password accepted", configEnv["GOBANK_PASSWORD_MIN_LENGTH"])
+	f.bind("password-require-upper", "passwords need an upper case letter", configEnv["GOBANK_PASSWORD_REQUIRE_UPPER"])
+	f.bind("password-require-lower", "passwords need a lower case letter", configEnv["GOBANK_PASSWORD_REQUIRE_LOWER"])
+	f.bind("password-require-digit", "passwords need a digit", configEnv["GOBANK_PASSWORD_REQUIRE_DIGIT"])
+	f.bind("password-require-symbol", "passwords need a symbol", configEnv["GOBANK_PASSWORD_REQUIRE_SYMBOL"])
+	f.bind("bcrypt-cost", "bcrypt cost of password hashes, existing ones are rehashed on login", configEnv["GOBANK_BCRYPT_COST"])
+	f.bind("password-reset-ttl", "how long an admin issued reset token works", configEnv["GOBANK_PASSWORD_RESET_TTL"])
+	f.bind("withdrawal-max", "largest single withdrawal staff can make, 0 turns it off", configEnv["GOBANK_WITHDRAWAL_MAX"])
+	f.bind("withdrawal-daily-limit", "most that can be withdrawn from an account in 24 hours, 0 turns it off", configEnv["GOBANK_WITHDRAWAL_DAILY_LIMIT"])
+
+	return f
+}
+
+func (f *ConfigFlags) bind(name, usage string, set func(*Config, string) error) {
+	f.fs.String(name, "", usage)
+	f.set[name] = set
+}
+
+// Load must be called after the FlagSet has been parsed
+func (f *ConfigFlags) Load() (*Config, error) {
+	cfg := defaultConfig()
+
+	path := *f.path
+	if path == "" {
+		path = os.Getenv("GOBANK_CONFIG")
+	}
+	if path != "" {
+		if err := loadConfigFile(path, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyConfigEnv(cfg); err != nil {
+		return nil, err
+	}
+
+	var flagErr error
+	f.fs.Visit(func(fl *flag.Flag) {
+		set, ok := f.set[fl.Name]
+		if !ok || flagErr != nil {
+			return
+		}
+
+		if err := set(cfg, fl.Value.String()); err != nil {
+			flagErr = fmt.Errorf("invalid -%s: %w", fl.Name, err)
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func setInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+
+	*dst = n
+	return nil
+}
+
+func setUint(dst *uint64, v string) error {
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	*dst = n
+	return nil
+}
+
+func setBool(dst *bool, v string) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return err
+	}
+
+	*dst = b
+	return nil
+}
+
+func setDuration(dst *Duration, v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+
+	*dst = Duration(d)
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{
+		"listen_addr": ":4000",
+		"database": {"dsn": "postgres://file@localhost/bank", "max_open_conns": 10, "max_idle_conns": 5}
+	}`), 0600)
+	require.NoError(t, err)
+
+	t.Setenv("DATABASE_URL", "postgres://env@localhost/bank")
+	t.Setenv("GOBANK_DB_PING_TIMEOUT", "2s")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	configFlags := BindConfigFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-config", path, "-db-max-open-conns", "20"}))
+
+	cfg, err := configFlags.Load()
+	require.NoError(t, err)
+
+	//file overrides defaults
+	assert.Equal(t, ":4000", cfg.ListenAddr)
+	assert.Equal(t, 5, cfg.Database.IdleConns())
+	//env overrides the file
+	assert.Equal(t, "postgres://env@localhost/bank", cfg.Database.DSN)
+	assert.Equal(t, Duration(2*time.Second), cfg.Database.PingTimeout)
+	//flags override everything
+	assert.Equal(t, 20, cfg.Database.MaxOpenConns)
+	//untouched settings keep their defaults
+	assert.Equal(t, "postgres", cfg.Store)
+}
+
+func TestConfigValidation(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	configFlags := BindConfigFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-db-max-open-conns", "2", "-db-max-idle-conns", "5"}))
+
+	_, err := configFlags.Load()
+	assert.Error(t, err)
+}
+
+func TestConfigIdleConnsFollowMaxOpen(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	configFlags := BindConfigFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-db-max-open-conns", "10"}))
+
+	//the default idle count is lowered to the open connections
+	cfg, err := configFlags.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 10, cfg.Database.IdleConns())
+
+	//an explicit idle count is kept
+	t.Setenv("GOBANK_DB_MAX_IDLE_CONNS", "4")
+	cfg, err = configFlags.Load()
+	require.NoError(t, err)
+	assert.Equal(t, 4, cfg.Database.IdleConns())
+
+	//unlimited open connections keep the default
+	assert.Equal(t, defaultMaxIdleConns, DatabaseConfig{}.IdleConns())
+}
+
+func TestConnString(t *testing.T) {
+	db := DatabaseConfig{DSN: "user=postgres dbname=postgres", SSLMode: "require"}
+	connStr, err := db.ConnString()
+	require.NoError(t, err)
+	assert.Equal(t, "user=postgres dbname=postgres sslmode=require", connStr)
+
+	db = DatabaseConfig{DSN: "postgres://postgres@localhost/bank", SSLMode: "verify-full"}
+	connStr, err = db.ConnString()
+	require.NoError(t, err)
+	assert.Equal(t, "postgres://postgres@localhost/bank?sslmode=verify-full", connStr)
+
+	//an sslmode in the DSN wins
+	db = DatabaseConfig{DSN: "postgres://postgres@localhost/bank?sslmode=disable", SSLMode: "require"}
+	connStr, err = db.ConnString()
+	require.NoError(t, err)
+	assert.Equal(t, "postgres://postgres@localhost/bank?sslmode=disable", connStr)
+}
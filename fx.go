@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoRate         = errors.New("no exchange rate available")
+	ErrQuoteNotFound  = errors.New("fx quote not found")
+	ErrQuoteUsed      = errors.New("fx quote already used")
+	ErrAmountTooSmall = errors.New("amount too small to convert")
+)
+
+const (
+	defaultFXQuoteTTL  = 30 * time.Second
+	rateScaleDecimals  = 9
+	basisPointsPerUnit = 10_000
+)
+
+var rateScale = big.NewInt(1_000_000_000)
+
+// Rate is an exchange rate in billionths, 1.085 is stored as 1_085_000_000.
+// It's written to JSON as a decimal string so clients never see a float.
+type Rate int64
+
+func ParseRate(s string) (Rate, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || r.Sign() <= 0 {
+		return 0, fmt.Errorf("invalid exchange rate %q", s)
+	}
+
+	scaled := new(big.Int).Quo(new(big.Int).Mul(r.Num(), rateScale), r.Denom())
+	if !scaled.IsInt64() || scaled.Sign() == 0 {
+		return 0, fmt.Errorf("exchange rate %q out of range", s)
+	}
+
+	return Rate(scaled.Int64()), nil
+}
+
+func (r Rate) String() string {
+	s := fmt.Sprintf("%d.%0*d", r/Rate(rateScale.Int64()), rateScaleDecimals, r%Rate(rateScale.Int64()))
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+
+	*r = parsed
+	return nil
+}
+
+// the rate going the other way, used to record reversals
+func (r Rate) inverse() Rate {
+	scale := rateScale.Int64()
+	return Rate(scale * scale / int64(r))
+}
+
+// the rate the customer gets, the spread is kept by the bank
+func (r Rate) withSpread(spreadBps int) Rate {
+	return Rate(int64(r) * (basisPointsPerUnit - int64(spreadBps)) / basisPointsPerUnit)
+}
+
+// converts into the minor units of the target currency, rounding down
+func convertMoney(m Money, to Currency, rate Rate) (Money, error) {
+	n := new(big.Int).Mul(new(big.Int).SetUint64(m.Amount), big.NewInt(int64(rate)))
+	n.Mul(n, pow10(to.MinorUnits()))
+	n.Quo(n, new(big.Int).Mul(rateScale, pow10(m.Currency.MinorUnits())))
+
+	if n.Sign() == 0 {
+		return Money{}, ErrAmountTooSmall
+	}
+	if !n.IsUint64() {
+		return Money{}, fmt.Errorf("converted amount out of range")
+	}
+
+	return Money{Amount: n.Uint64(), Currency: to}, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+type FXRateProvider interface {
+	// mid-market rate, one unit of from buys Rate units of to
+	Rate(from Currency, to Currency) (Rate, error)
+}
+
+// StaticRateProvider serves a fixed table of rates. A missing pair falls
+// back to the inverse of the opposite pair when that one is known.
+type StaticRateProvider struct {
+	rates map[[2]Currency]Rate
+}
+
+func NewStaticRateProvider(rates map[[2]Currency]Rate) *StaticRateProvider {
+	if rates == nil {
+		rates = map[[2]Currency]Rate{}
+	}
+
+	return &StaticRateProvider{rates: rates}
+}
+
+// reads {"rates": {"USD/EUR": "0.92", ...}}
+func LoadRateFile(path string) (*StaticRateProvider, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rate file: %w", err)
+	}
+
+	var file struct {
+		Rates map[string]Rate `json:"rates"`
+	}
+	if err := json.Unmarshal(contents, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse rate file %s: %w", path, err)
+	}
+
+	rates := map[[2]Currency]Rate{}
+	for pair, rate := range file.Rates {
+		codes := strings.Split(pair, "/")
+		if len(codes) != 2 {
+			return nil, fmt.Errorf("invalid currency pair %q, expected FROM/TO", pair)
+		}
+
+		from, err := ParseCurrency(codes[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := ParseCurrency(codes[1])
+		if err != nil {
+			return nil, err
+		}
+
+		rates[[2]Currency{from, to}] = rate
+	}
+
+	return NewStaticRateProvider(rates), nil
+}
+
+func (p *StaticRateProvider) Rate(from Currency, to Currency) (Rate, error) {
+	if from == to {
+		return Rate(rateScale.Int64()), nil
+	}
+
+	if rate, ok := p.rates[[2]Currency{from, to}]; ok {
+		return rate, nil
+	}
+
+	if inverse, ok := p.rates[[2]Currency{to, from}]; ok {
+		scaled := new(big.Int).Mul(rateScale, rateScale)
+		return Rate(scaled.Quo(scaled, big.NewInt(int64(inverse))).Int64()), nil
+	}
+
+	return 0, fmt.Errorf("%s/%s: %w", from, to, ErrNoRate)
+}
+
+// FXService prices conversions off a provider and applies the bank's spread
+type FXService struct {
+	provider  FXRateProvider
+	spreadBps int
+	quoteTTL  time.Duration
+}
+
+func NewFXService(provider FXRateProvider, spreadBps int, quoteTTL time.Duration) *FXService {
+	return &FXService{
+		provider:  provider,
+		spreadBps: spreadBps,
+		quoteTTL:  quoteTTL,
+	}
+}
+
+func (f *FXService) Convert(amount Money, to Currency) (*FXDetails, error) {
+	mid, err := f.provider.Rate(amount.Currency, to)
+	if err != nil {
+		return nil, err
+	}
+
+	rate := mid.withSpread(f.spreadBps)
+	converted, err := convertMoney(amount, to, rate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FXDetails{Rate: rate, Converted: converted}, nil
+}
+
+// prices a transfer and fixes the rate until the quote expires
+func (f *FXService) Quote(from *Account, to *Account, amount uint64) (*FXQuote, error) {
+	source := Money{Amount: amount, Currency: from.Currency}
+	details, err := f.Convert(source, to.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newQuoteId()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	return &FXQuote{
+		Id:         id,
+		FromNumber: from.Number,
+		ToNumber:   to.Number,
+		Money:      source,
+		Rate:       details.Rate,
+		Converted:  details.Converted,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(f.quoteTTL),
+	}, nil
+}
+
+func newQuoteId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
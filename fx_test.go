@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	rate, err := ParseRate("1.085")
+	assert.NoError(t, err)
+	assert.Equal(t, Rate(1_085_000_000), rate)
+	assert.Equal(t, "1.085", rate.String())
+
+	rate, err = ParseRate("151")
+	assert.NoError(t, err)
+	assert.Equal(t, "151", rate.String())
+
+	_, err = ParseRate("-1")
+	assert.Error(t, err)
+	_, err = ParseRate("abc")
+	assert.Error(t, err)
+
+	encoded, err := json.Marshal(Rate(920_000_000))
+	assert.NoError(t, err)
+	assert.Equal(t, `"0.92"`, string(encoded))
+
+	assert.Equal(t, Rate(500_000_000), Rate(2_000_000_000).inverse())
+	assert.Equal(t, Rate(6_613_756), Rate(151_200_000_000).inverse())
+}
+
+func TestConvertMoney(t *testing.T) {
+	//10.00 USD at 151.2 is 1512 JPY, which has no minor units
+	converted, err := convertMoney(Money{Amount: 1000, Currency: "USD"}, "JPY", Rate(151_200_000_000))
+	assert.NoError(t, err)
+	assert.Equal(t, Money{Amount: 1512, Currency: "JPY"}, converted)
+
+	//and back again, 1512 JPY to cents
+	converted, err = convertMoney(Money{Amount: 1512, Currency: "JPY"}, "USD", Rate(6_613_757))
+	assert.NoError(t, err)
+	assert.Equal(t, Money{Amount: 1000, Currency: "USD"}, converted)
+
+	_, err = convertMoney(Money{Amount: 1, Currency: "JPY"}, "USD", Rate(6_613_757))
+	assert.ErrorIs(t, err, ErrAmountTooSmall)
+}
+
+func TestFXServiceSpread(t *testing.T) {
+	provider := NewStaticRateProvider(map[[2]Currency]Rate{
+		{"USD", "EUR"}: Rate(1_000_000_000),
+	})
+	fx := NewFXService(provider, 100, time.Minute)
+
+	details, err := fx.Convert(Money{Amount: 10000, Currency: "USD"}, "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, "0.99", details.Rate.String())
+	assert.Equal(t, Money{Amount: 9900, Currency: "EUR"}, details.Converted)
+
+	//the inverse pair is derived from the one we know
+	details, err = fx.Convert(Money{Amount: 10000, Currency: "EUR"}, "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(9900), details.Converted.Amount)
+
+	_, err = fx.Convert(Money{Amount: 10000, Currency: "USD"}, "GBP")
+	assert.ErrorIs(t, err, ErrNoRate)
+}
+
+func TestLoadRateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"rates": {"usd/eur": "0.92"}}`), 0o600))
+
+	provider, err := LoadRateFile(path)
+	require.NoError(t, err)
+
+	rate, err := provider.Rate("USD", "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, "0.92", rate.String())
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"rates": {"USDEUR": "0.92"}}`), 0o600))
+	_, err = LoadRateFile(path)
+	assert.Error(t, err)
+}
+
+func TestPartialFXReversal(t *testing.T) {
+	//10.00 USD arrived as 1512 JPY
+	transfer := &Transfer{Id: 7, FromNumber: 1, ToNumber: 2, Money: Money{Amount: 1000, Currency: "USD"},
+		FX: &FXDetails{Rate: Rate(151_200_000_000), Converted: Money{Amount: 1512, Currency: "JPY"}}}
+
+	full := reversalOf(transfer, 1512)
+	assert.Equal(t, Money{Amount: 1512, Currency: "JPY"}, full.Money)
+	assert.Equal(t, transfer.Money, full.FX.Converted)
+
+	//a third of the yen refunds a third of the cents, rounded down
+	partial := reversalOf(transfer, 504)
+	assert.Equal(t, uint64(333), partial.FX.Converted.Amount)
+	assert.Equal(t, int64(2), partial.FromNumber)
+	assert.Equal(t, int64(7), partial.ReversalOf)
+}
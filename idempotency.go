@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyHeader        = "Idempotency-Key"
+	maxIdempotencyKeyLength  = 255
+	defaultIdempotencyTTL    = 24 * time.Hour
+	idempotencyPurgeInterval = time.Hour
+)
+
+// replays the stored response when a request is retried with the same
+// Idempotency-Key. It must run after jwtAuthMiddleware, keys are scoped to
+// the authorized account so two clients can't collide.
+func (s *ApiServer) idempotencyMiddleware(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			handlerFunc(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			WriteJson(w, http.StatusBadRequest, ApiError{Error: "idempotency key too long"})
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not read request"})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		accountNumber, _ := r.Context().Value("authorizedAccountNumber").(int64)
+		now := time.Now().UTC()
+		rec := &IdempotencyRecord{
+			Key:         fmt.Sprintf("%d:%s", accountNumber, key),
+			RequestHash: hashRequest(r, body),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(s.idempotencyTTL),
+		}
+
+		existing, err := s.store.ReserveIdempotencyKey(rec)
+		if err != nil {
+			fmt.Println("Error reserving idempotency key")
+			WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+			return
+		}
+
+		if existing != nil {
+			replayIdempotentResponse(w, rec, existing)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		handlerFunc(recorder, r)
+
+		// server errors are not remembered so the client can retry them, same
+		// for 401s so the retry can carry a step-up token
+		if recorder.status == 0 || recorder.status == http.StatusUnauthorized ||
+			recorder.status >= http.StatusInternalServerError {
+			if err := s.store.ReleaseIdempotencyKey(rec.Key); err != nil {
+				fmt.Println("Error releasing idempotency key")
+			}
+			return
+		}
+
+		rec.StatusCode = recorder.status
+		rec.ResponseBody = recorder.body.Bytes()
+		if err := s.store.CompleteIdempotencyKey(rec); err != nil {
+			fmt.Println("Error storing idempotent response")
+		}
+	}
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, rec *IdempotencyRecord, existing *IdempotencyRecord) {
+	if existing.RequestHash != rec.RequestHash {
+		WriteJson(w, http.StatusUnprocessableEntity, ApiError{Error: "idempotency key reused with a different request"})
+		return
+	}
+
+	if existing.StatusCode == 0 {
+		WriteJson(w, http.StatusConflict, ApiError{Error: "a request with this idempotency key is still in progress"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(existing.StatusCode)
+	w.Write(existing.ResponseBody)
+}
+
+func hashRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte(r.URL.Path))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *ApiServer) purgeIdempotencyKeys() {
+	for range time.Tick(idempotencyPurgeInterval) {
+		if _, err := s.store.PurgeIdempotencyKeys(time.Now().UTC()); err != nil {
+			fmt.Println("Error purging idempotency keys")
+		}
+	}
+}
+
+// keeps a copy of what the handler wrote so it can be replayed later
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultJWTIssuer    = "gobank"
+	defaultJWTAudience  = "gobank-api"
+	defaultJWTClockSkew = 30 * time.Second
+)
+
+// TokenClaims are the claims of a gobank access token, the subject is the
+// account number
+type TokenClaims struct {
+	Role string `json:"role"`
+	// how the user proved who they are, see the authMethod constants
+	AuthMethods []string `json:"amr,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (c *TokenClaims) AccountNumber() (int64, error) {
+	return strconv.ParseInt(c.Subject, 10, 64)
+}
+
+// authenticates the caller and puts their account number, role and its
+// permissions in the request context
+func (s *ApiServer) jwtAuthMiddleware(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(handlerFunc, true)
+}
+
+// for the mfa enrollment endpoints, accounts whose role needs mfa can only
+// get this far until they enrolled
+func (s *ApiServer) mfaEnrollmentMiddleware(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return s.authenticate(handlerFunc, false)
+}
+
+func (s *ApiServer) authenticate(handlerFunc http.HandlerFunc, requireMFA bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenString := r.Header.Get("x-jwt-token")
+		if tokenString == "" {
+			WriteJson(w, http.StatusUnauthorized, ApiError{Error: "authentication required"})
+			return
+		}
+
+		claims, err := s.validateJwt(tokenString)
+		if err != nil {
+			fmt.Println("Can't validate token:", err)
+			WriteJson(w, http.StatusForbidden, ApiError{Error: "permission denied"})
+			return
+		}
+
+		accountNumber, err := claims.AccountNumber()
+		if err != nil {
+			fmt.Println("Invalid subject in token")
+			WriteJson(w, http.StatusForbidden, ApiError{Error: "permission denied"})
+			return
+		}
+
+		revoked, err := s.store.IsTokenRevoked(claims.ID)
+		if err != nil {
+			fmt.Println("Error checking token revocation")
+			WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+			return
+		}
+		if revoked {
+			WriteJson(w, http.StatusUnauthorized, ApiError{Error: "token has been revoked"})
+			return
+		}
+
+		// a token outlives a closed account, don't let it act for one
+		acc, err := s.store.GetAccountByNumber(accountNumber)
+		if err != nil {
+			if errors.Is(err, ErrAccountNotFound) {
+				WriteJson(w, http.StatusUnauthorized, ApiError{Error: "account no longer exists"})
+				return
+			}
+			fmt.Println("Error retrieving token account")
+			WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+			return
+		}
+		if acc.Status == AccountClosed {
+			WriteJson(w, http.StatusUnauthorized, ApiError{Error: "account is closed"})
+			return
+		}
+
+		// the role is looked up on every request rather than trusted from the
+		// token, so changing it takes effect right away
+		role, err := s.store.GetRole(acc.Role)
+		if err != nil {
+			fmt.Println("Error retrieving role of token account")
+			WriteJson(w, http.StatusForbidden, ApiError{Error: "permission denied"})
+			return
+		}
+
+		if requireMFA && role.RequireMFA && !hasAuthMethod(claims.AuthMethods, authMethodOTP) {
+			WriteJson(w, http.StatusForbidden, ApiError{Error: fmt.Sprintf("the %s role requires mfa, see /account/mfa/enroll", role.Name)})
+			return
+		}
+
+		// iat only has second precision, tokens from the second of the change
+		// are rejected too rather than letting an older one through
+		if acc.PasswordChangedAt != nil && !claims.IssuedAt.Time.After(acc.PasswordChangedAt.Truncate(time.Second)) {
+			WriteJson(w, http.StatusUnauthorized, ApiError{Error: "password has changed, log in again"})
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "role", role.Name)
+		ctx = context.WithValue(ctx, "permissions", role.Permissions)
+		ctx = context.WithValue(ctx, "authorizedAccountNumber", accountNumber)
+		ctx = context.WithValue(ctx, "tokenId", claims.ID)
+		ctx = context.WithValue(ctx, "tokenExpiresAt", claims.ExpiresAt.Time)
+		ctx = context.WithValue(ctx, "authMethods", claims.AuthMethods)
+
+		handlerFunc(w, r.WithContext(ctx))
+	}
+}
+
+// checks the signature and every registered claim, clocks may be off by up
+// to jwtLeeway
+func (s *ApiServer) validateJwt(tokenString string) (*TokenClaims, error) {
+	return s.parseJwt(tokenString, s.jwtAudience)
+}
+
+// mfa challenges are signed the same way but for a different audience, so
+// they can't be used as access tokens
+func (s *ApiServer) parseJwt(tokenString string, audience string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, s.keys.keyFunc,
+		jwt.WithValidMethods(s.keys.methods()),
+		jwt.WithIssuer(s.jwtIssuer),
+		jwt.WithAudience(audience),
+		jwt.WithLeeway(s.jwtLeeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	// the parser only checks these when they are present
+	if claims.IssuedAt == nil || claims.NotBefore == nil || claims.Subject == "" || claims.ID == "" {
+		return nil, fmt.Errorf("token is missing required claims")
+	}
+
+	return claims, nil
+}
+
+func (s *ApiServer) createJwt(account *Account, expiresAt time.Time, authMethods []string) (string, error) {
+	tokenId, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := &TokenClaims{
+		Role:        account.Role,
+		AuthMethods: authMethods,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.jwtIssuer,
+			Subject:   strconv.FormatInt(account.Number, 10),
+			Audience:  jwt.ClaimStrings{s.jwtAudience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        tokenId,
+		},
+	}
+
+	return s.keys.sign(claims)
+}
+
+// public keys for services that verify gobank tokens themselves
+func (s *ApiServer) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	return WriteJson(w, http.StatusOK, s.keys.JWKS())
+}
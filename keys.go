@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const minRSAKeyBits = 2048
+
+// KeySet signs tokens with one key and verifies them with any key it knows,
+// picked by the kid header. Rotating means signing with a new key while the
+// old one stays in the set until the tokens it signed have expired.
+type KeySet struct {
+	signing *jwtKey
+	keys    map[string]*jwtKey
+}
+
+type jwtKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.PrivateKey
+	public  crypto.PublicKey
+}
+
+// JWK is the public half of a key as served from /.well-known/jwks.json
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyId     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// signs with the private key in signingKeyPath, the verification files can
+// hold public or private keys of previous signing keys
+func LoadKeySet(signingKeyPath string, verificationKeyPaths []string) (*KeySet, error) {
+	signing, err := loadKeyFile(signingKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	if signing.private == nil {
+		return nil, fmt.Errorf("%s: signing key must be a private key", signingKeyPath)
+	}
+
+	ks := &KeySet{signing: signing, keys: map[string]*jwtKey{signing.id: signing}}
+	for _, path := range verificationKeyPaths {
+		key, err := loadKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// only the public half is needed to verify
+		key.private = nil
+		if _, ok := ks.keys[key.id]; !ok {
+			ks.keys[key.id] = key
+		}
+	}
+
+	return ks, nil
+}
+
+// the old shared secret setup, kept for local development. Its tokens can't
+// be verified by other services, so it's left out of the JWKS.
+func NewHMACKeySet(secret []byte) *KeySet {
+	key := &jwtKey{id: "hmac", method: jwt.SigningMethodHS256, private: secret, public: secret}
+	return &KeySet{signing: key, keys: map[string]*jwtKey{key.id: key}}
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	if secret, ok := ks.signing.private.([]byte); ok && len(secret) == 0 {
+		return "", fmt.Errorf("JWT_SECRET environment variable not set")
+	}
+
+	token := jwt.NewWithClaims(ks.signing.method, claims)
+	token.Header["kid"] = ks.signing.id
+
+	return token.SignedString(ks.signing.private)
+}
+
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	// never let the token pick a different algorithm for a known key
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v for key %q", token.Header["alg"], kid)
+	}
+
+	return key.public, nil
+}
+
+func (ks *KeySet) methods() []string {
+	seen := map[string]bool{}
+	methods := []string{}
+	for _, key := range ks.keys {
+		if alg := key.method.Alg(); !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+
+	return methods
+}
+
+func (ks *KeySet) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		if jwk, ok := key.jwk(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].KeyId < set.Keys[j].KeyId
+	})
+
+	return set
+}
+
+func (k *jwtKey) jwk() (JWK, bool) {
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			KeyType:   "RSA",
+			KeyId:     k.id,
+			Use:       "sig",
+			Algorithm: k.method.Alg(),
+			N:         base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			KeyType:   "OKP",
+			KeyId:     k.id,
+			Use:       "sig",
+			Algorithm: k.method.Alg(),
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(public),
+		}, true
+	}
+
+	return JWK{}, false
+}
+
+// reads a PEM encoded RSA or Ed25519 key, public or private
+func loadKeyFile(path string) (*jwtKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read key file: %w", err)
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	key := &jwtKey{}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.private, key.public = k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.public = k
+	case ed25519.PrivateKey:
+		key.private, key.public = k, k.Public()
+	case ed25519.PublicKey:
+		key.public = k
+	default:
+		return nil, fmt.Errorf("%s: only RSA and Ed25519 keys are supported", path)
+	}
+
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("%s: RSA keys must be at least %d bits", path, minRSAKeyBits)
+		}
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	}
+
+	key.id, err = keyThumbprint(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// the kid is the RFC 7638 thumbprint, so it never has to be configured and
+// the same key always gets the same id
+func keyThumbprint(key *jwtKey) (string, error) {
+	jwk, ok := key.jwk()
+	if !ok {
+		return "", fmt.Errorf("can't compute a thumbprint for this key")
+	}
+
+	// the required members only, in lexicographic order
+	var members any
+	if jwk.KeyType == "RSA" {
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.KeyType, jwk.N}
+	} else {
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Curve, jwk.KeyType, jwk.X}
+	}
+
+	encoded, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(encoded)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePrivateKey(t *testing.T, key any) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+	return path
+}
+
+func TestKeyRotation(t *testing.T) {
+	_, oldKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	oldPath := writePrivateKey(t, oldKey)
+	newPath := writePrivateKey(t, newKey)
+	acc := &Account{Number: 9901, Role: "user"}
+
+	server := NewApiServer(":3000", NewMemoryStore())
+	server.keys, err = LoadKeySet(oldPath, nil)
+	require.NoError(t, err)
+
+	oldToken, err := server.createJwt(acc, time.Now().Add(time.Minute), []string{authMethodPassword})
+	require.NoError(t, err)
+
+	//sign with the new key, the old one only verifies
+	server.keys, err = LoadKeySet(newPath, []string{oldPath})
+	require.NoError(t, err)
+
+	newToken, err := server.createJwt(acc, time.Now().Add(time.Minute), []string{authMethodPassword})
+	require.NoError(t, err)
+
+	for _, token := range []string{oldToken, newToken} {
+		_, err := server.validateJwt(token)
+		assert.NoError(t, err)
+	}
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, &TokenClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "RS256", parsed.Method.Alg())
+
+	jwks := server.keys.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	kids := []string{jwks.Keys[0].KeyId, jwks.Keys[1].KeyId}
+	assert.Contains(t, kids, parsed.Header["kid"])
+	for _, key := range jwks.Keys {
+		assert.Equal(t, "sig", key.Use)
+		if key.KeyType == "OKP" {
+			assert.Equal(t, "EdDSA", key.Algorithm)
+			assert.Equal(t, "Ed25519", key.Curve)
+		} else {
+			assert.Equal(t, "RS256", key.Algorithm)
+			assert.Equal(t, "AQAB", key.E)
+		}
+	}
+
+	//once the old key is dropped its tokens stop working
+	server.keys, err = LoadKeySet(newPath, nil)
+	require.NoError(t, err)
+	_, err = server.validateJwt(oldToken)
+	assert.Error(t, err)
+}
+
+func TestKeyAlgorithmConfusion(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	server := NewApiServer(":3000", NewMemoryStore())
+	server.keys, err = LoadKeySet(writePrivateKey(t, key), nil)
+	require.NoError(t, err)
+
+	//an HS256 token keyed with the public key must not pass as the RSA key
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    defaultJWTIssuer,
+			Subject:   "9901",
+			Audience:  jwt.ClaimStrings{defaultJWTAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        "abc",
+		},
+	})
+	token.Header["kid"] = server.keys.signing.id
+	publicDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	forged, err := token.SignedString(publicDer)
+	require.NoError(t, err)
+
+	_, err = server.validateJwt(forged)
+	assert.Error(t, err)
+}
+
+func TestLoadKeyFileRejectsSmallRSAKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	_, err = LoadKeySet(writePrivateKey(t, key), nil)
+	assert.Error(t, err)
+}
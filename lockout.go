@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const loginAttemptPurgeInterval = time.Hour
+
+// LoginConfig throttles password guessing. Every failure doubles the wait
+// before the next attempt, starting at BackoffBase and capped at BackoffMax.
+// Reaching the failure limit locks the account (or client ip) until Lockout
+// has passed since the last failure or an admin unlocks it.
+type LoginConfig struct {
+	MaxAccountFailures int      `json:"max_account_failures"`
+	MaxIPFailures      int      `json:"max_ip_failures"`
+	Lockout            Duration `json:"lockout"`
+	BackoffBase        Duration `json:"backoff_base"`
+	BackoffMax         Duration `json:"backoff_max"`
+}
+
+func defaultLoginConfig() LoginConfig {
+	return LoginConfig{
+		MaxAccountFailures: 5,
+		MaxIPFailures:      50,
+		Lockout:            Duration(15 * time.Minute),
+		BackoffBase:        Duration(time.Second),
+		BackoffMax:         Duration(30 * time.Second),
+	}
+}
+
+// when the next attempt is allowed, the zero time means right away
+func (c LoginConfig) retryAt(attempts *LoginAttempts, maxFailures int) time.Time {
+	if attempts == nil || attempts.Failures == 0 {
+		return time.Time{}
+	}
+
+	if attempts.Failures >= maxFailures {
+		return attempts.LastFailureAt.Add(time.Duration(c.Lockout))
+	}
+
+	backoff := time.Duration(c.BackoffBase)
+	for i := 1; i < attempts.Failures && backoff < time.Duration(c.BackoffMax); i++ {
+		backoff *= 2
+	}
+	if backoff > time.Duration(c.BackoffMax) {
+		backoff = time.Duration(c.BackoffMax)
+	}
+
+	return attempts.LastFailureAt.Add(backoff)
+}
+
+func accountLoginKey(number int64) string {
+	return fmt.Sprintf("account:%d", number)
+}
+
+func ipLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+// the address of the connection, gobank isn't meant to sit behind a proxy
+// that rewrites it
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// returns how long the caller has to wait before trying to log in again
+func (s *ApiServer) loginBlocked(number int64, ip string, now time.Time) (time.Duration, error) {
+	limits := map[string]int{
+		accountLoginKey(number): s.login.MaxAccountFailures,
+		ipLoginKey(ip):          s.login.MaxIPFailures,
+	}
+
+	var wait time.Duration
+	for key, maxFailures := range limits {
+		attempts, err := s.store.GetLoginAttempts(key)
+		if err != nil {
+			return 0, err
+		}
+
+		if retryAt := s.login.retryAt(attempts, maxFailures); retryAt.Sub(now) > wait {
+			wait = retryAt.Sub(now)
+		}
+	}
+
+	return wait, nil
+}
+
+func (s *ApiServer) recordLoginFailure(number int64, ip string, now time.Time) {
+	// failures older than the lockout don't count anymore
+	since := now.Add(-time.Duration(s.login.Lockout))
+
+	for _, key := range []string{accountLoginKey(number), ipLoginKey(ip)} {
+		if _, err := s.store.RecordLoginFailure(key, now, since); err != nil {
+			fmt.Println("Error recording failed login")
+		}
+	}
+}
+
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) error {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return WriteJson(w, http.StatusTooManyRequests, ApiError{Error: "too many failed login attempts, try again later"})
+}
+
+// clears the failures of an account, and of a client ip when one is given
+func (s *ApiServer) handleUnlockAccount(w http.ResponseWriter, r *http.Request) error {
+	req, err := decodeAndValidateRequest[UnlockAccountRequest](r)
+	if err != nil {
+		fmt.Println("Error decoding unlock request")
+		return writeStaffRequestError(w, err)
+	}
+
+	parameter, err := getParameter(r, "number")
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
+
+	number, err := strconv.ParseInt(parameter, 10, 64)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
+
+	if err := s.store.ResetLoginAttempts(accountLoginKey(number), s.auditEntry(r, auditAccountUnlock)); err != nil {
+		fmt.Println("Error unlocking account")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	if req.IP != "" {
+		if err := s.store.ResetLoginAttempts(ipLoginKey(req.IP), s.auditEntry(r, auditAccountUnlock)); err != nil {
+			fmt.Println("Error unlocking ip")
+			return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+		}
+	}
+
+	return WriteJson(w, http.StatusOK, map[string]int64{"unlocked": number})
+}
+
+func (s *ApiServer) purgeLoginAttempts() {
+	for range time.Tick(loginAttemptPurgeInterval) {
+		before := time.Now().UTC().Add(-time.Duration(s.login.Lockout))
+		if _, err := s.store.PurgeLoginAttempts(before); err != nil {
+			fmt.Println("Error purging login attempts")
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	cfg := defaultLoginConfig()
+	last := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.True(t, cfg.retryAt(&LoginAttempts{}, 5).IsZero())
+
+	//1s, 2s, 4s, 8s then locked for the full lockout
+	for failures, wait := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 8 * time.Second,
+		5: 15 * time.Minute,
+	} {
+		attempts := &LoginAttempts{Failures: failures, LastFailureAt: last}
+		assert.Equal(t, last.Add(wait), cfg.retryAt(attempts, 5), "failures=%d", failures)
+	}
+
+	//the backoff is capped below the limit
+	attempts := &LoginAttempts{Failures: 20, LastFailureAt: last}
+	assert.Equal(t, last.Add(30*time.Second), cfg.retryAt(attempts, 50))
+}
@@ -4,16 +4,20 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"time"
 )
 
-func seedAccount(store Storage, fname, lname, pw, role string) *Account {
+func seedAccount(store Storage, passwords PasswordConfig, fname, lname, pw, role string) *Account {
 
-	acc, err := NewAccount(fname, lname, pw, role, 0)
+	acc, err := NewAccount(fname, lname, pw, role, 0, passwords.BcryptCost)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := store.CreateAccount(acc); err != nil {
+	// seeding happens outside the api, there is no one to attribute it to
+	audit := &AuditEntry{ActorRole: "system", Action: auditAccountCreate, CreatedAt: time.Now().UTC()}
+	if err := store.CreateAccount(acc, audit); err != nil {
 		log.Fatal(err)
 
 	}
@@ -25,35 +29,114 @@ func seedAccount(store Storage, fname, lname, pw, role string) *Account {
 }
 
 // seeding a test db
-func seedAccounts(s Storage) {
-	seedAccount(s, "luis", "cast", "password", "user")
+func seedAccounts(s Storage, passwords PasswordConfig) {
+	seedAccount(s, passwords, "luis", "cast", "password", "user")
 }
 
-func createAdminAccount(s Storage, firstName, lastName, password string) {
-	seedAccount(s, firstName, lastName, password, "admin")
+func createAdminAccount(s Storage, passwords PasswordConfig, firstName, lastName, password string) {
+	seedAccount(s, passwords, firstName, lastName, password, "admin")
+}
+
+// gobank migrate [config flags] up|down|status
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configFlags := BindConfigFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: gobank migrate [flags] up|down|status")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := configFlags.Load()
+	if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+
+	store, err := NewPostgressStore(cfg.Database)
+	if err != nil {
+		log.Fatal("Error initializing the db: ", err)
+	}
+
+	migrator, err := store.Migrator()
+	if err != nil {
+		log.Fatal("Error loading migrations: ", err)
+	}
+
+	switch fs.Arg(0) {
+	case "up":
+		if err := migrator.Up(); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Database is up to date")
+	case "down":
+		if err := migrator.Down(); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Rolled back the latest migration")
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+
 	seed := flag.Bool("seed", false, "seed the db")
 	createAdmin := flag.Bool("create-admin", false, "create an admin account")
 	firstName := flag.String("first_name", "", "first name for admin account")
 	lastName := flag.String("last_name", "", "last name for admin account")
 	password := flag.String("password", "", "password for admin account")
+	configFlags := BindConfigFlags(flag.CommandLine)
 	flag.Parse()
 
-	store, err := NewPostgressStore()
-
+	cfg, err := configFlags.Load()
 	if err != nil {
-		log.Fatal("Error initializing the db")
+		log.Fatal("Error loading config: ", err)
 	}
 
-	if err := store.Init(); err != nil {
-		log.Fatal("Error creating table ", err)
+	var store Storage
+	switch cfg.Store {
+	case "memory":
+		log.Println("Using the in-memory store, nothing will be persisted")
+		store = NewMemoryStore()
+	case "postgres":
+		pgStore, err := NewPostgressStore(cfg.Database)
+		if err != nil {
+			log.Fatal("Error initializing the db: ", err)
+		}
+
+		migrator, err := pgStore.Migrator()
+		if err != nil {
+			log.Fatal("Error loading migrations: ", err)
+		}
+
+		// refuse to serve against a schema this binary doesn't expect
+		if err := migrator.CheckCurrent(); err != nil {
+			log.Fatal(err)
+		}
+		store = pgStore
 	}
 
 	if *seed {
 		fmt.Println("Seeding the database")
-		seedAccounts(store)
+		seedAccounts(store, cfg.Password)
 	}
 
 	if *createAdmin {
@@ -61,11 +144,52 @@ func main() {
 			log.Fatal("insufficient fields")
 		}
 
-		createAdminAccount(store, *firstName, *lastName, *password)
+		createAdminAccount(store, cfg.Password, *firstName, *lastName, *password)
 		log.Println("Admin account created successfully")
 		return
 	}
 
-	server := NewApiServer(":3000", store)
+	rates := NewStaticRateProvider(nil)
+	if cfg.FX.RatesFile != "" {
+		rates, err = LoadRateFile(cfg.FX.RatesFile)
+		if err != nil {
+			log.Fatal("Error loading exchange rates: ", err)
+		}
+	}
+
+	server := NewApiServer(cfg.ListenAddr, store)
+	server.idempotencyTTL = time.Duration(cfg.IdempotencyTTL)
+	server.accessTokenTTL = time.Duration(cfg.Auth.AccessTokenTTL)
+	server.refreshTokenTTL = time.Duration(cfg.Auth.RefreshTokenTTL)
+	server.jwtIssuer = cfg.Auth.Issuer
+	server.jwtAudience = cfg.Auth.Audience
+	server.jwtLeeway = time.Duration(cfg.Auth.ClockSkew)
+	server.login = cfg.Login
+	server.stepUp = cfg.StepUp
+	server.passwords = cfg.Password
+	server.withdrawals = cfg.Withdrawal
+	if cfg.Auth.SigningKeyFile != "" {
+		server.keys, err = LoadKeySet(cfg.Auth.SigningKeyFile, cfg.Auth.VerificationKeyFiles)
+		if err != nil {
+			log.Fatal("Error loading jwt keys: ", err)
+		}
+	} else {
+		log.Println("No jwt signing key configured, signing tokens with JWT_SECRET")
+	}
+	// the derived key is only as secret as JWT_SECRET, which may be unset
+	// or unused, so it is never used for secrets that are persisted
+	switch {
+	case cfg.Auth.MFAKey != "":
+		key, _ := cfg.Auth.MFAKeyBytes()
+		server.mfaSecrets, err = NewSecretBox(key)
+		if err != nil {
+			log.Fatal("Error loading mfa key: ", err)
+		}
+	case cfg.Store == "memory":
+		log.Println("No mfa key configured, deriving one from JWT_SECRET")
+	default:
+		log.Fatal("An mfa key is required with the postgres store, set -mfa-key or GOBANK_MFA_KEY")
+	}
+	server.fx = NewFXService(rates, cfg.FX.SpreadBps, time.Duration(cfg.FX.QuoteTTL))
 	server.Run()
 }
@@ -0,0 +1,1266 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in process, handy for tests and local dev.
+// A single mutex guards all state so every method behaves like its own
+// transaction, errors match the ones PostgressStore returns.
+type MemoryStore struct {
+	mu              sync.Mutex
+	nextAccountId   int
+	nextEntryId     int
+	nextJournalId   int64
+	accounts        []*Account
+	ledger          []LedgerEntry
+	transfers       []*Transfer
+	idempotencyKeys map[string]*IdempotencyRecord
+	fxQuotes        map[string]*FXQuote
+	refreshTokens   map[string]*RefreshToken
+	revokedTokens   map[string]time.Time
+	loginAttempts   map[string]*LoginAttempts
+	mfaSecrets      map[int64]*MFASecret
+	passwordResets  map[string]*PasswordReset
+	roles           map[string]*Role
+	staffActions    []*StaffAction
+	auditLog        []*AuditEntry
+	// what is held for reversals, by the transfer being reversed
+	reversalHolds map[int64]uint64
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		idempotencyKeys: map[string]*IdempotencyRecord{},
+		fxQuotes:        map[string]*FXQuote{},
+		refreshTokens:   map[string]*RefreshToken{},
+		revokedTokens:   map[string]time.Time{},
+		loginAttempts:   map[string]*LoginAttempts{},
+		mfaSecrets:      map[int64]*MFASecret{},
+		passwordResets:  map[string]*PasswordReset{},
+		roles:           map[string]*Role{},
+		reversalHolds:   map[int64]uint64{},
+	}
+
+	for _, role := range defaultRoles() {
+		s.roles[role.Name] = role
+	}
+
+	return s
+}
+
+func (s *MemoryStore) CreateAccount(acc *Account, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// postgres has a foreign key for this
+	if _, ok := s.roles[acc.Role]; !ok {
+		return fmt.Errorf("role %q: %w", acc.Role, ErrRoleNotFound)
+	}
+
+	for attempt := 1; s.findAccount(acc.Number) != nil; attempt++ {
+		if attempt == maxAccountNumberAttempts {
+			return ErrAccountNumberTaken
+		}
+
+		number, err := generateAccountNumber()
+		if err != nil {
+			return err
+		}
+		acc.Number = number
+	}
+
+	if acc.Currency == "" {
+		acc.Currency = DefaultCurrency
+	}
+	if acc.Status == "" {
+		acc.Status = AccountActive
+	}
+	acc.Version = 1
+
+	s.nextAccountId++
+	acc.Id = s.nextAccountId
+
+	if acc.Balance > 0 {
+		opening := Money{Amount: acc.Balance, Currency: acc.Currency}
+		_, err := s.postJournal([]LedgerEntry{
+			{AccountNumber: openingBalanceAccountNumber, Direction: Debit, Money: opening},
+			{AccountNumber: acc.Number, Direction: Credit, Money: opening},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to book opening balance: %w", err)
+		}
+	}
+
+	stored := *acc
+	s.accounts = append(s.accounts, &stored)
+
+	if audit != nil {
+		audit.Target = accountTarget(acc.Number)
+		audit.After = snapshot(acc)
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateAccount(acc *Account, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := s.findAccount(acc.Number)
+	if stored == nil {
+		return fmt.Errorf("account number not found for number %d: %w", acc.Number, ErrAccountNotFound)
+	}
+	if stored.Version != acc.Version {
+		return fmt.Errorf("account %d is at version %d: %w", acc.Number, stored.Version, ErrVersionConflict)
+	}
+	if stored.Status == AccountClosed {
+		return fmt.Errorf("account %d: %w", acc.Number, ErrAccountClosed)
+	}
+	// postgres has a foreign key for this
+	if _, ok := s.roles[acc.Role]; !ok {
+		return fmt.Errorf("role %q: %w", acc.Role, ErrRoleNotFound)
+	}
+
+	before := *stored
+	stored.FirstName, stored.LastName, stored.Role, stored.Status = acc.FirstName, acc.LastName, acc.Role, acc.Status
+	stored.Version++
+	*acc = *stored
+
+	if audit != nil {
+		after := *stored
+		audit.Target = accountTarget(acc.Number)
+		audit.Before = snapshot(&before)
+		audit.After = snapshot(&after)
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetAccountStatus(number int64, status AccountStatus, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc := s.findAccount(number)
+	if acc == nil {
+		return fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+	}
+	if acc.Status == AccountClosed {
+		return fmt.Errorf("account %d: %w", number, ErrAccountClosed)
+	}
+
+	before := *acc
+	acc.Status = status
+	acc.Version++
+
+	if audit != nil {
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(&before)
+		audit.After = snapshot(acc)
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+func (s *MemoryStore) CloseAccount(number int64, payoutNumber int64, audit *AuditEntry) (*Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc := s.findAccount(number)
+	if acc == nil {
+		return nil, fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+	}
+	if acc.Status == AccountClosed {
+		return nil, fmt.Errorf("account %d: %w", number, ErrAccountClosed)
+	}
+
+	var payout *Account
+	if payoutNumber != 0 {
+		if payout = s.findAccount(payoutNumber); payout == nil {
+			return nil, fmt.Errorf("account %d: %w", payoutNumber, ErrInvalidPayoutAccount)
+		}
+	}
+
+	transfer, err := payoutTransfer(acc, payout)
+	if err != nil {
+		return nil, err
+	}
+
+	before := *acc
+	if transfer != nil {
+		journalId, err := s.postJournal(transferEntries(transfer))
+		if err != nil {
+			return nil, fmt.Errorf("payout failed: %w", err)
+		}
+		acc.Balance = s.ledgerBalance(acc.Number)
+		payout.Balance = s.ledgerBalance(payout.Number)
+
+		transfer.Id = journalId
+		transfer.Status = TransferCompleted
+		transfer.CreatedAt = time.Now().UTC()
+
+		stored := *transfer
+		s.transfers = append(s.transfers, &stored)
+	}
+
+	closedAt := time.Now().UTC()
+	acc.Status = AccountClosed
+	acc.ClosedAt = &closedAt
+	acc.Version++
+
+	for _, t := range s.refreshTokens {
+		if t.AccountNumber == number && t.RevokedAt == nil {
+			revokedAt := closedAt
+			t.RevokedAt = &revokedAt
+		}
+	}
+
+	if audit != nil {
+		after := *acc
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(closeSnapshot{Account: &before})
+		audit.After = snapshot(closeSnapshot{Account: &after, Payout: transfer})
+		s.appendAudit(audit)
+	}
+	return transfer, nil
+}
+
+func (s *MemoryStore) TransferMoney(transfer *Transfer, audit *AuditEntry) error {
+	_, err := s.transferMoney(transfer, false, nil, audit)
+	return err
+}
+
+func (s *MemoryStore) ReverseTransfer(reversal *Transfer, hold bool, action *StaffAction, audit *AuditEntry) (uint64, error) {
+	return s.transferMoney(reversal, hold, action, audit)
+}
+
+func (s *MemoryStore) transferMoney(transfer *Transfer, hold bool, action *StaffAction, audit *AuditEntry) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from := s.findAccount(transfer.FromNumber)
+	if from == nil {
+		return 0, fmt.Errorf("transfer failed: account number not found for number %d: %w", transfer.FromNumber, ErrAccountNotFound)
+	}
+
+	to := s.findAccount(transfer.ToNumber)
+	if to == nil {
+		return 0, fmt.Errorf("transfer failed: account number not found for number %d: %w", transfer.ToNumber, ErrAccountNotFound)
+	}
+
+	if err := checkTransferable(from.Status, to.Status); err != nil {
+		return 0, fmt.Errorf("transfer failed: %w", err)
+	}
+
+	if err := checkTransferCurrency(transfer, from.Currency, to.Currency); err != nil {
+		return 0, fmt.Errorf("transfer failed: %w", err)
+	}
+
+	booked := transfer
+	var original *Transfer
+	if transfer.ReversalOf != 0 {
+		original = s.findTransfer(transfer.ReversalOf)
+		if original == nil {
+			return 0, fmt.Errorf("transfer failed: transfer %d: %w", transfer.ReversalOf, ErrTransferNotFound)
+		}
+		if original.ReversalOf != 0 {
+			return 0, fmt.Errorf("transfer failed: transfer %d: %w", transfer.ReversalOf, ErrReversalReversed)
+		}
+		if err := checkReversalAmount(transfer, receivedAmount(original), s.reversedAmount(original.Id)); err != nil {
+			return 0, fmt.Errorf("transfer failed: %w", err)
+		}
+	}
+
+	// money held back for a reversal can only leave through that reversal
+	held := from.Held - s.reversalHolds[transfer.ReversalOf]
+
+	var shortfall uint64
+	available := from.Balance - min(from.Balance, held)
+	if available < transfer.Amount {
+		switch {
+		case (!hold || original == nil) && from.Balance < transfer.Amount:
+			return 0, fmt.Errorf("transfer failed: %w", ErrInsufficientFunds)
+		case !hold || original == nil:
+			return 0, fmt.Errorf("transfer failed: %w", ErrFundsHeld)
+		}
+		shortfall = transfer.Amount - available
+		booked = reversalOf(original, available)
+		if !bookable(booked) {
+			shortfall = transfer.Amount
+		}
+	}
+
+	var quote *FXQuote
+	if transfer.FX != nil && transfer.FX.QuoteId != "" {
+		quote = s.fxQuotes[transfer.FX.QuoteId]
+		if quote == nil {
+			return 0, fmt.Errorf("transfer failed: quote %s: %w", transfer.FX.QuoteId, ErrQuoteNotFound)
+		}
+		if quote.UsedAt != nil {
+			return 0, fmt.Errorf("transfer failed: quote %s: %w", transfer.FX.QuoteId, ErrQuoteUsed)
+		}
+	}
+
+	before := map[int64]uint64{from.Number: from.Balance, to.Number: to.Balance}
+	var recorded *Transfer
+	if bookable(booked) {
+		journalId, err := s.postJournal(transferEntries(booked))
+		if err != nil {
+			return 0, fmt.Errorf("transfer failed: %w", err)
+		}
+
+		if quote != nil {
+			usedAt := time.Now().UTC()
+			quote.UsedAt = &usedAt
+		}
+
+		from.Balance = s.ledgerBalance(from.Number)
+		to.Balance = s.ledgerBalance(to.Number)
+
+		booked.Id = journalId
+		booked.Status = TransferCompleted
+		booked.CreatedAt = time.Now().UTC()
+
+		stored := *booked
+		if booked.FX != nil {
+			fx := *booked.FX
+			stored.FX = &fx
+		}
+		s.transfers = append(s.transfers, &stored)
+
+		copied := stored
+		recorded = &copied
+	}
+
+	var stillHeld uint64
+	if original != nil {
+		stillHeld = nextHold(s.reversalHolds[original.Id], booked, shortfall, hold)
+		if stillHeld == 0 {
+			delete(s.reversalHolds, original.Id)
+		} else {
+			s.reversalHolds[original.Id] = stillHeld
+		}
+		from.Held = s.heldAmount(from.Number)
+	}
+
+	if action != nil {
+		s.recordStaffAction(action)
+	}
+
+	if audit != nil {
+		audit.Target = transferTarget(booked.Id)
+		if recorded == nil {
+			audit.Target = transferTarget(original.Id)
+		}
+		audit.Before = snapshot(transferSnapshot{Balances: before})
+		audit.After = snapshot(transferSnapshot{Transfer: recorded, Balances: map[int64]uint64{
+			from.Number: from.Balance,
+			to.Number:   to.Balance,
+		}, Held: stillHeld})
+		s.appendAudit(audit)
+	}
+
+	if booked != transfer {
+		*transfer = *booked
+	}
+	return shortfall, nil
+}
+
+func (s *MemoryStore) Deposit(transfer *Transfer, audit *AuditEntry) error {
+	return s.moveCash(transfer, transfer.ToNumber, 0, audit)
+}
+
+func (s *MemoryStore) Withdraw(transfer *Transfer, dailyLimit uint64, audit *AuditEntry) error {
+	return s.moveCash(transfer, transfer.FromNumber, dailyLimit, audit)
+}
+
+func (s *MemoryStore) moveCash(transfer *Transfer, number int64, dailyLimit uint64, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc := s.findAccount(number)
+	if acc == nil {
+		return fmt.Errorf("cash movement failed: account number not found for number %d: %w", number, ErrAccountNotFound)
+	}
+	if err := checkTransferable(acc.Status, AccountActive); err != nil {
+		return fmt.Errorf("cash movement failed: %w", err)
+	}
+	if acc.Currency != transfer.Currency {
+		return fmt.Errorf("cash movement failed: account holds %s: %w", acc.Currency, ErrCurrencyMismatch)
+	}
+
+	if transfer.FromNumber == number {
+		if acc.Balance < transfer.Amount {
+			return fmt.Errorf("cash movement failed: %w", ErrInsufficientFunds)
+		}
+		if transfer.Amount+acc.Held > acc.Balance {
+			return fmt.Errorf("cash movement failed: %w", ErrFundsHeld)
+		}
+
+		if dailyLimit > 0 {
+			since := time.Now().UTC().Add(-withdrawalLimitWindow)
+			var withdrawn uint64
+			for _, t := range s.transfers {
+				if t.FromNumber == number && t.ToNumber == cashAccountNumber && !t.CreatedAt.Before(since) {
+					withdrawn += t.Amount
+				}
+			}
+			if withdrawn+transfer.Amount > dailyLimit {
+				return fmt.Errorf("cash movement failed: %w", ErrWithdrawalLimit)
+			}
+		}
+	}
+
+	journalId, err := s.postJournal(transferEntries(transfer))
+	if err != nil {
+		return fmt.Errorf("cash movement failed: %w", err)
+	}
+
+	before := acc.Balance
+	acc.Balance = s.ledgerBalance(number)
+
+	transfer.Id = journalId
+	transfer.Status = TransferCompleted
+	transfer.CreatedAt = time.Now().UTC()
+
+	stored := *transfer
+	s.transfers = append(s.transfers, &stored)
+
+	if audit != nil {
+		recorded := stored
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(transferSnapshot{Balances: map[int64]uint64{number: before}})
+		audit.After = snapshot(transferSnapshot{Transfer: &recorded, Balances: map[int64]uint64{number: acc.Balance}})
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetAccountById(id int) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, acc := range s.accounts {
+		if acc.Id == id {
+			found := *acc
+			return &found, nil
+		}
+	}
+
+	return nil, fmt.Errorf("account not found for id %d: %w", id, ErrAccountNotFound)
+}
+
+func (s *MemoryStore) GetAccountByNumber(number int64) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc := s.findAccount(number)
+	if acc == nil {
+		return nil, fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+	}
+
+	found := *acc
+	return &found, nil
+}
+
+func (s *MemoryStore) GetAccounts(filter AccountFilter) ([]*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accounts := []*Account{}
+	for _, acc := range s.accounts {
+		if filter.matches(acc) {
+			found := *acc
+			accounts = append(accounts, &found)
+		}
+	}
+
+	slices.SortFunc(accounts, func(a, b *Account) int {
+		if filter.Descending {
+			return compareAccounts(b, a, filter.Sort)
+		}
+		return compareAccounts(a, b, filter.Sort)
+	})
+
+	if filter.Limit > 0 && len(accounts) > filter.Limit {
+		accounts = accounts[:filter.Limit]
+	}
+
+	return accounts, nil
+}
+
+func (s *MemoryStore) RecomputeBalance(number int64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc := s.findAccount(number)
+	if acc == nil {
+		return 0, fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+	}
+
+	acc.Balance = s.ledgerBalance(number)
+	return acc.Balance, nil
+}
+
+func (s *MemoryStore) GetTransfers(filter TransferFilter) ([]*Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transfers := []*Transfer{}
+	for i := len(s.transfers) - 1; i >= 0; i-- {
+		t := s.transfers[i]
+
+		switch filter.Direction {
+		case DirectionIncoming:
+			if t.ToNumber != filter.AccountNumber {
+				continue
+			}
+		case DirectionOutgoing:
+			if t.FromNumber != filter.AccountNumber {
+				continue
+			}
+		default:
+			if t.FromNumber != filter.AccountNumber && t.ToNumber != filter.AccountNumber {
+				continue
+			}
+		}
+
+		if !filter.From.IsZero() && t.CreatedAt.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !t.CreatedAt.Before(filter.To) {
+			continue
+		}
+		if filter.BeforeId > 0 && t.Id >= filter.BeforeId {
+			continue
+		}
+
+		found := *t
+		found.Reversed = s.reversedAmount(t.Id)
+		transfers = append(transfers, &found)
+		if filter.Limit > 0 && len(transfers) == filter.Limit {
+			break
+		}
+	}
+
+	return transfers, nil
+}
+
+func (s *MemoryStore) GetTransfer(id int64) (*Transfer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.findTransfer(id)
+	if t == nil {
+		return nil, fmt.Errorf("transfer %d: %w", id, ErrTransferNotFound)
+	}
+
+	found := *t
+	found.Reversed = s.reversedAmount(id)
+	return &found, nil
+}
+
+// callers must hold s.mu
+func (s *MemoryStore) reversedAmount(id int64) uint64 {
+	var reversed uint64
+	for _, t := range s.transfers {
+		if t.ReversalOf == id {
+			reversed += t.Amount
+		}
+	}
+
+	return reversed
+}
+
+func (s *MemoryStore) heldAmount(number int64) uint64 {
+	var held uint64
+	for id, amount := range s.reversalHolds {
+		if t := s.findTransfer(id); t != nil && t.ToNumber == number {
+			held += amount
+		}
+	}
+
+	return held
+}
+
+func (s *MemoryStore) RecordStaffAction(action *StaffAction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recordStaffAction(action)
+	return nil
+}
+
+// callers must hold s.mu
+func (s *MemoryStore) recordStaffAction(action *StaffAction) {
+	action.Id = int64(len(s.staffActions) + 1)
+	stored := *action
+	s.staffActions = append(s.staffActions, &stored)
+}
+
+func (s *MemoryStore) GetAuditLog(filter AuditFilter) ([]*AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := []*AuditEntry{}
+	for i := len(s.auditLog) - 1; i >= 0; i-- {
+		e := s.auditLog[i]
+
+		if filter.ActorNumber != 0 && e.ActorNumber != filter.ActorNumber {
+			continue
+		}
+		if filter.Action != "" && e.Action != filter.Action {
+			continue
+		}
+		if filter.Target != "" && e.Target != filter.Target {
+			continue
+		}
+		if !filter.From.IsZero() && e.CreatedAt.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !e.CreatedAt.Before(filter.To) {
+			continue
+		}
+		if filter.BeforeId > 0 && e.Id >= filter.BeforeId {
+			continue
+		}
+
+		found := *e
+		entries = append(entries, &found)
+		if filter.Limit > 0 && len(entries) == filter.Limit {
+			break
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *MemoryStore) ReserveIdempotencyKey(rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.idempotencyKeys[rec.Key]; ok && existing.ExpiresAt.After(rec.CreatedAt) {
+		found := *existing
+		return &found, nil
+	}
+
+	stored := *rec
+	stored.StatusCode = 0
+	stored.ResponseBody = nil
+	s.idempotencyKeys[rec.Key] = &stored
+	return nil, nil
+}
+
+func (s *MemoryStore) CompleteIdempotencyKey(rec *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.idempotencyKeys[rec.Key]; ok {
+		existing.StatusCode = rec.StatusCode
+		existing.ResponseBody = append([]byte(nil), rec.ResponseBody...)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) ReleaseIdempotencyKey(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotencyKeys, key)
+	return nil
+}
+
+func (s *MemoryStore) PurgeIdempotencyKeys(now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int64
+	for key, rec := range s.idempotencyKeys {
+		if !rec.ExpiresAt.After(now) {
+			delete(s.idempotencyKeys, key)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+func (s *MemoryStore) CreateFXQuote(q *FXQuote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *q
+	s.fxQuotes[q.Id] = &stored
+	return nil
+}
+
+func (s *MemoryStore) GetFXQuote(id string) (*FXQuote, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.fxQuotes[id]
+	if !ok {
+		return nil, fmt.Errorf("quote %s: %w", id, ErrQuoteNotFound)
+	}
+
+	found := *q
+	return &found, nil
+}
+
+func (s *MemoryStore) CreateRefreshToken(t *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *t
+	s.refreshTokens[t.TokenHash] = &stored
+	return nil
+}
+
+func (s *MemoryStore) RotateRefreshToken(tokenHash string, next *RefreshToken) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.refreshTokens[tokenHash]
+	if !ok {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	now := time.Now().UTC()
+	if current.RevokedAt != nil {
+		s.revokeRefreshFamily(current.FamilyId, now)
+		return nil, ErrRefreshTokenReused
+	}
+
+	if !now.Before(current.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	current.RevokedAt = &now
+	next.FamilyId = current.FamilyId
+	next.AccountNumber = current.AccountNumber
+	next.AuthMethods = current.AuthMethods
+
+	stored := *next
+	s.refreshTokens[next.TokenHash] = &stored
+
+	found := *current
+	return &found, nil
+}
+
+func (s *MemoryStore) RevokeRefreshToken(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.refreshTokens[tokenHash]
+	if !ok {
+		return ErrInvalidRefreshToken
+	}
+
+	s.revokeRefreshFamily(current.FamilyId, time.Now().UTC())
+	return nil
+}
+
+func (s *MemoryStore) RevokeToken(jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokedTokens[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryStore) ConsumeToken(jti string, expiresAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, used := s.revokedTokens[jti]; used {
+		return false, nil
+	}
+
+	s.revokedTokens[jti] = expiresAt
+	return true, nil
+}
+
+func (s *MemoryStore) IsTokenRevoked(jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, revoked := s.revokedTokens[jti]
+	return revoked, nil
+}
+
+func (s *MemoryStore) PurgeExpiredTokens(now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int64
+	for hash, t := range s.refreshTokens {
+		if !t.ExpiresAt.After(now) {
+			delete(s.refreshTokens, hash)
+			purged++
+		}
+	}
+	for jti, expiresAt := range s.revokedTokens {
+		if !expiresAt.After(now) {
+			delete(s.revokedTokens, jti)
+			purged++
+		}
+	}
+	for hash, reset := range s.passwordResets {
+		if !reset.ExpiresAt.After(now) {
+			delete(s.passwordResets, hash)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+func (s *MemoryStore) GetLoginAttempts(key string) (*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts, ok := s.loginAttempts[key]
+	if !ok {
+		return &LoginAttempts{Key: key}, nil
+	}
+
+	found := *attempts
+	return &found, nil
+}
+
+func (s *MemoryStore) RecordLoginFailure(key string, at time.Time, since time.Time) (*LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts, ok := s.loginAttempts[key]
+	if !ok || attempts.LastFailureAt.Before(since) {
+		attempts = &LoginAttempts{Key: key}
+		s.loginAttempts[key] = attempts
+	}
+
+	attempts.Failures++
+	attempts.LastFailureAt = at
+
+	found := *attempts
+	return &found, nil
+}
+
+func (s *MemoryStore) ResetLoginAttempts(key string, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var failures int
+	if attempts, ok := s.loginAttempts[key]; ok {
+		failures = attempts.Failures
+	}
+	delete(s.loginAttempts, key)
+
+	if audit != nil {
+		audit.Target = key
+		audit.Before = snapshot(loginAttemptsSnapshot{Failures: failures})
+		audit.After = snapshot(loginAttemptsSnapshot{})
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+func (s *MemoryStore) PurgeLoginAttempts(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int64
+	for key, attempts := range s.loginAttempts {
+		if attempts.LastFailureAt.Before(before) {
+			delete(s.loginAttempts, key)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+func (s *MemoryStore) SaveMFASecret(m *MFASecret, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var before mfaSnapshot
+	if existing, ok := s.mfaSecrets[m.AccountNumber]; ok {
+		if existing.EnabledAt != nil {
+			return ErrMFAAlreadyEnabled
+		}
+		enrolledAt := existing.CreatedAt
+		before.EnrolledAt = &enrolledAt
+	}
+
+	stored := *m
+	stored.EnabledAt = nil
+	stored.LastUsedStep = 0
+	s.mfaSecrets[m.AccountNumber] = &stored
+
+	if audit != nil {
+		audit.Target = accountTarget(m.AccountNumber)
+		audit.Before = snapshot(before)
+		audit.After = snapshot(mfaSnapshot{EnrolledAt: &stored.CreatedAt})
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetMFASecret(number int64) (*MFASecret, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.mfaSecrets[number]
+	if !ok {
+		return nil, fmt.Errorf("mfa for account %d: %w", number, ErrMFANotEnrolled)
+	}
+
+	found := *m
+	return &found, nil
+}
+
+func (s *MemoryStore) EnableMFA(number int64, step int64, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.mfaSecrets[number]
+	if !ok {
+		return fmt.Errorf("mfa for account %d: %w", number, ErrMFANotEnrolled)
+	}
+	if m.EnabledAt != nil {
+		return ErrMFAAlreadyEnabled
+	}
+
+	now := time.Now().UTC()
+	m.EnabledAt = &now
+	m.LastUsedStep = step
+
+	if audit != nil {
+		enrolledAt := m.CreatedAt
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(mfaSnapshot{EnrolledAt: &enrolledAt})
+		audit.After = snapshot(mfaSnapshot{EnrolledAt: &enrolledAt, EnabledAt: &now})
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+func (s *MemoryStore) UseMFAStep(number int64, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.mfaSecrets[number]
+	if !ok || m.LastUsedStep >= step {
+		return ErrMFACodeReused
+	}
+
+	m.LastUsedStep = step
+	return nil
+}
+
+func (s *MemoryStore) SetPassword(number int64, hash string, changedAt time.Time, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc := s.findAccount(number)
+	if acc == nil {
+		return fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+	}
+	before := passwordSnapshot{PasswordChangedAt: acc.PasswordChangedAt}
+
+	if err := s.setPassword(number, hash, changedAt); err != nil {
+		return err
+	}
+
+	if audit != nil {
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(before)
+		audit.After = snapshot(passwordSnapshot{PasswordChangedAt: &changedAt})
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+// callers must hold s.mu
+func (s *MemoryStore) setPassword(number int64, hash string, changedAt time.Time) error {
+	acc := s.findAccount(number)
+	if acc == nil {
+		return fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+	}
+
+	acc.EncryptedPassword = hash
+	acc.PasswordChangedAt = &changedAt
+	for _, t := range s.refreshTokens {
+		if t.AccountNumber == number && t.RevokedAt == nil {
+			t.RevokedAt = &changedAt
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) RehashPassword(number int64, oldHash string, newHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if acc := s.findAccount(number); acc != nil && acc.EncryptedPassword == oldHash {
+		acc.EncryptedPassword = newHash
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) CreatePasswordReset(reset *PasswordReset, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pending int64
+	for hash, existing := range s.passwordResets {
+		if existing.AccountNumber == reset.AccountNumber && existing.UsedAt == nil {
+			delete(s.passwordResets, hash)
+			pending++
+		}
+	}
+
+	stored := *reset
+	s.passwordResets[reset.TokenHash] = &stored
+
+	if audit != nil {
+		audit.Target = accountTarget(reset.AccountNumber)
+		audit.Before = snapshot(resetTokenSnapshot{Pending: pending})
+		audit.After = snapshot(resetTokenSnapshot{Pending: 1, ExpiresAt: &stored.ExpiresAt})
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+func (s *MemoryStore) ResetPassword(tokenHash string, hash string, now time.Time, audit *AuditEntry) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reset, ok := s.passwordResets[tokenHash]
+	if !ok || reset.UsedAt != nil || !now.Before(reset.ExpiresAt) {
+		return 0, ErrInvalidResetToken
+	}
+
+	acc := s.findAccount(reset.AccountNumber)
+	if acc == nil {
+		return 0, fmt.Errorf("account number not found for number %d: %w", reset.AccountNumber, ErrAccountNotFound)
+	}
+	before := passwordSnapshot{PasswordChangedAt: acc.PasswordChangedAt}
+
+	if err := s.setPassword(reset.AccountNumber, hash, now); err != nil {
+		return 0, err
+	}
+
+	reset.UsedAt = &now
+
+	if audit != nil {
+		if audit.ActorNumber == 0 {
+			audit.ActorNumber, audit.ActorRole = acc.Number, acc.Role
+		}
+		audit.Target = accountTarget(acc.Number)
+		audit.Before = snapshot(before)
+		audit.After = snapshot(passwordSnapshot{PasswordChangedAt: &now, ResetBy: reset.CreatedBy})
+		s.appendAudit(audit)
+	}
+	return reset.AccountNumber, nil
+}
+
+func (s *MemoryStore) GetRole(name string) (*Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	role, ok := s.roles[name]
+	if !ok {
+		return nil, fmt.Errorf("role %q: %w", name, ErrRoleNotFound)
+	}
+
+	return copyRole(role), nil
+}
+
+func (s *MemoryStore) GetRoles() ([]*Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	roles := []*Role{}
+	for _, role := range s.roles {
+		roles = append(roles, copyRole(role))
+	}
+
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Name < roles[j].Name
+	})
+
+	return roles, nil
+}
+
+func (s *MemoryStore) SaveRole(role *Role, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := copyRole(role)
+	stored.Builtin = false
+	existing, ok := s.roles[role.Name]
+	if ok {
+		stored.Builtin = existing.Builtin
+	}
+
+	s.roles[role.Name] = stored
+
+	if audit != nil {
+		audit.Target = roleTarget(role.Name)
+		if ok {
+			audit.Before = snapshot(copyRole(existing))
+		}
+		audit.After = snapshot(copyRole(stored))
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteRole(name string, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.roles[name]
+	if !ok {
+		return fmt.Errorf("role %q: %w", name, ErrRoleNotFound)
+	}
+
+	for _, acc := range s.accounts {
+		if acc.Role == name {
+			return fmt.Errorf("role %q: %w", name, ErrRoleInUse)
+		}
+	}
+
+	delete(s.roles, name)
+
+	if audit != nil {
+		audit.Target = roleTarget(name)
+		audit.Before = snapshot(copyRole(existing))
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetAccountRole(number int64, role string, audit *AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[role]; !ok {
+		return fmt.Errorf("role %q: %w", role, ErrRoleNotFound)
+	}
+
+	acc := s.findAccount(number)
+	if acc == nil {
+		return fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+	}
+
+	before := *acc
+	acc.Role = role
+	acc.Version++
+
+	if audit != nil {
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(&before)
+		audit.After = snapshot(acc)
+		s.appendAudit(audit)
+	}
+	return nil
+}
+
+// permissions are sorted like the postgres store returns them
+func copyRole(role *Role) *Role {
+	c := *role
+	c.Permissions = slices.Clone(role.Permissions)
+	slices.Sort(c.Permissions)
+	return &c
+}
+
+// callers must hold s.mu
+func (s *MemoryStore) revokeRefreshFamily(familyId string, now time.Time) {
+	for _, t := range s.refreshTokens {
+		if t.FamilyId == familyId && t.RevokedAt == nil {
+			revokedAt := now
+			t.RevokedAt = &revokedAt
+		}
+	}
+}
+
+// callers must hold s.mu
+func (s *MemoryStore) appendAudit(entry *AuditEntry) {
+	var prevHash string
+	if len(s.auditLog) > 0 {
+		prevHash = s.auditLog[len(s.auditLog)-1].Hash
+	}
+
+	entry.seal(prevHash)
+	entry.Id = int64(len(s.auditLog) + 1)
+	stored := *entry
+	s.auditLog = append(s.auditLog, &stored)
+}
+
+// callers must hold s.mu
+func (s *MemoryStore) findTransfer(id int64) *Transfer {
+	for _, t := range s.transfers {
+		if t.Id == id {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// callers must hold s.mu
+func (s *MemoryStore) findAccount(number int64) *Account {
+	for _, acc := range s.accounts {
+		if acc.Number == number {
+			return acc
+		}
+	}
+
+	return nil
+}
+
+// callers must hold s.mu
+func (s *MemoryStore) postJournal(entries []LedgerEntry) (int64, error) {
+	if err := validateJournal(entries); err != nil {
+		return 0, err
+	}
+
+	s.nextJournalId++
+	now := time.Now().UTC()
+	for _, e := range entries {
+		s.nextEntryId++
+		e.Id = s.nextEntryId
+		e.JournalId = s.nextJournalId
+		e.CreatedAt = now
+		s.ledger = append(s.ledger, e)
+	}
+
+	return s.nextJournalId, nil
+}
+
+// callers must hold s.mu
+func (s *MemoryStore) ledgerBalance(number int64) uint64 {
+	var credits, debits uint64
+	for _, e := range s.ledger {
+		if e.AccountNumber != number {
+			continue
+		}
+
+		if e.Direction == Credit {
+			credits += e.Amount
+		} else {
+			debits += e.Amount
+		}
+	}
+
+	return credits - debits
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrMFANotEnrolled      = errors.New("mfa not enrolled")
+	ErrMFAAlreadyEnabled   = errors.New("mfa already enabled")
+	ErrMFACodeReused       = errors.New("mfa code already used")
+	errInvalidMFAChallenge = errors.New("invalid mfa challenge")
+)
+
+// values for the amr claim, RFC 8176
+const (
+	authMethodPassword = "pwd"
+	authMethodOTP      = "otp"
+)
+
+const (
+	mfaChallengeTTL      = 5 * time.Minute
+	mfaChallengeAudience = "gobank-mfa"
+)
+
+// for tests and the memory store only, the key is derived from JWT_SECRET
+// and main refuses to use it with postgres
+func devSecretBox() *SecretBox {
+	key := sha256.Sum256([]byte("gobank-mfa:" + os.Getenv("JWT_SECRET")))
+	box, _ := NewSecretBox(key[:])
+	return box
+}
+
+func hasAuthMethod(methods []string, method string) bool {
+	return slices.Contains(methods, method)
+}
+
+// a password only login of an account with mfa gets a challenge instead of
+// tokens, it can only be traded in at /login/mfa
+func (s *ApiServer) createMFAChallenge(acc *Account) (*MFAChallengeResponse, error) {
+	tokenId, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(mfaChallengeTTL)
+	token, err := s.keys.sign(&TokenClaims{
+		Role:        acc.Role,
+		AuthMethods: []string{authMethodPassword},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.jwtIssuer,
+			Subject:   strconv.FormatInt(acc.Number, 10),
+			Audience:  jwt.ClaimStrings{mfaChallengeAudience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        tokenId,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &MFAChallengeResponse{
+		MFARequired:    true,
+		ChallengeToken: token,
+		ExpiresAt:      expiresAt.UTC(),
+	}, nil
+}
+
+// second step of the login, exchanges a challenge and a code for tokens
+func (s *ApiServer) handleMFALogin(w http.ResponseWriter, r *http.Request) error {
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
+
+	claims, err := s.parseJwt(req.ChallengeToken, mfaChallengeAudience)
+	if err != nil {
+		return WriteJson(w, http.StatusUnauthorized, ApiError{Error: "invalid mfa challenge"})
+	}
+
+	number, err := claims.AccountNumber()
+	if err != nil {
+		return WriteJson(w, http.StatusUnauthorized, ApiError{Error: "invalid mfa challenge"})
+	}
+
+	// wrong codes count as failed logins, guessing a code is throttled the
+	// same way as guessing a password
+	ip := clientIP(r)
+	now := time.Now().UTC()
+	wait, err := s.loginBlocked(number, ip, now)
+	if err != nil {
+		fmt.Println("Error checking login attempts")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+	if wait > 0 {
+		return writeTooManyAttempts(w, wait)
+	}
+
+	revoked, err := s.store.IsTokenRevoked(claims.ID)
+	if err != nil || revoked {
+		return WriteJson(w, http.StatusUnauthorized, ApiError{Error: "invalid mfa challenge"})
+	}
+
+	// the account may have been closed since the password was checked
+	acc, err := s.store.GetAccountByNumber(number)
+	if err != nil || acc.Status == AccountClosed {
+		return WriteJson(w, http.StatusUnauthorized, ApiError{Error: "invalid mfa challenge"})
+	}
+
+	if err := s.checkTOTP(number, req.Code, now); err != nil {
+		if errors.Is(err, errInvalidMFAChallenge) {
+			s.recordLoginFailure(number, ip, now)
+			return WriteJson(w, http.StatusUnauthorized, ApiError{Error: "invalid code"})
+		}
+		fmt.Println("Error verifying mfa code")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	// a challenge is good for one login
+	if err := s.store.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		fmt.Println("Error revoking mfa challenge")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	if err := s.store.ResetLoginAttempts(accountLoginKey(number), nil); err != nil {
+		fmt.Println("Error resetting login attempts")
+	}
+
+	resp, err := s.issueTokens(acc, []string{authMethodPassword, authMethodOTP})
+	if err != nil {
+		fmt.Println("Error creating tokens")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, resp)
+}
+
+// checks a code against the enabled secret of an account and burns its step
+func (s *ApiServer) checkTOTP(number int64, code string, now time.Time) error {
+	mfa, err := s.store.GetMFASecret(number)
+	if errors.Is(err, ErrMFANotEnrolled) {
+		return errInvalidMFAChallenge
+	}
+	if err != nil {
+		return err
+	}
+	if mfa.EnabledAt == nil {
+		return errInvalidMFAChallenge
+	}
+
+	secret, err := s.mfaSecrets.Open(mfa.EncryptedSecret)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt mfa secret: %w", err)
+	}
+
+	step, ok := verifyTOTP(secret, code, now, mfa.LastUsedStep)
+	if !ok {
+		return errInvalidMFAChallenge
+	}
+
+	// two requests racing with the same code, only one gets the step
+	if err := s.store.UseMFAStep(number, step); err != nil {
+		if errors.Is(err, ErrMFACodeReused) {
+			return errInvalidMFAChallenge
+		}
+		return err
+	}
+
+	return nil
+}
+
+// starts enrollment with a new secret, it only protects logins once a code
+// from it has been verified
+func (s *ApiServer) handleMFAEnroll(w http.ResponseWriter, r *http.Request) error {
+	number, _ := r.Context().Value("authorizedAccountNumber").(int64)
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		fmt.Println("Error generating mfa secret")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	sealed, err := s.mfaSecrets.Seal(secret)
+	if err != nil {
+		fmt.Println("Error encrypting mfa secret")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	err = s.store.SaveMFASecret(&MFASecret{
+		AccountNumber:   number,
+		EncryptedSecret: sealed,
+		CreatedAt:       time.Now().UTC(),
+	}, s.auditEntry(r, auditMFAEnroll))
+	if err != nil {
+		if errors.Is(err, ErrMFAAlreadyEnabled) {
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "mfa is already enabled"})
+		}
+		fmt.Println("Error storing mfa secret")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, MFAEnrollResponse{
+		Secret: totpEncoding.EncodeToString(secret),
+		URI:    otpauthURI(s.jwtIssuer, strconv.FormatInt(number, 10), secret),
+	})
+}
+
+// confirms enrollment with a first code and hands out tokens that carry the
+// otp factor, so admins can carry on without logging in again
+func (s *ApiServer) handleMFAVerify(w http.ResponseWriter, r *http.Request) error {
+	number, _ := r.Context().Value("authorizedAccountNumber").(int64)
+
+	var req MFAVerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
+
+	mfa, err := s.store.GetMFASecret(number)
+	if errors.Is(err, ErrMFANotEnrolled) {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "mfa enrollment has not been started"})
+	}
+	if err != nil {
+		fmt.Println("Error retrieving mfa secret")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+	if mfa.EnabledAt != nil {
+		return WriteJson(w, http.StatusConflict, ApiError{Error: "mfa is already enabled"})
+	}
+
+	secret, err := s.mfaSecrets.Open(mfa.EncryptedSecret)
+	if err != nil {
+		fmt.Println("Error decrypting mfa secret")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	step, ok := verifyTOTP(secret, req.Code, time.Now(), mfa.LastUsedStep)
+	if !ok {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid code"})
+	}
+
+	if err := s.store.EnableMFA(number, step, s.auditEntry(r, auditMFAEnable)); err != nil {
+		fmt.Println("Error enabling mfa")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	acc, err := s.store.GetAccountByNumber(number)
+	if err != nil {
+		fmt.Println("Error retrieving account")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	resp, err := s.issueTokens(acc, []string{authMethodPassword, authMethodOTP})
+	if err != nil {
+		fmt.Println("Error creating tokens")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, resp)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down)
+	}
+}
+
+func TestLoadMigrationsRejectsBadSets(t *testing.T) {
+	missingDown := fstest.MapFS{
+		"m/0001_init.up.sql": {Data: []byte("SELECT 1;")},
+	}
+	_, err := loadMigrations(missingDown, "m")
+	assert.Error(t, err)
+
+	gap := fstest.MapFS{
+		"m/0001_init.up.sql":    {Data: []byte("SELECT 1;")},
+		"m/0001_init.down.sql":  {Data: []byte("SELECT 1;")},
+		"m/0003_later.up.sql":   {Data: []byte("SELECT 1;")},
+		"m/0003_later.down.sql": {Data: []byte("SELECT 1;")},
+	}
+	_, err = loadMigrations(gap, "m")
+	assert.Error(t, err)
+
+	badName := fstest.MapFS{
+		"m/init.sql": {Data: []byte("SELECT 1;")},
+	}
+	_, err = loadMigrations(badName, "m")
+	assert.Error(t, err)
+}
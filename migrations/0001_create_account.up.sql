@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS account (
+    id SERIAL PRIMARY KEY,
+    first_name VARCHAR(50),
+    last_name VARCHAR(50),
+    number BIGINT,
+    encrypted_password VARCHAR(100),
+    balance BIGINT,
+    role VARCHAR(100),
+    created_at timestamp DEFAULT NOW()
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS ledger_entry;
+DROP SEQUENCE IF EXISTS ledger_journal_seq;
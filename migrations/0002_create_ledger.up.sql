@@ -0,0 +1,25 @@
+CREATE SEQUENCE IF NOT EXISTS ledger_journal_seq;
+
+CREATE TABLE IF NOT EXISTS ledger_entry (
+    id SERIAL PRIMARY KEY,
+    journal_id BIGINT NOT NULL,
+    account_number BIGINT NOT NULL,
+    direction VARCHAR(6) NOT NULL CHECK (direction IN ('debit', 'credit')),
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    created_at timestamp DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entry_account_number_idx ON ledger_entry (account_number);
+
+-- accounts created before the ledger existed get an opening journal so
+-- recomputing their balance doesn't wipe it out
+WITH opening AS (
+    SELECT a.number, a.balance, nextval('ledger_journal_seq') AS journal_id
+    FROM account a
+    WHERE a.balance > 0
+    AND NOT EXISTS (SELECT 1 FROM ledger_entry e WHERE e.account_number = a.number)
+)
+INSERT INTO ledger_entry (journal_id, account_number, direction, amount)
+SELECT journal_id, number, 'credit', balance FROM opening
+UNION ALL
+SELECT journal_id, -1, 'debit', balance FROM opening;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS transfer (
+    id BIGINT PRIMARY KEY,
+    from_number BIGINT NOT NULL,
+    to_number BIGINT NOT NULL,
+    amount BIGINT NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    created_at timestamp DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS transfer_from_number_idx ON transfer (from_number, id);
+CREATE INDEX IF NOT EXISTS transfer_to_number_idx ON transfer (to_number, id);
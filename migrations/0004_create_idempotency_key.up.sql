@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS idempotency_key (
+    key VARCHAR(300) PRIMARY KEY,
+    request_hash CHAR(64) NOT NULL,
+    status_code INT NOT NULL DEFAULT 0,
+    response_body BYTEA NOT NULL DEFAULT '',
+    created_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL
+);
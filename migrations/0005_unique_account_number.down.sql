@@ -0,0 +1 @@
+DROP INDEX IF EXISTS account_number_key;
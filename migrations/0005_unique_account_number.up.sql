@@ -0,0 +1,3 @@
+-- fails if the table already holds duplicate numbers, those have to be
+-- renumbered by hand first since GetAccountByNumber can't tell them apart
+CREATE UNIQUE INDEX IF NOT EXISTS account_number_key ON account (number);
@@ -0,0 +1,5 @@
+ALTER TABLE transfer DROP COLUMN IF EXISTS fx_quote_id;
+ALTER TABLE transfer DROP COLUMN IF EXISTS converted_currency;
+ALTER TABLE transfer DROP COLUMN IF EXISTS converted_amount;
+ALTER TABLE transfer DROP COLUMN IF EXISTS fx_rate;
+DROP TABLE IF EXISTS fx_quote;
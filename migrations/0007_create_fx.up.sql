@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS fx_quote (
+    id VARCHAR(64) PRIMARY KEY,
+    from_number BIGINT NOT NULL,
+    to_number BIGINT NOT NULL,
+    amount BIGINT NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    rate BIGINT NOT NULL,
+    converted_amount BIGINT NOT NULL,
+    converted_currency VARCHAR(3) NOT NULL,
+    created_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL,
+    used_at timestamp
+);
+
+-- only set for cross-currency transfers, rate is in billionths
+ALTER TABLE transfer ADD COLUMN IF NOT EXISTS fx_rate BIGINT;
+ALTER TABLE transfer ADD COLUMN IF NOT EXISTS converted_amount BIGINT;
+ALTER TABLE transfer ADD COLUMN IF NOT EXISTS converted_currency VARCHAR(3);
+ALTER TABLE transfer ADD COLUMN IF NOT EXISTS fx_quote_id VARCHAR(64);
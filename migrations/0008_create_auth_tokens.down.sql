@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS revoked_token;
+DROP INDEX IF EXISTS refresh_token_family_idx;
+DROP TABLE IF EXISTS refresh_token;
@@ -0,0 +1,18 @@
+-- only a hash of the refresh token is stored, tokens rotated from the same
+-- login share a family so a reused token can revoke all of them
+CREATE TABLE IF NOT EXISTS refresh_token (
+    token_hash CHAR(64) PRIMARY KEY,
+    family_id VARCHAR(64) NOT NULL,
+    account_number BIGINT NOT NULL,
+    created_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL,
+    revoked_at timestamp
+);
+
+CREATE INDEX IF NOT EXISTS refresh_token_family_idx ON refresh_token (family_id);
+
+-- access tokens revoked before they expired, kept until they would have
+CREATE TABLE IF NOT EXISTS revoked_token (
+    jti VARCHAR(64) PRIMARY KEY,
+    expires_at timestamp NOT NULL
+);
@@ -0,0 +1,6 @@
+-- failed logins per account ("account:<number>") and per client ip ("ip:<addr>")
+CREATE TABLE IF NOT EXISTS login_attempt (
+    key VARCHAR(100) PRIMARY KEY,
+    failures INT NOT NULL,
+    last_failure_at timestamp NOT NULL
+);
@@ -0,0 +1,2 @@
+ALTER TABLE refresh_token DROP COLUMN IF EXISTS auth_methods;
+DROP TABLE IF EXISTS account_mfa;
@@ -0,0 +1,12 @@
+-- the secret is encrypted by the application, last_used_step stops a code
+-- from being used twice
+CREATE TABLE IF NOT EXISTS account_mfa (
+    account_number BIGINT PRIMARY KEY,
+    encrypted_secret BYTEA NOT NULL,
+    created_at timestamp NOT NULL,
+    enabled_at timestamp,
+    last_used_step BIGINT NOT NULL DEFAULT 0
+);
+
+-- the amr of the login a refresh token family came from
+ALTER TABLE refresh_token ADD COLUMN IF NOT EXISTS auth_methods TEXT[] NOT NULL DEFAULT '{pwd}';
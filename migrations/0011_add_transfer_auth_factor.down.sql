@@ -0,0 +1 @@
+ALTER TABLE transfer DROP COLUMN IF EXISTS auth_factor;
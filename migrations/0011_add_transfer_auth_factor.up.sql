@@ -0,0 +1,2 @@
+-- the factor that authorized the transfer: session, pwd or otp
+ALTER TABLE transfer ADD COLUMN IF NOT EXISTS auth_factor VARCHAR(16);
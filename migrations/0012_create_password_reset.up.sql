@@ -0,0 +1,13 @@
+-- tokens issued before a password change are rejected
+ALTER TABLE account ADD COLUMN IF NOT EXISTS password_changed_at timestamp;
+
+CREATE TABLE IF NOT EXISTS password_reset_token (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    account_number BIGINT NOT NULL,
+    created_by BIGINT NOT NULL,
+    created_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL,
+    used_at timestamp
+);
+
+CREATE INDEX IF NOT EXISTS password_reset_token_account_idx ON password_reset_token (account_number);
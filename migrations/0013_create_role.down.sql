@@ -0,0 +1,3 @@
+ALTER TABLE account DROP CONSTRAINT IF EXISTS account_role_fkey;
+DROP TABLE IF EXISTS role_permission;
+DROP TABLE IF EXISTS role;
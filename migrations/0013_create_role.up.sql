@@ -0,0 +1,48 @@
+CREATE TABLE IF NOT EXISTS role (
+    name VARCHAR(100) PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT '',
+    require_mfa BOOLEAN NOT NULL DEFAULT FALSE,
+    builtin BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS role_permission (
+    role_name VARCHAR(100) NOT NULL REFERENCES role (name) ON DELETE CASCADE,
+    permission VARCHAR(100) NOT NULL,
+    PRIMARY KEY (role_name, permission)
+);
+
+-- has to match defaultRoles in rbac.go
+INSERT INTO role (name, description, require_mfa, builtin) VALUES
+    ('admin', 'full access', TRUE, TRUE),
+    ('user', 'account holder', FALSE, TRUE),
+    ('teller', 'opens accounts and looks them up for customers', TRUE, TRUE),
+    ('auditor', 'read only access to accounts and transfers', TRUE, TRUE),
+    ('support', 'helps account holders get back into their accounts', TRUE, TRUE)
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permission (role_name, permission) VALUES
+    ('admin', 'accounts:read'),
+    ('admin', 'accounts:create'),
+    ('admin', 'accounts:delete'),
+    ('admin', 'accounts:unlock'),
+    ('admin', 'passwords:reset'),
+    ('admin', 'transfers:create'),
+    ('admin', 'transfers:read'),
+    ('admin', 'roles:manage'),
+    ('user', 'transfers:create'),
+    ('teller', 'accounts:read'),
+    ('teller', 'accounts:create'),
+    ('teller', 'transfers:read'),
+    ('teller', 'transfers:create'),
+    ('auditor', 'accounts:read'),
+    ('auditor', 'transfers:read'),
+    ('support', 'accounts:read'),
+    ('support', 'transfers:read'),
+    ('support', 'accounts:unlock'),
+    ('support', 'passwords:reset')
+ON CONFLICT DO NOTHING;
+
+-- the role used to be free text, anything unknown gets the least privilege
+UPDATE account SET role = 'user' WHERE role NOT IN (SELECT name FROM role);
+
+ALTER TABLE account ADD CONSTRAINT account_role_fkey FOREIGN KEY (role) REFERENCES role (name);
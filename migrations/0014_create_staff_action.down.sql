@@ -0,0 +1,4 @@
+DELETE FROM role_permission WHERE permission = 'transfers:reverse';
+DROP INDEX IF EXISTS transfer_reversal_of_idx;
+ALTER TABLE transfer DROP COLUMN IF EXISTS reversal_of;
+DROP TABLE IF EXISTS staff_action;
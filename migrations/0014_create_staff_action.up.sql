@@ -0,0 +1,23 @@
+-- staff reading or changing accounts that aren't theirs, with the reason they gave
+CREATE TABLE IF NOT EXISTS staff_action (
+    id BIGSERIAL PRIMARY KEY,
+    actor_number BIGINT NOT NULL,
+    actor_role VARCHAR(100) NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    target_number BIGINT,
+    transfer_id BIGINT,
+    reason TEXT NOT NULL,
+    created_at timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS staff_action_target_idx ON staff_action (target_number, id);
+CREATE INDEX IF NOT EXISTS staff_action_actor_idx ON staff_action (actor_number, id);
+
+-- a reversal points at the transfer it undoes, and there is only one
+ALTER TABLE transfer ADD COLUMN IF NOT EXISTS reversal_of BIGINT REFERENCES transfer (id);
+CREATE UNIQUE INDEX IF NOT EXISTS transfer_reversal_of_idx ON transfer (reversal_of);
+
+INSERT INTO role_permission (role_name, permission) VALUES
+    ('admin', 'transfers:reverse'),
+    ('support', 'transfers:reverse')
+ON CONFLICT DO NOTHING;
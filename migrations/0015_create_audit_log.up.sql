@@ -0,0 +1,35 @@
+-- before and after are TEXT rather than JSONB so they hash the same after a
+-- round trip
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_number BIGINT NOT NULL,
+    actor_role VARCHAR(100) NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    target VARCHAR(100) NOT NULL,
+    request_id VARCHAR(100) NOT NULL DEFAULT '',
+    before_state TEXT,
+    after_state TEXT,
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    created_at timestamp NOT NULL,
+    prev_hash VARCHAR(64) NOT NULL,
+    hash VARCHAR(64) NOT NULL UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor_number, id);
+CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log (target, id);
+
+-- append only, the hash chain catches anyone who gets around this
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+INSERT INTO role_permission (role_name, permission) VALUES
+    ('admin', 'audit:read'),
+    ('auditor', 'audit:read')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,5 @@
+DELETE FROM role_permission WHERE permission = 'accounts:freeze';
+UPDATE role_permission SET permission = 'accounts:delete' WHERE permission = 'accounts:close';
+
+ALTER TABLE account DROP COLUMN IF EXISTS closed_at;
+ALTER TABLE account DROP COLUMN IF EXISTS status;
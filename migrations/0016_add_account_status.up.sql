@@ -0,0 +1,11 @@
+-- accounts are closed instead of deleted
+ALTER TABLE account ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'active'
+    CHECK (status IN ('active', 'frozen', 'closed'));
+ALTER TABLE account ADD COLUMN IF NOT EXISTS closed_at timestamp;
+
+UPDATE role_permission SET permission = 'accounts:close' WHERE permission = 'accounts:delete';
+
+INSERT INTO role_permission (role_name, permission) VALUES
+    ('admin', 'accounts:freeze'),
+    ('support', 'accounts:freeze')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,3 @@
+DELETE FROM role_permission WHERE permission = 'accounts:update';
+
+ALTER TABLE account DROP COLUMN IF EXISTS version;
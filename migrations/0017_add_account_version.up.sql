@@ -0,0 +1,7 @@
+-- bumped on every change to names, role or status, sent back as the ETag of
+-- an account
+ALTER TABLE account ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+INSERT INTO role_permission (role_name, permission) VALUES
+    ('admin', 'accounts:update')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,3 @@
+DELETE FROM role_permission WHERE permission IN ('cash:deposit', 'cash:withdraw');
+
+ALTER TABLE transfer DROP COLUMN IF EXISTS reason_code;
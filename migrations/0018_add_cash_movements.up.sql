@@ -0,0 +1,9 @@
+-- why a deposit or withdrawal happened, empty for ordinary transfers
+ALTER TABLE transfer ADD COLUMN IF NOT EXISTS reason_code VARCHAR(32);
+
+INSERT INTO role_permission (role_name, permission) VALUES
+    ('admin', 'cash:deposit'),
+    ('admin', 'cash:withdraw'),
+    ('teller', 'cash:deposit'),
+    ('teller', 'cash:withdraw')
+ON CONFLICT DO NOTHING;
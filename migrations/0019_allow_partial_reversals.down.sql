@@ -0,0 +1,11 @@
+-- only one reversal per transfer fits the old index, partial ones have to be
+-- merged or removed by hand first
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM transfer WHERE reversal_of IS NOT NULL GROUP BY reversal_of HAVING COUNT(*) > 1) THEN
+        RAISE EXCEPTION 'transfers with more than one reversal exist, clean them up before migrating down';
+    END IF;
+END $$;
+
+DROP INDEX IF EXISTS transfer_reversal_of_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS transfer_reversal_of_idx ON transfer (reversal_of);
@@ -0,0 +1,4 @@
+-- a transfer can be reversed in parts, the store checks they don't add up to
+-- more than it moved
+DROP INDEX IF EXISTS transfer_reversal_of_idx;
+CREATE INDEX IF NOT EXISTS transfer_reversal_of_idx ON transfer (reversal_of);
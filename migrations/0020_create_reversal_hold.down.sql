@@ -0,0 +1,2 @@
+DELETE FROM role_permission WHERE permission = 'transfers:hold';
+DROP TABLE IF EXISTS reversal_hold;
@@ -0,0 +1,15 @@
+-- what a partial reversal couldn't take back, held on the recipient until
+-- another reversal collects it
+CREATE TABLE IF NOT EXISTS reversal_hold (
+    transfer_id BIGINT PRIMARY KEY REFERENCES transfer (id),
+    account_number BIGINT NOT NULL,
+    amount BIGINT NOT NULL CHECK (amount > 0),
+    created_at timestamp DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS reversal_hold_account_idx ON reversal_hold (account_number);
+
+INSERT INTO role_permission (role_name, permission) VALUES
+    ('admin', 'transfers:hold'),
+    ('support', 'transfers:hold')
+ON CONFLICT DO NOTHING;
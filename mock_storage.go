@@ -11,6 +11,7 @@ package main
 
 import (
 	reflect "reflect"
+	time "time"
 
 	gomock "go.uber.org/mock/gomock"
 )
@@ -39,32 +40,146 @@ func (m *MockStorage) EXPECT() *MockStorageMockRecorder {
 	return m.recorder
 }
 
+// CloseAccount mocks base method.
+func (m *MockStorage) CloseAccount(arg0, arg1 int64, arg2 *AuditEntry) (*Transfer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CloseAccount", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*Transfer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CloseAccount indicates an expected call of CloseAccount.
+func (mr *MockStorageMockRecorder) CloseAccount(arg0, arg1, arg2 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CloseAccount", reflect.TypeOf((*MockStorage)(nil).CloseAccount), arg0, arg1, arg2)
+}
+
+// CompleteIdempotencyKey mocks base method.
+func (m *MockStorage) CompleteIdempotencyKey(arg0 *IdempotencyRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CompleteIdempotencyKey", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CompleteIdempotencyKey indicates an expected call of CompleteIdempotencyKey.
+func (mr *MockStorageMockRecorder) CompleteIdempotencyKey(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CompleteIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).CompleteIdempotencyKey), arg0)
+}
+
+// ConsumeToken mocks base method.
+func (m *MockStorage) ConsumeToken(arg0 string, arg1 time.Time) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ConsumeToken", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ConsumeToken indicates an expected call of ConsumeToken.
+func (mr *MockStorageMockRecorder) ConsumeToken(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConsumeToken", reflect.TypeOf((*MockStorage)(nil).ConsumeToken), arg0, arg1)
+}
+
 // CreateAccount mocks base method.
-func (m *MockStorage) CreateAccount(arg0 *Account) error {
+func (m *MockStorage) CreateAccount(arg0 *Account, arg1 *AuditEntry) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreateAccount", arg0)
+	ret := m.ctrl.Call(m, "CreateAccount", arg0, arg1)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // CreateAccount indicates an expected call of CreateAccount.
-func (mr *MockStorageMockRecorder) CreateAccount(arg0 any) *gomock.Call {
+func (mr *MockStorageMockRecorder) CreateAccount(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAccount", reflect.TypeOf((*MockStorage)(nil).CreateAccount), arg0, arg1)
+}
+
+// CreateFXQuote mocks base method.
+func (m *MockStorage) CreateFXQuote(arg0 *FXQuote) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateFXQuote", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateFXQuote indicates an expected call of CreateFXQuote.
+func (mr *MockStorageMockRecorder) CreateFXQuote(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateFXQuote", reflect.TypeOf((*MockStorage)(nil).CreateFXQuote), arg0)
+}
+
+// CreatePasswordReset mocks base method.
+func (m *MockStorage) CreatePasswordReset(arg0 *PasswordReset, arg1 *AuditEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreatePasswordReset", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreatePasswordReset indicates an expected call of CreatePasswordReset.
+func (mr *MockStorageMockRecorder) CreatePasswordReset(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreatePasswordReset", reflect.TypeOf((*MockStorage)(nil).CreatePasswordReset), arg0, arg1)
+}
+
+// CreateRefreshToken mocks base method.
+func (m *MockStorage) CreateRefreshToken(arg0 *RefreshToken) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateRefreshToken", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateRefreshToken indicates an expected call of CreateRefreshToken.
+func (mr *MockStorageMockRecorder) CreateRefreshToken(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateRefreshToken", reflect.TypeOf((*MockStorage)(nil).CreateRefreshToken), arg0)
+}
+
+// DeleteRole mocks base method.
+func (m *MockStorage) DeleteRole(arg0 string, arg1 *AuditEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteRole", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteRole indicates an expected call of DeleteRole.
+func (mr *MockStorageMockRecorder) DeleteRole(arg0, arg1 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAccount", reflect.TypeOf((*MockStorage)(nil).CreateAccount), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteRole", reflect.TypeOf((*MockStorage)(nil).DeleteRole), arg0, arg1)
 }
 
-// DeleteAccount mocks base method.
-func (m *MockStorage) DeleteAccount(arg0 int) error {
+// Deposit mocks base method.
+func (m *MockStorage) Deposit(arg0 *Transfer, arg1 *AuditEntry) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DeleteAccount", arg0)
+	ret := m.ctrl.Call(m, "Deposit", arg0, arg1)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// DeleteAccount indicates an expected call of DeleteAccount.
-func (mr *MockStorageMockRecorder) DeleteAccount(arg0 any) *gomock.Call {
+// Deposit indicates an expected call of Deposit.
+func (mr *MockStorageMockRecorder) Deposit(arg0, arg1 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteAccount", reflect.TypeOf((*MockStorage)(nil).DeleteAccount), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Deposit", reflect.TypeOf((*MockStorage)(nil).Deposit), arg0, arg1)
+}
+
+// EnableMFA mocks base method.
+func (m *MockStorage) EnableMFA(arg0, arg1 int64, arg2 *AuditEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EnableMFA", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// EnableMFA indicates an expected call of EnableMFA.
+func (mr *MockStorageMockRecorder) EnableMFA(arg0, arg1, arg2 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnableMFA", reflect.TypeOf((*MockStorage)(nil).EnableMFA), arg0, arg1, arg2)
 }
 
 // GetAccountById mocks base method.
@@ -98,44 +213,496 @@ func (mr *MockStorageMockRecorder) GetAccountByNumber(arg0 any) *gomock.Call {
 }
 
 // GetAccounts mocks base method.
-func (m *MockStorage) GetAccounts() ([]*Account, error) {
+func (m *MockStorage) GetAccounts(arg0 AccountFilter) ([]*Account, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetAccounts")
+	ret := m.ctrl.Call(m, "GetAccounts", arg0)
 	ret0, _ := ret[0].([]*Account)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetAccounts indicates an expected call of GetAccounts.
-func (mr *MockStorageMockRecorder) GetAccounts() *gomock.Call {
+func (mr *MockStorageMockRecorder) GetAccounts(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAccounts", reflect.TypeOf((*MockStorage)(nil).GetAccounts), arg0)
+}
+
+// GetAuditLog mocks base method.
+func (m *MockStorage) GetAuditLog(arg0 AuditFilter) ([]*AuditEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAuditLog", arg0)
+	ret0, _ := ret[0].([]*AuditEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAuditLog indicates an expected call of GetAuditLog.
+func (mr *MockStorageMockRecorder) GetAuditLog(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAuditLog", reflect.TypeOf((*MockStorage)(nil).GetAuditLog), arg0)
+}
+
+// GetFXQuote mocks base method.
+func (m *MockStorage) GetFXQuote(arg0 string) (*FXQuote, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetFXQuote", arg0)
+	ret0, _ := ret[0].(*FXQuote)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetFXQuote indicates an expected call of GetFXQuote.
+func (mr *MockStorageMockRecorder) GetFXQuote(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFXQuote", reflect.TypeOf((*MockStorage)(nil).GetFXQuote), arg0)
+}
+
+// GetLoginAttempts mocks base method.
+func (m *MockStorage) GetLoginAttempts(arg0 string) (*LoginAttempts, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLoginAttempts", arg0)
+	ret0, _ := ret[0].(*LoginAttempts)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLoginAttempts indicates an expected call of GetLoginAttempts.
+func (mr *MockStorageMockRecorder) GetLoginAttempts(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLoginAttempts", reflect.TypeOf((*MockStorage)(nil).GetLoginAttempts), arg0)
+}
+
+// GetMFASecret mocks base method.
+func (m *MockStorage) GetMFASecret(arg0 int64) (*MFASecret, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMFASecret", arg0)
+	ret0, _ := ret[0].(*MFASecret)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMFASecret indicates an expected call of GetMFASecret.
+func (mr *MockStorageMockRecorder) GetMFASecret(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMFASecret", reflect.TypeOf((*MockStorage)(nil).GetMFASecret), arg0)
+}
+
+// GetRole mocks base method.
+func (m *MockStorage) GetRole(arg0 string) (*Role, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRole", arg0)
+	ret0, _ := ret[0].(*Role)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRole indicates an expected call of GetRole.
+func (mr *MockStorageMockRecorder) GetRole(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRole", reflect.TypeOf((*MockStorage)(nil).GetRole), arg0)
+}
+
+// GetRoles mocks base method.
+func (m *MockStorage) GetRoles() ([]*Role, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRoles")
+	ret0, _ := ret[0].([]*Role)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRoles indicates an expected call of GetRoles.
+func (mr *MockStorageMockRecorder) GetRoles() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRoles", reflect.TypeOf((*MockStorage)(nil).GetRoles))
+}
+
+// GetTransfer mocks base method.
+func (m *MockStorage) GetTransfer(arg0 int64) (*Transfer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTransfer", arg0)
+	ret0, _ := ret[0].(*Transfer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTransfer indicates an expected call of GetTransfer.
+func (mr *MockStorageMockRecorder) GetTransfer(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTransfer", reflect.TypeOf((*MockStorage)(nil).GetTransfer), arg0)
+}
+
+// GetTransfers mocks base method.
+func (m *MockStorage) GetTransfers(arg0 TransferFilter) ([]*Transfer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTransfers", arg0)
+	ret0, _ := ret[0].([]*Transfer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTransfers indicates an expected call of GetTransfers.
+func (mr *MockStorageMockRecorder) GetTransfers(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTransfers", reflect.TypeOf((*MockStorage)(nil).GetTransfers), arg0)
+}
+
+// IsTokenRevoked mocks base method.
+func (m *MockStorage) IsTokenRevoked(arg0 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IsTokenRevoked", arg0)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// IsTokenRevoked indicates an expected call of IsTokenRevoked.
+func (mr *MockStorageMockRecorder) IsTokenRevoked(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsTokenRevoked", reflect.TypeOf((*MockStorage)(nil).IsTokenRevoked), arg0)
+}
+
+// PurgeExpiredTokens mocks base method.
+func (m *MockStorage) PurgeExpiredTokens(arg0 time.Time) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeExpiredTokens", arg0)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeExpiredTokens indicates an expected call of PurgeExpiredTokens.
+func (mr *MockStorageMockRecorder) PurgeExpiredTokens(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeExpiredTokens", reflect.TypeOf((*MockStorage)(nil).PurgeExpiredTokens), arg0)
+}
+
+// PurgeIdempotencyKeys mocks base method.
+func (m *MockStorage) PurgeIdempotencyKeys(arg0 time.Time) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeIdempotencyKeys", arg0)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeIdempotencyKeys indicates an expected call of PurgeIdempotencyKeys.
+func (mr *MockStorageMockRecorder) PurgeIdempotencyKeys(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeIdempotencyKeys", reflect.TypeOf((*MockStorage)(nil).PurgeIdempotencyKeys), arg0)
+}
+
+// PurgeLoginAttempts mocks base method.
+func (m *MockStorage) PurgeLoginAttempts(arg0 time.Time) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeLoginAttempts", arg0)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeLoginAttempts indicates an expected call of PurgeLoginAttempts.
+func (mr *MockStorageMockRecorder) PurgeLoginAttempts(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeLoginAttempts", reflect.TypeOf((*MockStorage)(nil).PurgeLoginAttempts), arg0)
+}
+
+// RecomputeBalance mocks base method.
+func (m *MockStorage) RecomputeBalance(arg0 int64) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecomputeBalance", arg0)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecomputeBalance indicates an expected call of RecomputeBalance.
+func (mr *MockStorageMockRecorder) RecomputeBalance(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecomputeBalance", reflect.TypeOf((*MockStorage)(nil).RecomputeBalance), arg0)
+}
+
+// RecordLoginFailure mocks base method.
+func (m *MockStorage) RecordLoginFailure(arg0 string, arg1, arg2 time.Time) (*LoginAttempts, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordLoginFailure", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*LoginAttempts)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RecordLoginFailure indicates an expected call of RecordLoginFailure.
+func (mr *MockStorageMockRecorder) RecordLoginFailure(arg0, arg1, arg2 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordLoginFailure", reflect.TypeOf((*MockStorage)(nil).RecordLoginFailure), arg0, arg1, arg2)
+}
+
+// RecordStaffAction mocks base method.
+func (m *MockStorage) RecordStaffAction(arg0 *StaffAction) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordStaffAction", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecordStaffAction indicates an expected call of RecordStaffAction.
+func (mr *MockStorageMockRecorder) RecordStaffAction(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordStaffAction", reflect.TypeOf((*MockStorage)(nil).RecordStaffAction), arg0)
+}
+
+// RehashPassword mocks base method.
+func (m *MockStorage) RehashPassword(arg0 int64, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RehashPassword", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RehashPassword indicates an expected call of RehashPassword.
+func (mr *MockStorageMockRecorder) RehashPassword(arg0, arg1, arg2 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RehashPassword", reflect.TypeOf((*MockStorage)(nil).RehashPassword), arg0, arg1, arg2)
+}
+
+// ReleaseIdempotencyKey mocks base method.
+func (m *MockStorage) ReleaseIdempotencyKey(arg0 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseIdempotencyKey", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseIdempotencyKey indicates an expected call of ReleaseIdempotencyKey.
+func (mr *MockStorageMockRecorder) ReleaseIdempotencyKey(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).ReleaseIdempotencyKey), arg0)
+}
+
+// ReserveIdempotencyKey mocks base method.
+func (m *MockStorage) ReserveIdempotencyKey(arg0 *IdempotencyRecord) (*IdempotencyRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReserveIdempotencyKey", arg0)
+	ret0, _ := ret[0].(*IdempotencyRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReserveIdempotencyKey indicates an expected call of ReserveIdempotencyKey.
+func (mr *MockStorageMockRecorder) ReserveIdempotencyKey(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReserveIdempotencyKey", reflect.TypeOf((*MockStorage)(nil).ReserveIdempotencyKey), arg0)
+}
+
+// ResetLoginAttempts mocks base method.
+func (m *MockStorage) ResetLoginAttempts(arg0 string, arg1 *AuditEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetLoginAttempts", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResetLoginAttempts indicates an expected call of ResetLoginAttempts.
+func (mr *MockStorageMockRecorder) ResetLoginAttempts(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetLoginAttempts", reflect.TypeOf((*MockStorage)(nil).ResetLoginAttempts), arg0, arg1)
+}
+
+// ResetPassword mocks base method.
+func (m *MockStorage) ResetPassword(arg0, arg1 string, arg2 time.Time, arg3 *AuditEntry) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResetPassword", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResetPassword indicates an expected call of ResetPassword.
+func (mr *MockStorageMockRecorder) ResetPassword(arg0, arg1, arg2, arg3 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetPassword", reflect.TypeOf((*MockStorage)(nil).ResetPassword), arg0, arg1, arg2, arg3)
+}
+
+// ReverseTransfer mocks base method.
+func (m *MockStorage) ReverseTransfer(arg0 *Transfer, arg1 bool, arg2 *StaffAction, arg3 *AuditEntry) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReverseTransfer", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReverseTransfer indicates an expected call of ReverseTransfer.
+func (mr *MockStorageMockRecorder) ReverseTransfer(arg0, arg1, arg2, arg3 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReverseTransfer", reflect.TypeOf((*MockStorage)(nil).ReverseTransfer), arg0, arg1, arg2, arg3)
+}
+
+// RevokeRefreshToken mocks base method.
+func (m *MockStorage) RevokeRefreshToken(arg0 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeRefreshToken", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeRefreshToken indicates an expected call of RevokeRefreshToken.
+func (mr *MockStorageMockRecorder) RevokeRefreshToken(arg0 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeRefreshToken", reflect.TypeOf((*MockStorage)(nil).RevokeRefreshToken), arg0)
+}
+
+// RevokeToken mocks base method.
+func (m *MockStorage) RevokeToken(arg0 string, arg1 time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RevokeToken", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RevokeToken indicates an expected call of RevokeToken.
+func (mr *MockStorageMockRecorder) RevokeToken(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RevokeToken", reflect.TypeOf((*MockStorage)(nil).RevokeToken), arg0, arg1)
+}
+
+// RotateRefreshToken mocks base method.
+func (m *MockStorage) RotateRefreshToken(arg0 string, arg1 *RefreshToken) (*RefreshToken, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RotateRefreshToken", arg0, arg1)
+	ret0, _ := ret[0].(*RefreshToken)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RotateRefreshToken indicates an expected call of RotateRefreshToken.
+func (mr *MockStorageMockRecorder) RotateRefreshToken(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RotateRefreshToken", reflect.TypeOf((*MockStorage)(nil).RotateRefreshToken), arg0, arg1)
+}
+
+// SaveMFASecret mocks base method.
+func (m *MockStorage) SaveMFASecret(arg0 *MFASecret, arg1 *AuditEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveMFASecret", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveMFASecret indicates an expected call of SaveMFASecret.
+func (mr *MockStorageMockRecorder) SaveMFASecret(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveMFASecret", reflect.TypeOf((*MockStorage)(nil).SaveMFASecret), arg0, arg1)
+}
+
+// SaveRole mocks base method.
+func (m *MockStorage) SaveRole(arg0 *Role, arg1 *AuditEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SaveRole", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SaveRole indicates an expected call of SaveRole.
+func (mr *MockStorageMockRecorder) SaveRole(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveRole", reflect.TypeOf((*MockStorage)(nil).SaveRole), arg0, arg1)
+}
+
+// SetAccountRole mocks base method.
+func (m *MockStorage) SetAccountRole(arg0 int64, arg1 string, arg2 *AuditEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetAccountRole", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetAccountRole indicates an expected call of SetAccountRole.
+func (mr *MockStorageMockRecorder) SetAccountRole(arg0, arg1, arg2 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetAccountRole", reflect.TypeOf((*MockStorage)(nil).SetAccountRole), arg0, arg1, arg2)
+}
+
+// SetAccountStatus mocks base method.
+func (m *MockStorage) SetAccountStatus(arg0 int64, arg1 AccountStatus, arg2 *AuditEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetAccountStatus", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetAccountStatus indicates an expected call of SetAccountStatus.
+func (mr *MockStorageMockRecorder) SetAccountStatus(arg0, arg1, arg2 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAccounts", reflect.TypeOf((*MockStorage)(nil).GetAccounts))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetAccountStatus", reflect.TypeOf((*MockStorage)(nil).SetAccountStatus), arg0, arg1, arg2)
+}
+
+// SetPassword mocks base method.
+func (m *MockStorage) SetPassword(arg0 int64, arg1 string, arg2 time.Time, arg3 *AuditEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetPassword", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetPassword indicates an expected call of SetPassword.
+func (mr *MockStorageMockRecorder) SetPassword(arg0, arg1, arg2, arg3 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPassword", reflect.TypeOf((*MockStorage)(nil).SetPassword), arg0, arg1, arg2, arg3)
 }
 
 // TransferMoney mocks base method.
-func (m *MockStorage) TransferMoney(arg0, arg1 *Account, arg2 uint64) error {
+func (m *MockStorage) TransferMoney(arg0 *Transfer, arg1 *AuditEntry) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "TransferMoney", arg0, arg1, arg2)
+	ret := m.ctrl.Call(m, "TransferMoney", arg0, arg1)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // TransferMoney indicates an expected call of TransferMoney.
-func (mr *MockStorageMockRecorder) TransferMoney(arg0, arg1, arg2 any) *gomock.Call {
+func (mr *MockStorageMockRecorder) TransferMoney(arg0, arg1 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransferMoney", reflect.TypeOf((*MockStorage)(nil).TransferMoney), arg0, arg1, arg2)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TransferMoney", reflect.TypeOf((*MockStorage)(nil).TransferMoney), arg0, arg1)
 }
 
 // UpdateAccount mocks base method.
-func (m *MockStorage) UpdateAccount(arg0 *Account) error {
+func (m *MockStorage) UpdateAccount(arg0 *Account, arg1 *AuditEntry) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateAccount", arg0)
+	ret := m.ctrl.Call(m, "UpdateAccount", arg0, arg1)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // UpdateAccount indicates an expected call of UpdateAccount.
-func (mr *MockStorageMockRecorder) UpdateAccount(arg0 any) *gomock.Call {
+func (mr *MockStorageMockRecorder) UpdateAccount(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateAccount", reflect.TypeOf((*MockStorage)(nil).UpdateAccount), arg0, arg1)
+}
+
+// UseMFAStep mocks base method.
+func (m *MockStorage) UseMFAStep(arg0, arg1 int64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UseMFAStep", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UseMFAStep indicates an expected call of UseMFAStep.
+func (mr *MockStorageMockRecorder) UseMFAStep(arg0, arg1 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UseMFAStep", reflect.TypeOf((*MockStorage)(nil).UseMFAStep), arg0, arg1)
+}
+
+// Withdraw mocks base method.
+func (m *MockStorage) Withdraw(arg0 *Transfer, arg1 uint64, arg2 *AuditEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Withdraw", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Withdraw indicates an expected call of Withdraw.
+func (mr *MockStorageMockRecorder) Withdraw(arg0, arg1, arg2 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateAccount", reflect.TypeOf((*MockStorage)(nil).UpdateAccount), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Withdraw", reflect.TypeOf((*MockStorage)(nil).Withdraw), arg0, arg1, arg2)
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Currency is an ISO 4217 code
+type Currency string
+
+const DefaultCurrency Currency = "USD"
+
+var ErrCurrencyMismatch = errors.New("currencies do not match")
+
+// number of digits after the decimal point, amounts are always stored as an
+// integer count of these minor units (cents for USD, yen for JPY)
+var currencyMinorUnits = map[Currency]int{
+	"AUD": 2,
+	"BHD": 3,
+	"BRL": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"CLP": 0,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"INR": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"MXN": 2,
+	"NZD": 2,
+	"SEK": 2,
+	"USD": 2,
+}
+
+func ParseCurrency(code string) (Currency, error) {
+	c := Currency(strings.ToUpper(strings.TrimSpace(code)))
+	if _, ok := currencyMinorUnits[c]; !ok {
+		return "", fmt.Errorf("unsupported currency %q", code)
+	}
+
+	return c, nil
+}
+
+func (c Currency) MinorUnits() int {
+	return currencyMinorUnits[c]
+}
+
+// Money is an amount in the minor units of its currency
+type Money struct {
+	Amount   uint64   `json:"amount"`
+	Currency Currency `json:"currency"`
+}
+
+// formats with the currency's decimal places, e.g. "12.34 USD" or "1234 JPY"
+func (m Money) String() string {
+	units := m.Currency.MinorUnits()
+	if units == 0 {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+
+	scale := uint64(1)
+	for i := 0; i < units; i++ {
+		scale *= 10
+	}
+
+	return fmt.Sprintf("%d.%0*d %s", m.Amount/scale, units, m.Amount%scale, m.Currency)
+}
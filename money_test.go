@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCurrency(t *testing.T) {
+	currency, err := ParseCurrency(" eur ")
+	assert.Nil(t, err)
+	assert.Equal(t, Currency("EUR"), currency)
+
+	_, err = ParseCurrency("XYZ")
+	assert.NotNil(t, err)
+}
+
+func TestMoneyString(t *testing.T) {
+	assert.Equal(t, "12.34 USD", Money{Amount: 1234, Currency: "USD"}.String())
+	assert.Equal(t, "0.05 EUR", Money{Amount: 5, Currency: "EUR"}.String())
+	assert.Equal(t, "1234 JPY", Money{Amount: 1234, Currency: "JPY"}.String())
+	assert.Equal(t, "1.234 KWD", Money{Amount: 1234, Currency: "KWD"}.String())
+}
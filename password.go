@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidResetToken = errors.New("invalid password reset token")
+
+// bcrypt ignores everything after 72 bytes
+const maxPasswordBytes = 72
+
+// PasswordConfig is the policy new passwords have to meet and how they are
+// hashed. Changing BcryptCost rehashes passwords as their owners log in.
+type PasswordConfig struct {
+	MinLength     int      `json:"min_length"`
+	RequireUpper  bool     `json:"require_upper"`
+	RequireLower  bool     `json:"require_lower"`
+	RequireDigit  bool     `json:"require_digit"`
+	RequireSymbol bool     `json:"require_symbol"`
+	BcryptCost    int      `json:"bcrypt_cost"`
+	ResetTokenTTL Duration `json:"reset_token_ttl"`
+}
+
+func defaultPasswordConfig() PasswordConfig {
+	return PasswordConfig{
+		MinLength:     8,
+		RequireDigit:  true,
+		BcryptCost:    bcrypt.DefaultCost,
+		ResetTokenTTL: Duration(time.Hour),
+	}
+}
+
+// returns an error a user can act on when password breaks the policy
+func (c PasswordConfig) check(password string) error {
+	if len(password) < c.MinLength {
+		return fmt.Errorf("password must be at least %d characters", c.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+
+	switch {
+	case c.RequireUpper && !upper:
+		return fmt.Errorf("password must contain an upper case letter")
+	case c.RequireLower && !lower:
+		return fmt.Errorf("password must contain a lower case letter")
+	case c.RequireDigit && !digit:
+		return fmt.Errorf("password must contain a digit")
+	case c.RequireSymbol && !symbol:
+		return fmt.Errorf("password must contain a symbol")
+	}
+
+	return nil
+}
+
+func (c PasswordConfig) hash(password string) (string, error) {
+	encpw, err := bcrypt.GenerateFromPassword([]byte(password), c.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(encpw), nil
+}
+
+// called after a successful login, a failed rehash only costs another try
+// next time
+func (s *ApiServer) rehashPassword(acc *Account, password string) {
+	cost, err := bcrypt.Cost([]byte(acc.EncryptedPassword))
+	if err != nil || cost == s.passwords.BcryptCost {
+		return
+	}
+
+	encpw, err := s.passwords.hash(password)
+	if err != nil {
+		fmt.Println("Error rehashing password")
+		return
+	}
+
+	if err := s.store.RehashPassword(acc.Number, acc.EncryptedPassword, encpw); err != nil {
+		fmt.Println("Error storing rehashed password")
+	}
+}
+
+func (s *ApiServer) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	number, _ := r.Context().Value("authorizedAccountNumber").(int64)
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
+
+	// the current password is guessed the same way a login would be
+	ip := clientIP(r)
+	now := time.Now().UTC()
+	wait, err := s.loginBlocked(number, ip, now)
+	if err != nil {
+		fmt.Println("Error checking login attempts")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+	if wait > 0 {
+		return writeTooManyAttempts(w, wait)
+	}
+
+	acc, err := s.store.GetAccountByNumber(number)
+	if err != nil {
+		fmt.Println("Error retrieving account")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	if err := acc.ValidatePassword(req.CurrentPassword); err != nil {
+		s.recordLoginFailure(number, ip, now)
+		return WriteJson(w, http.StatusUnauthorized, ApiError{Error: "current password is incorrect"})
+	}
+
+	if req.NewPassword == req.CurrentPassword {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "new password must be different"})
+	}
+
+	if err := s.passwords.check(req.NewPassword); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+	}
+
+	encpw, err := s.passwords.hash(req.NewPassword)
+	if err != nil {
+		fmt.Println("Error hashing password")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	// also revokes every token issued to the account so far
+	if err := s.store.SetPassword(number, encpw, now, s.auditEntry(r, auditPasswordChange)); err != nil {
+		fmt.Println("Error storing password")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	if err := s.store.ResetLoginAttempts(accountLoginKey(number), nil); err != nil {
+		fmt.Println("Error resetting login attempts")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// issues a reset token an admin hands to the account owner out of band.
+// Issuing a new one cancels the previous one.
+func (s *ApiServer) handleCreatePasswordReset(w http.ResponseWriter, r *http.Request) error {
+	req, err := decodeAndValidateRequest[PasswordResetRequest](r)
+	if err != nil {
+		fmt.Println("Error decoding password reset request")
+		return writeStaffRequestError(w, err)
+	}
+
+	parameter, err := getParameter(r, "number")
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
+
+	number, err := strconv.ParseInt(parameter, 10, 64)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
+
+	if _, err := s.store.GetAccountByNumber(number); err != nil {
+		if errors.Is(err, ErrAccountNotFound) {
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "account not found"})
+		}
+		fmt.Println("Error retrieving account")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	plain, err := randomToken(32)
+	if err != nil {
+		fmt.Println("Error creating reset token")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	now := time.Now().UTC()
+	reset := &PasswordReset{
+		TokenHash:     hashToken(plain),
+		AccountNumber: number,
+		CreatedBy:     req.AdminAccount,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(time.Duration(s.passwords.ResetTokenTTL)),
+	}
+	if err := s.store.CreatePasswordReset(reset, s.auditEntry(r, auditResetToken)); err != nil {
+		fmt.Println("Error storing reset token")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, PasswordResetResponse{
+		Number:     number,
+		ResetToken: plain,
+		ExpiresAt:  reset.ExpiresAt,
+	})
+}
+
+// sets a new password with a reset token, no login needed
+func (s *ApiServer) handleResetPassword(w http.ResponseWriter, r *http.Request) error {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
+
+	if err := s.passwords.check(req.NewPassword); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+	}
+
+	encpw, err := s.passwords.hash(req.NewPassword)
+	if err != nil {
+		fmt.Println("Error hashing password")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	// the token is burnt in the same transaction that sets the password
+	number, err := s.store.ResetPassword(hashToken(req.ResetToken), encpw, time.Now().UTC(), s.auditEntry(r, auditPasswordReset))
+	if err != nil {
+		if errors.Is(err, ErrInvalidResetToken) {
+			return WriteJson(w, http.StatusUnauthorized, ApiError{Error: "invalid or expired reset token"})
+		}
+		fmt.Println("Error resetting password")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	// a reset also lifts a lockout
+	if err := s.store.ResetLoginAttempts(accountLoginKey(number), nil); err != nil {
+		fmt.Println("Error resetting login attempts")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
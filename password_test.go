@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordConfig{
+		MinLength:     10,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+	}
+
+	for password, ok := range map[string]bool{
+		"Short1!":            false,
+		"alllowercase1!":     false,
+		"ALLUPPERCASE1!":     false,
+		"NoDigitsHere!":      false,
+		"NoSymbolsHere1":     false,
+		"Correct-Horse-1":    true,
+		"Ünïcödé-Pässwörd-1": true,
+	} {
+		err := policy.check(password)
+		assert.Equal(t, ok, err == nil, "%q: %v", password, err)
+	}
+
+	//bcrypt would silently ignore the rest
+	long := make([]byte, maxPasswordBytes+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+	assert.Error(t, defaultPasswordConfig().check("1"+string(long)))
+}
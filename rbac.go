@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+var (
+	ErrRoleNotFound = errors.New("role not found")
+	ErrRoleInUse    = errors.New("role is assigned to accounts")
+)
+
+// Permission is what a route asks for. Accounts can always read their own
+// data and send from their own balance, the accounts: and transfers:read
+// permissions are about other people's accounts.
+type Permission string
+
+const (
+	PermAccountsRead     Permission = "accounts:read"
+	PermAccountsCreate   Permission = "accounts:create"
+	PermAccountsFreeze   Permission = "accounts:freeze"
+	PermAccountsClose    Permission = "accounts:close"
+	PermAccountsUpdate   Permission = "accounts:update"
+	PermAccountsUnlock   Permission = "accounts:unlock"
+	PermCashDeposit      Permission = "cash:deposit"
+	PermCashWithdraw     Permission = "cash:withdraw"
+	PermPasswordsReset   Permission = "passwords:reset"
+	PermTransfersCreate  Permission = "transfers:create"
+	PermTransfersRead    Permission = "transfers:read"
+	PermTransfersReverse Permission = "transfers:reverse"
+	PermTransfersHold    Permission = "transfers:hold"
+	PermRolesManage      Permission = "roles:manage"
+	PermAuditRead        Permission = "audit:read"
+)
+
+var allPermissions = []Permission{
+	PermAccountsRead,
+	PermAccountsCreate,
+	PermAccountsFreeze,
+	PermAccountsClose,
+	PermAccountsUpdate,
+	PermAccountsUnlock,
+	PermCashDeposit,
+	PermCashWithdraw,
+	PermPasswordsReset,
+	PermTransfersCreate,
+	PermTransfersRead,
+	PermTransfersReverse,
+	PermTransfersHold,
+	PermRolesManage,
+	PermAuditRead,
+}
+
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,49}$`)
+
+// the roles every store starts with, the migrations seed the same ones
+func defaultRoles() []*Role {
+	return []*Role{
+		{
+			Name:        roleAdmin,
+			Description: "full access",
+			Permissions: allPermissions,
+			RequireMFA:  true,
+			Builtin:     true,
+		},
+		{
+			Name:        roleUser,
+			Description: "account holder",
+			Permissions: []Permission{PermTransfersCreate},
+			Builtin:     true,
+		},
+		{
+			Name:        "teller",
+			Description: "opens accounts and looks them up for customers",
+			Permissions: []Permission{PermAccountsRead, PermAccountsCreate, PermTransfersRead, PermTransfersCreate, PermCashDeposit, PermCashWithdraw},
+			RequireMFA:  true,
+			Builtin:     true,
+		},
+		{
+			Name:        "auditor",
+			Description: "read only access to accounts and transfers",
+			Permissions: []Permission{PermAccountsRead, PermTransfersRead, PermAuditRead},
+			RequireMFA:  true,
+			Builtin:     true,
+		},
+		{
+			Name:        "support",
+			Description: "helps account holders get back into their accounts",
+			Permissions: []Permission{PermAccountsRead, PermTransfersRead, PermTransfersReverse, PermTransfersHold, PermAccountsUnlock, PermAccountsFreeze, PermPasswordsReset},
+			RequireMFA:  true,
+			Builtin:     true,
+		},
+	}
+}
+
+// the permissions of the caller's role are put in the request context by
+// jwtAuthMiddleware
+func hasPermission(r *http.Request, p Permission) bool {
+	permissions, _ := r.Context().Value("permissions").([]Permission)
+	return slices.Contains(permissions, p)
+}
+
+// declares the permission a route needs, it must run after jwtAuthMiddleware
+func (s *ApiServer) requirePermission(p Permission, handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasPermission(r, p) {
+			WriteJson(w, http.StatusForbidden, ApiError{Error: fmt.Sprintf("permission denied: %s required", p)})
+			return
+		}
+
+		handlerFunc(w, r)
+	}
+}
+
+func validateRole(role *Role) error {
+	if !roleNamePattern.MatchString(role.Name) {
+		return fmt.Errorf("role names are 2 to 50 lower case letters, digits, - or _")
+	}
+
+	for _, p := range role.Permissions {
+		if !slices.Contains(allPermissions, p) {
+			return fmt.Errorf("unknown permission %q", p)
+		}
+	}
+
+	return nil
+}
+
+func (s *ApiServer) handleGetRoles(w http.ResponseWriter, r *http.Request) error {
+	roles, err := s.store.GetRoles()
+	if err != nil {
+		fmt.Println("Error retrieving roles")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, roles)
+}
+
+// creates or replaces a role, the admin role is fixed so nobody can lock
+// everyone out
+func (s *ApiServer) handleSaveRole(w http.ResponseWriter, r *http.Request) error {
+	name, err := getParameter(r, "name")
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid role name"})
+	}
+
+	var req SaveRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
+
+	if name == roleAdmin {
+		return WriteJson(w, http.StatusForbidden, ApiError{Error: "the admin role can't be changed"})
+	}
+
+	role := &Role{
+		Name:        name,
+		Description: req.Description,
+		Permissions: req.Permissions,
+		RequireMFA:  req.RequireMFA,
+	}
+	if err := validateRole(role); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+	}
+
+	if err := s.store.SaveRole(role, s.auditEntry(r, auditRoleSave)); err != nil {
+		fmt.Println("Error saving role")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	saved, err := s.store.GetRole(name)
+	if err != nil {
+		fmt.Println("Error retrieving role")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, saved)
+}
+
+func (s *ApiServer) handleDeleteRole(w http.ResponseWriter, r *http.Request) error {
+	name, err := getParameter(r, "name")
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid role name"})
+	}
+
+	role, err := s.store.GetRole(name)
+	if err != nil {
+		if errors.Is(err, ErrRoleNotFound) {
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "role not found"})
+		}
+		fmt.Println("Error retrieving role")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+	if role.Builtin {
+		return WriteJson(w, http.StatusForbidden, ApiError{Error: "built in roles can't be deleted"})
+	}
+
+	if err := s.store.DeleteRole(name, s.auditEntry(r, auditRoleDelete)); err != nil {
+		switch {
+		case errors.Is(err, ErrRoleInUse):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "role is still assigned to accounts"})
+		case errors.Is(err, ErrRoleNotFound):
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "role not found"})
+		}
+		fmt.Println("Error deleting role")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *ApiServer) handleSetAccountRole(w http.ResponseWriter, r *http.Request) error {
+	parameter, err := getParameter(r, "number")
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
+
+	number, err := strconv.ParseInt(parameter, 10, 64)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid account number"})
+	}
+
+	var req SetAccountRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
+
+	// keeps the last admin from demoting themselves
+	authorizedAccountNumber, _ := r.Context().Value("authorizedAccountNumber").(int64)
+	if number == authorizedAccountNumber {
+		return WriteJson(w, http.StatusForbidden, ApiError{Error: "you can't change your own role"})
+	}
+
+	if err := s.store.SetAccountRole(number, req.Role, s.auditEntry(r, auditAccountRole)); err != nil {
+		switch {
+		case errors.Is(err, ErrRoleNotFound):
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "unknown role"})
+		case errors.Is(err, ErrAccountNotFound):
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "account not found"})
+		}
+		fmt.Println("Error setting account role")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, map[string]any{"number": number, "role": req.Role})
+}
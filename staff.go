@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTransferReversed = errors.New("transfer already reversed")
+	ErrReversalTooLarge = errors.New("reversal exceeds what is left of the transfer")
+	ErrReversalReversed = errors.New("a reversal can't be reversed")
+	ErrFundsHeld        = errors.New("funds are held for a reversal")
+)
+
+// what happens when the recipient of a transfer can't pay the reversal
+type ReversalPolicy string
+
+const (
+	// nothing moves and the reversal fails
+	ReversalFail ReversalPolicy = "fail"
+	// what the recipient has is taken back and the rest is held on their
+	// account until another reversal collects it
+	ReversalHold ReversalPolicy = "hold"
+)
+
+// staff acting on an account that isn't theirs say why in this header
+const (
+	actionReasonHeader    = "x-action-reason"
+	maxActionReasonLength = 500
+)
+
+// values for StaffAction.Action
+const (
+	staffActionListAccounts    = "accounts.list"
+	staffActionReadAccount     = "account.read"
+	staffActionReadTransfers   = "transfers.read"
+	staffActionReverseTransfer = "transfer.reverse"
+)
+
+func actionReason(r *http.Request) (string, error) {
+	reason := strings.TrimSpace(r.Header.Get(actionReasonHeader))
+	if reason == "" {
+		return "", fmt.Errorf("a reason is required, send it in the %s header", actionReasonHeader)
+	}
+	if len(reason) > maxActionReasonLength {
+		return "", fmt.Errorf("reason must be at most %d characters", maxActionReasonLength)
+	}
+
+	return reason, nil
+}
+
+func (s *ApiServer) recordStaffAction(r *http.Request, action string, target int64, transferId int64, reason string) error {
+	return s.store.RecordStaffAction(s.staffAction(r, action, target, transferId, reason))
+}
+
+func (s *ApiServer) staffAction(r *http.Request, action string, target int64, transferId int64, reason string) *StaffAction {
+	actor, _ := r.Context().Value("authorizedAccountNumber").(int64)
+	role, _ := r.Context().Value("role").(string)
+
+	return &StaffAction{
+		ActorNumber:  actor,
+		ActorRole:    role,
+		Action:       action,
+		TargetNumber: target,
+		TransferId:   transferId,
+		Reason:       reason,
+		CreatedAt:    time.Now().UTC(),
+	}
+}
+
+// accounts can always access their own data, anyone else needs permission
+// and a reason, which is recorded before any data is handed out. false means
+// the response has been written.
+func (s *ApiServer) authorizeAccountAccess(w http.ResponseWriter, r *http.Request, number int64, permission Permission, action string) (bool, error) {
+	authorizedAccountNumber, _ := r.Context().Value("authorizedAccountNumber").(int64)
+	if authorizedAccountNumber == number {
+		return true, nil
+	}
+
+	if !hasPermission(r, permission) {
+		return false, WriteJson(w, http.StatusForbidden, ApiError{Error: "permission denied"})
+	}
+
+	reason, err := actionReason(r)
+	if err != nil {
+		return false, WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+	}
+
+	if err := s.recordStaffAction(r, action, number, 0, reason); err != nil {
+		fmt.Println("Error recording staff action")
+		return false, WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return true, nil
+}
+
+// what the recipient got, in their currency. Reversals are counted in it.
+func receivedAmount(t *Transfer) uint64 {
+	if t.FX != nil {
+		return t.FX.Converted.Amount
+	}
+	return t.Amount
+}
+
+// takes amount back from the recipient. A cross-currency transfer is undone
+// at its original rate, a partial one refunds the same share of what was
+// sent, rounded down, so refunds never add up to more than the original.
+func reversalOf(t *Transfer, amount uint64) *Transfer {
+	reversal := &Transfer{
+		FromNumber: t.ToNumber,
+		ToNumber:   t.FromNumber,
+		Money:      Money{Amount: amount, Currency: t.Currency},
+		ReversalOf: t.Id,
+	}
+
+	if t.FX != nil {
+		refund := t.Money
+		if amount != t.FX.Converted.Amount {
+			share := new(big.Int).Mul(new(big.Int).SetUint64(t.Amount), new(big.Int).SetUint64(amount))
+			refund.Amount = share.Div(share, new(big.Int).SetUint64(t.FX.Converted.Amount)).Uint64()
+		}
+
+		reversal.Money = Money{Amount: amount, Currency: t.FX.Converted.Currency}
+		reversal.FX = &FXDetails{
+			Rate:      t.FX.Rate.inverse(),
+			Converted: refund,
+		}
+	}
+
+	return reversal
+}
+
+// a partial reversal of a cross-currency transfer can round down to nothing
+func bookable(t *Transfer) bool {
+	return t.Amount > 0 && (t.FX == nil || t.FX.Converted.Amount > 0)
+}
+
+// what is held on the recipient after a reversal of booked, asked for with
+// shortfall left unpaid. Whatever was booked pays the hold down, and under
+// the hold policy the shortfall stays held.
+func nextHold(held uint64, booked *Transfer, shortfall uint64, hold bool) uint64 {
+	if bookable(booked) {
+		held -= min(held, booked.Amount)
+	}
+	if hold {
+		held = max(held, shortfall)
+	}
+	return held
+}
+
+// reversals are counted in what the recipient got, reversed is the sum of
+// the ones booked so far
+func checkReversalAmount(reversal *Transfer, received uint64, reversed uint64) error {
+	switch {
+	case reversed >= received:
+		return fmt.Errorf("transfer %d: %w", reversal.ReversalOf, ErrTransferReversed)
+	case reversal.Amount > received-reversed:
+		return fmt.Errorf("transfer %d has %d left: %w", reversal.ReversalOf, received-reversed, ErrReversalTooLarge)
+	}
+
+	return nil
+}
+
+func parseReverseTransferRequest(r *http.Request) (*ReverseTransferRequest, error) {
+	req := new(ReverseTransferRequest)
+	// a full reversal doesn't need a body
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid request body")
+	}
+
+	switch req.Policy {
+	case "":
+		req.Policy = ReversalFail
+	case ReversalFail, ReversalHold:
+	default:
+		return nil, fmt.Errorf("policy must be fail or hold")
+	}
+
+	return req, nil
+}
+
+// moves the money of a transfer back with a new transfer, the original
+// stays in both histories. A transfer can be reversed in parts until all of
+// it has been.
+func (s *ApiServer) handleReverseTransfer(w http.ResponseWriter, r *http.Request) error {
+	parameter, err := getParameter(r, "id")
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid transfer id"})
+	}
+
+	id, err := strconv.ParseInt(parameter, 10, 64)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "invalid transfer id"})
+	}
+
+	reason, err := actionReason(r)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+	}
+
+	req, err := parseReverseTransferRequest(r)
+	if err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+	}
+	if req.Policy == ReversalHold && !hasPermission(r, PermTransfersHold) {
+		return WriteJson(w, http.StatusForbidden, ApiError{Error: fmt.Sprintf("permission denied: the hold policy needs %s", PermTransfersHold)})
+	}
+
+	original, err := s.store.GetTransfer(id)
+	if err != nil {
+		if errors.Is(err, ErrTransferNotFound) {
+			return WriteJson(w, http.StatusNotFound, ApiError{Error: "transfer not found"})
+		}
+		fmt.Println("Error retrieving transfer")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	if original.ReversalOf != 0 {
+		return WriteJson(w, http.StatusUnprocessableEntity, ApiError{Error: "a reversal can't be reversed"})
+	}
+
+	// the store checks this again while it holds the transfer
+	remaining := receivedAmount(original) - original.Reversed
+	if remaining == 0 {
+		return WriteJson(w, http.StatusConflict, ApiError{Error: "transfer has already been reversed"})
+	}
+
+	amount := req.Amount
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount > remaining {
+		return WriteJson(w, http.StatusUnprocessableEntity, ApiError{Error: fmt.Sprintf("only %d of the transfer is left to reverse", remaining)})
+	}
+
+	reversal := reversalOf(original, amount)
+	if !bookable(reversal) {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "amount is too small to refund"})
+	}
+
+	// under the hold policy the store takes what the recipient has and
+	// holds the rest on their account. The reason is recorded with the
+	// reversal so one can't happen without the other.
+	action := s.staffAction(r, staffActionReverseTransfer, original.ToNumber, original.Id, reason)
+	shortfall, err := s.store.ReverseTransfer(reversal, req.Policy == ReversalHold, action, s.auditEntry(r, auditTransferReverse))
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrTransferReversed):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "transfer has already been reversed"})
+		case errors.Is(err, ErrReversalReversed):
+			return WriteJson(w, http.StatusUnprocessableEntity, ApiError{Error: "a reversal can't be reversed"})
+		case errors.Is(err, ErrReversalTooLarge):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "the transfer has been reversed in the meantime, fetch it again"})
+		case errors.Is(err, ErrInsufficientFunds):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "the recipient no longer holds the funds"})
+		case errors.Is(err, ErrFundsHeld):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "the recipient's funds are held for another reversal"})
+		case errors.Is(err, ErrAccountNotFound), errors.Is(err, ErrAccountClosed):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "one of the accounts no longer exists"})
+		case errors.Is(err, ErrAccountFrozen):
+			return WriteJson(w, http.StatusConflict, ApiError{Error: "one of the accounts is frozen"})
+		}
+		fmt.Println("Error reversing transfer")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	resp := ReverseTransferResponse{
+		Shortfall: shortfall,
+		Held:      shortfall > 0,
+		Remaining: remaining - amount + shortfall,
+	}
+	if reversal.Id != 0 {
+		resp.Reversal = reversal
+	}
+	return WriteJson(w, http.StatusOK, resp)
+}
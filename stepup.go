@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	stepUpHeader   = "x-step-up-token"
+	stepUpAudience = "gobank-step-up"
+	// recorded on transfers that were below the threshold, the access token
+	// was enough
+	authFactorSession = "session"
+)
+
+// StepUpConfig makes transfers above Threshold (in minor units of the source
+// currency) need a password or totp code entered within the last Window.
+// A zero threshold turns step-up off.
+type StepUpConfig struct {
+	Threshold uint64   `json:"threshold"`
+	Window    Duration `json:"window"`
+}
+
+func defaultStepUpConfig() StepUpConfig {
+	return StepUpConfig{
+		Threshold: 1_000_000,
+		Window:    Duration(5 * time.Minute),
+	}
+}
+
+func (c StepUpConfig) required(amount uint64) bool {
+	return c.Threshold > 0 && amount > c.Threshold
+}
+
+// the factors an account can step up with, accounts with mfa have to use it
+func (s *ApiServer) stepUpMethods(number int64) ([]string, error) {
+	mfa, err := s.store.GetMFASecret(number)
+	if errors.Is(err, ErrMFANotEnrolled) {
+		return []string{authMethodPassword}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mfa.EnabledAt == nil {
+		return []string{authMethodPassword}, nil
+	}
+
+	return []string{authMethodOTP}, nil
+}
+
+// trades a password or code for a short lived step-up token, sent as
+// x-step-up-token with the transfer it was asked for
+func (s *ApiServer) handleStepUp(w http.ResponseWriter, r *http.Request) error {
+	number, _ := r.Context().Value("authorizedAccountNumber").(int64)
+
+	var req StepUpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+	}
+
+	// a stolen access token must not turn into a password oracle
+	ip := clientIP(r)
+	now := time.Now().UTC()
+	wait, err := s.loginBlocked(number, ip, now)
+	if err != nil {
+		fmt.Println("Error checking login attempts")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+	if wait > 0 {
+		return writeTooManyAttempts(w, wait)
+	}
+
+	methods, err := s.stepUpMethods(number)
+	if err != nil {
+		fmt.Println("Error retrieving mfa secret")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	var method string
+	switch {
+	case req.Code != "" && hasAuthMethod(methods, authMethodOTP):
+		method = authMethodOTP
+		err = s.checkTOTP(number, req.Code, now)
+	case req.Password != "" && hasAuthMethod(methods, authMethodPassword):
+		method = authMethodPassword
+		var acc *Account
+		acc, err = s.store.GetAccountByNumber(number)
+		if err == nil && acc.ValidatePassword(req.Password) != nil {
+			err = errInvalidMFAChallenge
+		}
+	default:
+		return WriteJson(w, http.StatusBadRequest, StepUpRequiredResponse{
+			Error:          "step-up needs one of the listed methods",
+			StepUpRequired: true,
+			Methods:        methods,
+		})
+	}
+	if err != nil {
+		if errors.Is(err, errInvalidMFAChallenge) {
+			s.recordLoginFailure(number, ip, now)
+			return WriteJson(w, http.StatusUnauthorized, ApiError{Error: "invalid credentials"})
+		}
+		fmt.Println("Error checking step-up credentials")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	tokenId, err := randomToken(16)
+	if err != nil {
+		fmt.Println("Error creating step-up token")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	expiresAt := now.Add(time.Duration(s.stepUp.Window))
+	token, err := s.keys.sign(&TokenClaims{
+		AuthMethods: []string{method},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.jwtIssuer,
+			Subject:   strconv.FormatInt(number, 10),
+			Audience:  jwt.ClaimStrings{stepUpAudience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        tokenId,
+		},
+	})
+	if err != nil {
+		fmt.Println("Error signing step-up token")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, StepUpResponse{
+		Token:      token,
+		AuthMethod: method,
+		ExpiresAt:  expiresAt,
+	})
+}
+
+// returns the factor that authorized a transfer of amount. An empty factor
+// with a nil error means the response has already been written.
+func (s *ApiServer) authorizeTransferAmount(w http.ResponseWriter, r *http.Request, amount uint64) (string, error) {
+	if !s.stepUp.required(amount) {
+		return authFactorSession, nil
+	}
+
+	number, _ := r.Context().Value("authorizedAccountNumber").(int64)
+	tokenString := r.Header.Get(stepUpHeader)
+	if tokenString == "" {
+		methods, err := s.stepUpMethods(number)
+		if err != nil {
+			return "", err
+		}
+		return "", WriteJson(w, http.StatusUnauthorized, StepUpRequiredResponse{
+			Error:          "transfers above the step-up threshold need a step-up token",
+			StepUpRequired: true,
+			Methods:        methods,
+		})
+	}
+
+	claims, err := s.parseJwt(tokenString, stepUpAudience)
+	if err != nil {
+		return "", WriteJson(w, http.StatusUnauthorized, ApiError{Error: "invalid step-up token"})
+	}
+
+	subject, err := claims.AccountNumber()
+	if err != nil || subject != number || len(claims.AuthMethods) != 1 {
+		return "", WriteJson(w, http.StatusUnauthorized, ApiError{Error: "invalid step-up token"})
+	}
+
+	// each step-up authorizes one transfer, even when two race
+	first, err := s.store.ConsumeToken(claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		return "", err
+	}
+	if !first {
+		return "", WriteJson(w, http.StatusUnauthorized, ApiError{Error: "step-up token has already been used"})
+	}
+
+	return claims.AuthMethods[0], nil
+}
@@ -3,19 +3,84 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/sethvargo/go-retry"
 )
 
+var (
+	ErrAccountNotFound    = errors.New("account not found")
+	ErrTransferNotFound   = errors.New("transfer not found")
+	ErrInsufficientFunds  = errors.New("insufficient funds")
+	ErrAccountNumberTaken = errors.New("could not find a free account number")
+)
+
+const maxAccountNumberAttempts = 5
+
 type Storage interface {
-	CreateAccount(*Account) error
-	DeleteAccount(int) error
-	TransferMoney(*Account, *Account, uint64) error
+	// the state-changing methods write the *AuditEntry in the same
+	// transaction, nil skips the audit log
+	CreateAccount(*Account, *AuditEntry) error
+	// checks acc.Version against the stored one and bumps it
+	UpdateAccount(*Account, *AuditEntry) error
+	SetAccountStatus(int64, AccountStatus, *AuditEntry) error
+	CloseAccount(int64, int64, *AuditEntry) (*Transfer, error)
+	TransferMoney(*Transfer, *AuditEntry) error
+	// books a reversal. When the recipient can't cover it and hold is set,
+	// what they have is taken back, the rest is held on their account and
+	// returned as the shortfall. The transfer is left without an id if
+	// nothing could be taken back. The staff action is recorded with it.
+	ReverseTransfer(*Transfer, bool, *StaffAction, *AuditEntry) (uint64, error)
+	// the transfer comes from or goes to the cash account. Withdraw fails
+	// with ErrWithdrawalLimit when the account's withdrawals over the last
+	// day would exceed the limit, 0 means no limit.
+	Deposit(*Transfer, *AuditEntry) error
+	Withdraw(*Transfer, uint64, *AuditEntry) error
+	GetAccountById(int) (*Account, error)
 	GetAccountByNumber(int64) (*Account, error)
-	GetAccounts() ([]*Account, error)
+	GetAccounts(AccountFilter) ([]*Account, error)
+	RecomputeBalance(int64) (uint64, error)
+	GetTransfers(TransferFilter) ([]*Transfer, error)
+	GetTransfer(int64) (*Transfer, error)
+	RecordStaffAction(*StaffAction) error
+	GetAuditLog(AuditFilter) ([]*AuditEntry, error)
+	ReserveIdempotencyKey(*IdempotencyRecord) (*IdempotencyRecord, error)
+	CompleteIdempotencyKey(*IdempotencyRecord) error
+	ReleaseIdempotencyKey(string) error
+	PurgeIdempotencyKeys(time.Time) (int64, error)
+	CreateFXQuote(*FXQuote) error
+	GetFXQuote(string) (*FXQuote, error)
+	CreateRefreshToken(*RefreshToken) error
+	RotateRefreshToken(string, *RefreshToken) (*RefreshToken, error)
+	RevokeRefreshToken(string) error
+	RevokeToken(string, time.Time) error
+	IsTokenRevoked(string) (bool, error)
+	ConsumeToken(string, time.Time) (bool, error)
+	SetPassword(int64, string, time.Time, *AuditEntry) error
+	RehashPassword(int64, string, string) error
+	CreatePasswordReset(*PasswordReset, *AuditEntry) error
+	// the audit entry's actor is the account when it is left at 0, the
+	// caller doesn't know whose token it is
+	ResetPassword(string, string, time.Time, *AuditEntry) (int64, error)
+	GetRole(string) (*Role, error)
+	GetRoles() ([]*Role, error)
+	SaveRole(*Role, *AuditEntry) error
+	DeleteRole(string, *AuditEntry) error
+	SetAccountRole(int64, string, *AuditEntry) error
+	PurgeExpiredTokens(time.Time) (int64, error)
+	GetLoginAttempts(string) (*LoginAttempts, error)
+	RecordLoginFailure(string, time.Time, time.Time) (*LoginAttempts, error)
+	ResetLoginAttempts(string, *AuditEntry) error
+	PurgeLoginAttempts(time.Time) (int64, error)
+	SaveMFASecret(*MFASecret, *AuditEntry) error
+	GetMFASecret(int64) (*MFASecret, error)
+	EnableMFA(int64, int64, *AuditEntry) error
+	UseMFAStep(int64, int64) error
 }
 
 // what other db could I use?
@@ -23,15 +88,27 @@ type PostgressStore struct {
 	db *sql.DB
 }
 
-func NewPostgressStore() (*PostgressStore, error) {
-	connStr := "user=postgres dbname=postgres password=gobank sslmode=disable"
+func NewPostgressStore(cfg DatabaseConfig) (*PostgressStore, error) {
+	connStr, err := cfg.ConnString()
+	if err != nil {
+		return nil, err
+	}
+
 	db, err := sql.Open("postgres", connStr)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if pingErr := db.Ping(); pingErr != nil {
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.IdleConns())
+	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetime))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.PingTimeout))
+	defer cancel()
+
+	if pingErr := db.PingContext(ctx); pingErr != nil {
+		db.Close()
 		return nil, pingErr
 	}
 
@@ -40,68 +117,296 @@ func NewPostgressStore() (*PostgressStore, error) {
 	}, nil
 }
 
-func (s *PostgressStore) Init() error {
-	return s.createAccountTable()
+// the schema is managed by the embedded migrations, see migrate.go
+func (s *PostgressStore) Migrator() (*Migrator, error) {
+	return NewMigrator(s.db)
 }
 
-func (s *PostgressStore) createAccountTable() error {
-	query := `CREATE TABLE IF NOT EXISTS account (
-                  id SERIAL PRIMARY KEY,
-                  first_name VARCHAR(50),
-                  last_name VARCHAR(50),
-                  number BIGINT,
-                  encrypted_password VARCHAR(100),
-                  balance BIGINT,
-                  role VARCHAR(100),
-                  created_at timestamp DEFAULT NOW()
-           )`
-	_, err := s.db.Exec(query)
-	return err
-}
+// if acc.Number is already taken a fresh number is generated, up to
+// maxAccountNumberAttempts times
+func (s *PostgressStore) CreateAccount(acc *Account, audit *AuditEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if acc.Currency == "" {
+		acc.Currency = DefaultCurrency
+	}
+	if acc.Status == "" {
+		acc.Status = AccountActive
+	}
 
-func (s *PostgressStore) CreateAccount(acc *Account) error {
 	query := `INSERT INTO account
-                   (first_name, last_name, number, encrypted_password, balance, role, created_at)
+                   (first_name, last_name, number, encrypted_password, balance, currency, role, created_at, status)
                    VALUES
-                   ($1, $2, $3, $4, $5, $6, $7)
-                   RETURNING ID`
+                   ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+                   ON CONFLICT (number) DO NOTHING
+                   RETURNING id, version`
+
+	for attempt := 1; ; attempt++ {
+		err = tx.QueryRow(query, acc.FirstName,
+			acc.LastName, acc.Number, acc.EncryptedPassword,
+			acc.Balance, acc.Currency, acc.Role, acc.CreatedAt, acc.Status).Scan(&acc.Id, &acc.Version)
+		if err == nil {
+			break
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("role %q: %w", acc.Role, ErrRoleNotFound)
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
 
-	err := s.db.QueryRow(query, acc.FirstName,
-		acc.LastName, acc.Number, acc.EncryptedPassword,
-		acc.Balance, acc.Role, acc.CreatedAt).Scan(&acc.Id)
+		if attempt == maxAccountNumberAttempts {
+			return ErrAccountNumberTaken
+		}
 
-	return err
+		if acc.Number, err = generateAccountNumber(); err != nil {
+			return err
+		}
+	}
+
+	if acc.Balance > 0 {
+		opening := Money{Amount: acc.Balance, Currency: acc.Currency}
+		_, err := postJournal(context.Background(), tx, []LedgerEntry{
+			{AccountNumber: openingBalanceAccountNumber, Direction: Debit, Money: opening},
+			{AccountNumber: acc.Number, Direction: Credit, Money: opening},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to book opening balance: %w", err)
+		}
+	}
+
+	if audit != nil {
+		audit.Target = accountTarget(acc.Number)
+		audit.After = snapshot(acc)
+		if err := appendAudit(context.Background(), tx, audit); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return tx.Commit()
 }
 
-func (s *PostgressStore) DeleteAccount(id int) error {
-	result, err := s.db.Exec("DELETE FROM ACCOUNT WHERE ID = $1", id)
+func (s *PostgressStore) UpdateAccount(acc *Account, audit *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stored, err := lockFullAccount(ctx, tx, acc.Number)
 	if err != nil {
 		return err
 	}
+	if stored.Version != acc.Version {
+		return fmt.Errorf("account %d is at version %d: %w", acc.Number, stored.Version, ErrVersionConflict)
+	}
+	if stored.Status == AccountClosed {
+		return fmt.Errorf("account %d: %w", acc.Number, ErrAccountClosed)
+	}
 
-	rowsAffected, err := result.RowsAffected()
+	query := `UPDATE account
+                  SET first_name = $2, last_name = $3, role = $4, status = $5, version = version + 1
+                  WHERE number = $1`
+	_, err = tx.ExecContext(ctx, query, acc.Number, acc.FirstName, acc.LastName, acc.Role, acc.Status)
+	if isForeignKeyViolation(err) {
+		return fmt.Errorf("role %q: %w", acc.Role, ErrRoleNotFound)
+	}
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("Could not delete account with id=%d", id)
+	// everything else stays as it is stored
+	updated := *stored
+	updated.FirstName, updated.LastName, updated.Role, updated.Status = acc.FirstName, acc.LastName, acc.Role, acc.Status
+	updated.Version++
+
+	if audit != nil {
+		audit.Target = accountTarget(acc.Number)
+		audit.Before = snapshot(stored)
+		audit.After = snapshot(&updated)
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	*acc = updated
+	return nil
+}
+
+func (s *PostgressStore) SetAccountStatus(number int64, status AccountStatus, audit *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	acc, err := lockFullAccount(ctx, tx, number)
+	if err != nil {
+		return err
+	}
+	if acc.Status == AccountClosed {
+		return fmt.Errorf("account %d: %w", number, ErrAccountClosed)
+	}
+
+	before := *acc
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE account SET status = $2, version = version + 1 WHERE number = $1", number, status); err != nil {
+		return err
+	}
+	acc.Status = status
+	acc.Version++
+
+	if audit != nil {
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(&before)
+		audit.After = snapshot(acc)
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// pays out the balance, marks the account closed and ends its sessions in a
+// single transaction
+func (s *PostgressStore) CloseAccount(number int64, payoutNumber int64, audit *AuditEntry) (*Transfer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// same lock order as transfers
+	locked := map[int64]*Account{}
+	numbers := []int64{number}
+	if payoutNumber != 0 && payoutNumber != number {
+		numbers = lockOrder(number, payoutNumber)
+	}
+	for _, n := range numbers {
+		acc, err := lockFullAccount(ctx, tx, n)
+		if errors.Is(err, ErrAccountNotFound) && n == payoutNumber {
+			return nil, fmt.Errorf("account %d: %w", n, ErrInvalidPayoutAccount)
+		}
+		if err != nil {
+			return nil, err
+		}
+		locked[n] = acc
+	}
+
+	acc := locked[number]
+	if acc.Status == AccountClosed {
+		return nil, fmt.Errorf("account %d: %w", number, ErrAccountClosed)
+	}
+	before := *acc
+
+	var payout *Account
+	if payoutNumber != 0 {
+		payout = locked[payoutNumber]
+	}
+	if payoutNumber == number {
+		payout = acc
+	}
+
+	transfer, err := payoutTransfer(acc, payout)
+	if err != nil {
+		return nil, err
+	}
+
+	if transfer != nil {
+		journalId, err := postJournal(ctx, tx, transferEntries(transfer))
+		if err != nil {
+			return nil, fmt.Errorf("failed to write ledger entries: %w", err)
+		}
+		if _, err := refreshBalance(ctx, tx, transfer.FromNumber); err != nil {
+			return nil, fmt.Errorf("failed to update closed account: %w", err)
+		}
+		if _, err := refreshBalance(ctx, tx, transfer.ToNumber); err != nil {
+			return nil, fmt.Errorf("failed to update payout account: %w", err)
+		}
+
+		createdAt, err := insertTransfer(ctx, tx, journalId, transfer)
+		if err != nil {
+			return nil, err
+		}
+		transfer.Id, transfer.Status, transfer.CreatedAt = journalId, TransferCompleted, createdAt
+	}
+
+	closedAt := time.Now().UTC()
+	_, err = tx.ExecContext(ctx,
+		"UPDATE account SET status = $2, closed_at = $3, version = version + 1 WHERE number = $1",
+		number, AccountClosed, closedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE refresh_token SET revoked_at = $2 WHERE account_number = $1 AND revoked_at IS NULL",
+		number, closedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if audit != nil {
+		after := *acc
+		after.Balance, after.Status, after.ClosedAt, after.Version = 0, AccountClosed, &closedAt, acc.Version+1
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(closeSnapshot{Account: &before})
+		audit.After = snapshot(closeSnapshot{Account: &after, Payout: transfer})
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return nil, fmt.Errorf("failed to write audit log: %w", err)
+		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return transfer, nil
+}
+
+// locks both accounts, checks the balance and books the journal in a single
+// transaction. The caller fills in FromNumber, ToNumber and Amount, the rest
+// of the transfer is set once it commits.
+func (s *PostgressStore) TransferMoney(transfer *Transfer, audit *AuditEntry) error {
+	_, err := s.transferMoney(transfer, false, nil, audit)
 	return err
 }
 
-func (s *PostgressStore) TransferMoney(fromAcc *Account, toAcc *Account, amount uint64) error {
+func (s *PostgressStore) ReverseTransfer(reversal *Transfer, hold bool, action *StaffAction, audit *AuditEntry) (uint64, error) {
+	return s.transferMoney(reversal, hold, action, audit)
+}
+
+// hold and action only matter for reversals, see ReverseTransfer
+func (s *PostgressStore) transferMoney(transfer *Transfer, hold bool, action *StaffAction, audit *AuditEntry) (uint64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	b := retry.NewFibonacci(10 * time.Millisecond)
 	b = retry.WithMaxDuration(5*time.Second, b)
 
+	var shortfall uint64
 	err := retry.Do(ctx, retry.WithMaxRetries(3, b), func(ctx context.Context) error {
 		tx, err := s.db.BeginTx(ctx, nil)
 		if err != nil {
-			return fmt.Errorf("failed to begin transaction: %w", err)
+			return retryable(fmt.Errorf("failed to begin transaction: %w", err))
 		}
 
 		// Attempt to execute operations within transaction
@@ -113,73 +418,973 @@ func (s *PostgressStore) TransferMoney(fromAcc *Account, toAcc *Account, amount
 			}
 		}()
 
-		// Update first account
-		firstAccBalanceUpdate := fromAcc.Balance - amount
-		_, err = tx.ExecContext(ctx,
-			"UPDATE ACCOUNT SET balance = $1 WHERE number = $2",
-			firstAccBalanceUpdate, fromAcc.Number)
-		if err != nil {
-			return fmt.Errorf("failed to update source account: %w", err)
+		// always lock the lower account number first so two transfers
+		// going in opposite directions can't deadlock
+		locked := map[int64]*lockedAccount{}
+		for _, number := range lockOrder(transfer.FromNumber, transfer.ToNumber) {
+			acc, err := lockAccount(ctx, tx, number)
+			if err != nil {
+				return retryable(err)
+			}
+			locked[number] = acc
+		}
+
+		from, to := locked[transfer.FromNumber], locked[transfer.ToNumber]
+		if err := checkTransferable(from.Status, to.Status); err != nil {
+			return err
+		}
+
+		if err := checkTransferCurrency(transfer, from.Currency, to.Currency); err != nil {
+			return err
+		}
+
+		// a reversal may come out smaller than asked for, the caller's
+		// transfer is only updated once it commits
+		booked := transfer
+		var original *Transfer
+		if transfer.ReversalOf != 0 {
+			if original, err = checkReversible(ctx, tx, transfer); err != nil {
+				return retryable(err)
+			}
 		}
 
-		secondAccBalanceUpdate := toAcc.Balance + amount
-		_, err = tx.ExecContext(ctx,
-			"UPDATE ACCOUNT SET balance = $1 WHERE number = $2",
-			secondAccBalanceUpdate, toAcc.Number)
+		// money held back for a reversal can only leave through that
+		// reversal
+		held, err := heldAmount(ctx, tx, transfer.FromNumber, transfer.ReversalOf)
 		if err != nil {
-			return fmt.Errorf("failed to update destination account: %w", err)
+			return retryable(err)
+		}
+
+		shortfall = 0
+		available := from.Balance - min(from.Balance, held)
+		if available < transfer.Amount {
+			switch {
+			case (!hold || original == nil) && from.Balance < transfer.Amount:
+				return ErrInsufficientFunds
+			case !hold || original == nil:
+				return ErrFundsHeld
+			}
+			shortfall = transfer.Amount - available
+			booked = reversalOf(original, available)
+			if !bookable(booked) {
+				shortfall = transfer.Amount
+			}
+		}
+
+		if transfer.FX != nil && transfer.FX.QuoteId != "" {
+			if err := useFXQuote(ctx, tx, transfer.FX.QuoteId); err != nil {
+				return retryable(err)
+			}
+		}
+
+		var journalId int64
+		var createdAt time.Time
+		fromBalance, toBalance := from.Balance, to.Balance
+		if bookable(booked) {
+			journalId, err = postJournal(ctx, tx, transferEntries(booked))
+			if err != nil {
+				return retryable(fmt.Errorf("failed to write ledger entries: %w", err))
+			}
+
+			fromBalance, err = refreshBalance(ctx, tx, booked.FromNumber)
+			if err != nil {
+				return retryable(fmt.Errorf("failed to update source account: %w", err))
+			}
+
+			toBalance, err = refreshBalance(ctx, tx, booked.ToNumber)
+			if err != nil {
+				return retryable(fmt.Errorf("failed to update destination account: %w", err))
+			}
+
+			createdAt, err = insertTransfer(ctx, tx, journalId, booked)
+			if err != nil {
+				return retryable(err)
+			}
+		}
+
+		var stillHeld uint64
+		if original != nil {
+			if stillHeld, err = updateReversalHold(ctx, tx, original, booked, shortfall, hold); err != nil {
+				return retryable(fmt.Errorf("failed to update reversal hold: %w", err))
+			}
+		}
+
+		if action != nil {
+			if err := insertStaffAction(ctx, tx, action); err != nil {
+				return retryable(fmt.Errorf("failed to record staff action: %w", err))
+			}
+		}
+
+		if audit != nil {
+			recorded := *booked
+			recorded.Id, recorded.Status, recorded.CreatedAt = journalId, TransferCompleted, createdAt
+			audit.Target = transferTarget(journalId)
+			if journalId == 0 {
+				audit.Target = transferTarget(original.Id)
+			}
+			audit.Before = snapshot(transferSnapshot{Balances: map[int64]uint64{
+				transfer.FromNumber: from.Balance,
+				transfer.ToNumber:   to.Balance,
+			}})
+			after := transferSnapshot{Balances: map[int64]uint64{
+				transfer.FromNumber: fromBalance,
+				transfer.ToNumber:   toBalance,
+			}, Held: stillHeld}
+			if journalId != 0 {
+				after.Transfer = &recorded
+			}
+			audit.After = snapshot(after)
+			if err := appendAudit(ctx, tx, audit); err != nil {
+				return retryable(fmt.Errorf("failed to write audit log: %w", err))
+			}
 		}
 
 		// Commit transaction
 		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("failed to commit transaction: %w", err)
+			return retryable(fmt.Errorf("failed to commit transaction: %w", err))
 		}
 
 		committed = true
+		if booked != transfer {
+			*transfer = *booked
+		}
+		transfer.Id = journalId
+		transfer.Status = TransferCompleted
+		transfer.CreatedAt = createdAt
 		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("transfer failed after retries: %w", err)
+		return 0, fmt.Errorf("transfer failed: %w", err)
 	}
-	return nil
+	return shortfall, nil
 }
 
-func (s *PostgressStore) GetAccountByNumber(number int64) (*Account, error) {
-	rows, err := s.db.Query("SELECT * FROM ACCOUNT WHERE NUMBER = $1", number)
+// what the recipient of reversals still owes, on top of what it holds.
+// except leaves out the hold of the transfer being reversed.
+func heldAmount(ctx context.Context, tx *sql.Tx, number int64, except int64) (uint64, error) {
+	var held uint64
+	err := tx.QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(amount), 0) FROM reversal_hold WHERE account_number = $1 AND transfer_id <> $2",
+		number, except).Scan(&held)
+	return held, err
+}
+
+// a reversal under the hold policy leaves its shortfall behind as the hold,
+// any other reversal pays the hold down. Returns what is still held.
+func updateReversalHold(ctx context.Context, tx *sql.Tx, original *Transfer, booked *Transfer, shortfall uint64, hold bool) (uint64, error) {
+	var held uint64
+	err := tx.QueryRowContext(ctx,
+		"SELECT amount FROM reversal_hold WHERE transfer_id = $1", original.Id).Scan(&held)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	held = nextHold(held, booked, shortfall, hold)
+	if held == 0 {
+		_, err = tx.ExecContext(ctx, "DELETE FROM reversal_hold WHERE transfer_id = $1", original.Id)
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO reversal_hold (transfer_id, account_number, amount) VALUES ($1, $2, $3)
+                 ON CONFLICT (transfer_id) DO UPDATE SET amount = EXCLUDED.amount`,
+		original.Id, original.ToNumber, held)
+	return held, err
+}
+
+func (s *PostgressStore) Deposit(transfer *Transfer, audit *AuditEntry) error {
+	return s.moveCash(transfer, transfer.ToNumber, 0, audit)
+}
+
+func (s *PostgressStore) Withdraw(transfer *Transfer, dailyLimit uint64, audit *AuditEntry) error {
+	return s.moveCash(transfer, transfer.FromNumber, dailyLimit, audit)
+}
+
+// books a deposit or withdrawal against the cash account, which like the
+// other system accounts only lives in the ledger
+func (s *PostgressStore) moveCash(transfer *Transfer, number int64, dailyLimit uint64, audit *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	b := retry.NewFibonacci(10 * time.Millisecond)
+	b = retry.WithMaxDuration(5*time.Second, b)
+
+	withdrawal := transfer.FromNumber == number
+
+	err := retry.Do(ctx, retry.WithMaxRetries(3, b), func(ctx context.Context) error {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return retryable(fmt.Errorf("failed to begin transaction: %w", err))
+		}
+
+		committed := false
+		defer func() {
+			if !committed {
+				tx.Rollback()
+			}
+		}()
+
+		acc, err := lockAccount(ctx, tx, number)
+		if err != nil {
+			return retryable(err)
+		}
+		if err := checkTransferable(acc.Status, AccountActive); err != nil {
+			return err
+		}
+		if acc.Currency != transfer.Currency {
+			return fmt.Errorf("account holds %s: %w", acc.Currency, ErrCurrencyMismatch)
+		}
+
+		if withdrawal {
+			if acc.Balance < transfer.Amount {
+				return ErrInsufficientFunds
+			}
+
+			held, err := heldAmount(ctx, tx, number, 0)
+			if err != nil {
+				return retryable(err)
+			}
+			if transfer.Amount+held > acc.Balance {
+				return ErrFundsHeld
+			}
+
+			// the row lock keeps two withdrawals from both fitting under
+			// the limit
+			if dailyLimit > 0 {
+				var withdrawn uint64
+				err := tx.QueryRowContext(ctx,
+					`SELECT COALESCE(SUM(amount), 0) FROM transfer
+                     WHERE from_number = $1 AND to_number = $2 AND created_at >= NOW() - $3 * INTERVAL '1 second'`,
+					number, cashAccountNumber, int64(withdrawalLimitWindow.Seconds())).Scan(&withdrawn)
+				if err != nil {
+					return retryable(fmt.Errorf("failed to sum withdrawals: %w", err))
+				}
+				if withdrawn+transfer.Amount > dailyLimit {
+					return ErrWithdrawalLimit
+				}
+			}
+		}
+
+		journalId, err := postJournal(ctx, tx, transferEntries(transfer))
+		if err != nil {
+			return retryable(fmt.Errorf("failed to write ledger entries: %w", err))
+		}
+
+		balance, err := refreshBalance(ctx, tx, number)
+		if err != nil {
+			return retryable(fmt.Errorf("failed to update account: %w", err))
+		}
+
+		createdAt, err := insertTransfer(ctx, tx, journalId, transfer)
+		if err != nil {
+			return retryable(err)
+		}
+
+		if audit != nil {
+			recorded := *transfer
+			recorded.Id, recorded.Status, recorded.CreatedAt = journalId, TransferCompleted, createdAt
+			audit.Target = accountTarget(number)
+			audit.Before = snapshot(transferSnapshot{Balances: map[int64]uint64{number: acc.Balance}})
+			audit.After = snapshot(transferSnapshot{Transfer: &recorded, Balances: map[int64]uint64{number: balance}})
+			if err := appendAudit(ctx, tx, audit); err != nil {
+				return retryable(fmt.Errorf("failed to write audit log: %w", err))
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return retryable(fmt.Errorf("failed to commit transaction: %w", err))
+		}
+
+		committed = true
+		transfer.Id = journalId
+		transfer.Status = TransferCompleted
+		transfer.CreatedAt = createdAt
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("cash movement failed: %w", err)
 	}
-	defer rows.Close()
+	return nil
+}
 
-	for rows.Next() {
-		return scanIntoAccount(rows)
+// appends to the hash chain, the advisory lock is held until the transaction
+// ends so nobody else can read the same previous hash
+func appendAudit(ctx context.Context, tx *sql.Tx, entry *AuditEntry) error {
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", auditLockId); err != nil {
+		return err
+	}
+
+	var prevHash string
+	err := tx.QueryRowContext(ctx, "SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1").Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	entry.seal(prevHash)
+	return tx.QueryRowContext(ctx,
+		`INSERT INTO audit_log (actor_number, actor_role, action, target, request_id,
+                                before_state, after_state, ip, created_at, prev_hash, hash)
+                 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+                 RETURNING id`,
+		entry.ActorNumber, entry.ActorRole, entry.Action, entry.Target, entry.RequestId,
+		nullableJSON(entry.Before), nullableJSON(entry.After), entry.IP, entry.CreatedAt,
+		entry.PrevHash, entry.Hash).Scan(&entry.Id)
+}
+
+// snapshots are stored as text, jsonb would reorder keys and break the hash
+func nullableJSON(b json.RawMessage) sql.NullString {
+	return sql.NullString{String: string(b), Valid: len(b) > 0}
+}
+
+// writes the transfer row for a journal that has been posted
+func insertTransfer(ctx context.Context, tx *sql.Tx, journalId int64, transfer *Transfer) (time.Time, error) {
+	var fxRate, convertedAmount sql.NullInt64
+	var convertedCurrency, quoteId sql.NullString
+	if transfer.FX != nil {
+		fxRate = sql.NullInt64{Int64: int64(transfer.FX.Rate), Valid: true}
+		convertedAmount = sql.NullInt64{Int64: int64(transfer.FX.Converted.Amount), Valid: true}
+		convertedCurrency = sql.NullString{String: string(transfer.FX.Converted.Currency), Valid: true}
+		quoteId = sql.NullString{String: transfer.FX.QuoteId, Valid: transfer.FX.QuoteId != ""}
+	}
+
+	authFactor := sql.NullString{String: transfer.AuthFactor, Valid: transfer.AuthFactor != ""}
+	reversalOf := sql.NullInt64{Int64: transfer.ReversalOf, Valid: transfer.ReversalOf != 0}
+	reasonCode := sql.NullString{String: transfer.ReasonCode, Valid: transfer.ReasonCode != ""}
+
+	var createdAt time.Time
+	err := tx.QueryRowContext(ctx,
+		`INSERT INTO transfer (id, from_number, to_number, amount, currency, status,
+                                 fx_rate, converted_amount, converted_currency, fx_quote_id, auth_factor, reversal_of,
+                                 reason_code)
+                         VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+                         RETURNING created_at`,
+		journalId, transfer.FromNumber, transfer.ToNumber, transfer.Amount, transfer.Currency,
+		TransferCompleted, fxRate, convertedAmount, convertedCurrency, quoteId, authFactor, reversalOf,
+		reasonCode).Scan(&createdAt)
+	// reversal_of references the reversed transfer
+	if isForeignKeyViolation(err) {
+		return createdAt, fmt.Errorf("transfer %d: %w", transfer.ReversalOf, ErrTransferNotFound)
+	}
+	if err != nil {
+		return createdAt, fmt.Errorf("failed to record transfer: %w", err)
 	}
 
-	return nil, fmt.Errorf("account number not found for number %d", number)
+	return createdAt, nil
 }
 
-func (s *PostgressStore) GetAccounts() ([]*Account, error) {
-	rows, err := s.db.Query("SELECT * FROM ACCOUNT")
+// locking the original makes partial reversals of the same transfer wait for
+// each other, so together they can't take back more than it moved. Returns
+// the original.
+func checkReversible(ctx context.Context, tx *sql.Tx, reversal *Transfer) (*Transfer, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx,
+		"SELECT id FROM transfer WHERE id = $1 FOR UPDATE", reversal.ReversalOf).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("transfer %d: %w", reversal.ReversalOf, ErrTransferNotFound)
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	accounts := []*Account{}
-	for rows.Next() {
-		account, error := scanIntoAccount(rows)
+	rows, err := tx.QueryContext(ctx, "SELECT "+transferColumns+" FROM transfer WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		if error != nil {
-			return nil, error
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
 		}
-
-		accounts = append(accounts, account)
+		return nil, fmt.Errorf("transfer %d: %w", reversal.ReversalOf, ErrTransferNotFound)
+	}
+	original, err := scanIntoTransfer(rows)
+	if err != nil {
+		return nil, err
+	}
+	if original.ReversalOf != 0 {
+		return nil, fmt.Errorf("transfer %d: %w", reversal.ReversalOf, ErrReversalReversed)
 	}
 
-	return accounts, nil
+	return original, checkReversalAmount(reversal, receivedAmount(original), original.Reversed)
 }
 
-func scanIntoAccount(rows *sql.Rows) (*Account, error) {
+func lockOrder(a, b int64) []int64 {
+	if a < b {
+		return []int64{a, b}
+	}
+	return []int64{b, a}
+}
+
+// the columns of a locked row that decide whether money may move
+type lockedAccount struct {
+	Balance  uint64
+	Currency Currency
+	Status   AccountStatus
+}
+
+func lockAccount(ctx context.Context, tx *sql.Tx, number int64) (*lockedAccount, error) {
+	acc := new(lockedAccount)
+	err := tx.QueryRowContext(ctx,
+		"SELECT balance, currency, status FROM account WHERE number = $1 FOR UPDATE", number).Scan(
+		&acc.Balance, &acc.Currency, &acc.Status)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+	}
+
+	return acc, err
+}
+
+// for changes that need the whole row, like snapshots for the audit log
+func lockFullAccount(ctx context.Context, tx *sql.Tx, number int64) (*Account, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT "+accountColumns+" FROM account WHERE number = $1 FOR UPDATE", number)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		return scanIntoAccount(rows)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+}
+
+// only serialization failures and deadlocks are worth another attempt,
+// everything else goes straight back to the caller
+func retryable(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", "40P01":
+			return retry.RetryableError(err)
+		}
+	}
+
+	return err
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+func (s *PostgressStore) GetAccountById(id int) (*Account, error) {
+	rows, err := s.db.Query("SELECT "+accountColumns+" FROM account WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoAccount(rows)
+	}
+
+	return nil, fmt.Errorf("account not found for id %d: %w", id, ErrAccountNotFound)
+}
+
+func (s *PostgressStore) GetAccountByNumber(number int64) (*Account, error) {
+	rows, err := s.db.Query("SELECT "+accountColumns+" FROM ACCOUNT WHERE NUMBER = $1", number)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoAccount(rows)
+	}
+
+	return nil, fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+}
+
+// LIKE treats these as wildcards, names are matched literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *PostgressStore) GetAccounts(filter AccountFilter) ([]*Account, error) {
+	args := []any{}
+	where := "TRUE"
+
+	if filter.Role != "" {
+		args = append(args, filter.Role)
+		where += fmt.Sprintf(" AND role = $%d", len(args))
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		where += fmt.Sprintf(" AND status = $%d", len(args))
+	}
+	if !filter.CreatedFrom.IsZero() {
+		args = append(args, filter.CreatedFrom)
+		where += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !filter.CreatedTo.IsZero() {
+		args = append(args, filter.CreatedTo)
+		where += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+	if filter.MinBalance > 0 {
+		args = append(args, filter.MinBalance)
+		where += fmt.Sprintf(" AND balance >= $%d", len(args))
+	}
+	if filter.MaxBalance != nil {
+		args = append(args, *filter.MaxBalance)
+		where += fmt.Sprintf(" AND balance <= $%d", len(args))
+	}
+	if filter.NamePrefix != "" {
+		args = append(args, likeEscaper.Replace(filter.NamePrefix)+"%")
+		where += fmt.Sprintf(" AND (first_name ILIKE $%d OR last_name ILIKE $%d)", len(args), len(args))
+	}
+
+	// the column names come from the AccountSort constants, never the request
+	column, direction, compare := string(SortCreatedAt), "ASC", ">"
+	switch filter.Sort {
+	case SortBalance, SortLastName, SortNumber:
+		column = string(filter.Sort)
+	}
+	if filter.Descending {
+		direction, compare = "DESC", "<"
+	}
+
+	if filter.After != nil {
+		args = append(args, accountSortKey(filter.After, filter.Sort), filter.After.Id)
+		where += fmt.Sprintf(" AND (%s, id) %s ($%d, $%d)", column, compare, len(args)-1, len(args))
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM account WHERE %s ORDER BY %s %s, id %s",
+		accountColumns, where, column, direction, direction)
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	return accounts, rows.Err()
+}
+
+func (s *PostgressStore) RecomputeBalance(number int64) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	balance, err := refreshBalance(ctx, tx, number)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return balance, nil
+}
+
+func (s *PostgressStore) GetTransfers(filter TransferFilter) ([]*Transfer, error) {
+	args := []any{filter.AccountNumber}
+	var where string
+	switch filter.Direction {
+	case DirectionIncoming:
+		where = "to_number = $1"
+	case DirectionOutgoing:
+		where = "from_number = $1"
+	default:
+		where = "(from_number = $1 OR to_number = $1)"
+	}
+
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		where += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		where += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+	if filter.BeforeId > 0 {
+		args = append(args, filter.BeforeId)
+		where += fmt.Sprintf(" AND id < $%d", len(args))
+	}
+
+	query := "SELECT " + transferColumns + " FROM transfer WHERE " + where + " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []*Transfer{}
+	for rows.Next() {
+		t, err := scanIntoTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		transfers = append(transfers, t)
+	}
+
+	return transfers, rows.Err()
+}
+
+func (s *PostgressStore) GetTransfer(id int64) (*Transfer, error) {
+	rows, err := s.db.Query("SELECT "+transferColumns+" FROM transfer WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		return scanIntoTransfer(rows)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("transfer %d: %w", id, ErrTransferNotFound)
+}
+
+func (s *PostgressStore) RecordStaffAction(action *StaffAction) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertStaffAction(ctx, tx, action); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// staff actions that change something are written in the same transaction
+// as the change
+func insertStaffAction(ctx context.Context, tx *sql.Tx, action *StaffAction) error {
+	target := sql.NullInt64{Int64: action.TargetNumber, Valid: action.TargetNumber != 0}
+	transferId := sql.NullInt64{Int64: action.TransferId, Valid: action.TransferId != 0}
+
+	return tx.QueryRowContext(ctx,
+		`INSERT INTO staff_action (actor_number, actor_role, action, target_number, transfer_id, reason, created_at)
+                 VALUES ($1, $2, $3, $4, $5, $6, $7)
+                 RETURNING id`,
+		action.ActorNumber, action.ActorRole, action.Action, target, transferId, action.Reason, action.CreatedAt).Scan(&action.Id)
+}
+
+func (s *PostgressStore) GetAuditLog(filter AuditFilter) ([]*AuditEntry, error) {
+	args := []any{}
+	where := "TRUE"
+	if filter.ActorNumber != 0 {
+		args = append(args, filter.ActorNumber)
+		where += fmt.Sprintf(" AND actor_number = $%d", len(args))
+	}
+	if filter.Action != "" {
+		args = append(args, filter.Action)
+		where += fmt.Sprintf(" AND action = $%d", len(args))
+	}
+	if filter.Target != "" {
+		args = append(args, filter.Target)
+		where += fmt.Sprintf(" AND target = $%d", len(args))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		where += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		where += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+	if filter.BeforeId > 0 {
+		args = append(args, filter.BeforeId)
+		where += fmt.Sprintf(" AND id < $%d", len(args))
+	}
+
+	query := `SELECT id, actor_number, actor_role, action, target, request_id,
+                         before_state, after_state, ip, created_at, prev_hash, hash
+                  FROM audit_log WHERE ` + where + " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		e := new(AuditEntry)
+		var before, after sql.NullString
+		err := rows.Scan(&e.Id, &e.ActorNumber, &e.ActorRole, &e.Action, &e.Target, &e.RequestId,
+			&before, &after, &e.IP, &e.CreatedAt, &e.PrevHash, &e.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// claims the key for rec. If an unexpired record already holds the key it is
+// returned instead and nothing is written.
+func (s *PostgressStore) ReserveIdempotencyKey(rec *IdempotencyRecord) (*IdempotencyRecord, error) {
+	var key string
+	err := s.db.QueryRow(
+		`INSERT INTO idempotency_key (key, request_hash, created_at, expires_at)
+                 VALUES ($1, $2, $3, $4)
+                 ON CONFLICT (key) DO UPDATE SET
+                         request_hash = EXCLUDED.request_hash,
+                         status_code = 0,
+                         response_body = '',
+                         created_at = EXCLUDED.created_at,
+                         expires_at = EXCLUDED.expires_at
+                 WHERE idempotency_key.expires_at <= EXCLUDED.created_at
+                 RETURNING key`,
+		rec.Key, rec.RequestHash, rec.CreatedAt, rec.ExpiresAt).Scan(&key)
+	if err == nil {
+		return nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	existing := new(IdempotencyRecord)
+	err = s.db.QueryRow(
+		`SELECT key, request_hash, status_code, response_body, created_at, expires_at
+                 FROM idempotency_key WHERE key = $1`, rec.Key).Scan(
+		&existing.Key,
+		&existing.RequestHash,
+		&existing.StatusCode,
+		&existing.ResponseBody,
+		&existing.CreatedAt,
+		&existing.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return existing, nil
+}
+
+func (s *PostgressStore) CompleteIdempotencyKey(rec *IdempotencyRecord) error {
+	_, err := s.db.Exec(
+		"UPDATE idempotency_key SET status_code = $1, response_body = $2 WHERE key = $3",
+		rec.StatusCode, rec.ResponseBody, rec.Key)
+	return err
+}
+
+func (s *PostgressStore) ReleaseIdempotencyKey(key string) error {
+	_, err := s.db.Exec("DELETE FROM idempotency_key WHERE key = $1", key)
+	return err
+}
+
+func (s *PostgressStore) PurgeIdempotencyKeys(now time.Time) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM idempotency_key WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (s *PostgressStore) CreateFXQuote(q *FXQuote) error {
+	_, err := s.db.Exec(
+		`INSERT INTO fx_quote (id, from_number, to_number, amount, currency, rate,
+                                       converted_amount, converted_currency, created_at, expires_at)
+                 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		q.Id, q.FromNumber, q.ToNumber, q.Amount, q.Currency, q.Rate,
+		q.Converted.Amount, q.Converted.Currency, q.CreatedAt, q.ExpiresAt)
+	return err
+}
+
+func (s *PostgressStore) GetFXQuote(id string) (*FXQuote, error) {
+	q := new(FXQuote)
+	var usedAt sql.NullTime
+	err := s.db.QueryRow(
+		`SELECT id, from_number, to_number, amount, currency, rate,
+                        converted_amount, converted_currency, created_at, expires_at, used_at
+                 FROM fx_quote WHERE id = $1`, id).Scan(
+		&q.Id,
+		&q.FromNumber,
+		&q.ToNumber,
+		&q.Amount,
+		&q.Currency,
+		&q.Rate,
+		&q.Converted.Amount,
+		&q.Converted.Currency,
+		&q.CreatedAt,
+		&q.ExpiresAt,
+		&usedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("quote %s: %w", id, ErrQuoteNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		q.UsedAt = &usedAt.Time
+	}
+
+	return q, nil
+}
+
+// marks the quote as spent inside the transfer transaction so a quote can
+// never pay for two transfers
+func useFXQuote(ctx context.Context, tx *sql.Tx, id string) error {
+	result, err := tx.ExecContext(ctx,
+		"UPDATE fx_quote SET used_at = NOW() WHERE id = $1 AND used_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("quote %s: %w", id, ErrQuoteUsed)
+	}
+
+	return nil
+}
+
+// writes a balanced set of entries under a fresh journal id
+func postJournal(ctx context.Context, tx *sql.Tx, entries []LedgerEntry) (int64, error) {
+	if err := validateJournal(entries); err != nil {
+		return 0, err
+	}
+
+	var journalId int64
+	if err := tx.QueryRowContext(ctx, "SELECT nextval('ledger_journal_seq')").Scan(&journalId); err != nil {
+		return 0, err
+	}
+
+	for _, e := range entries {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO ledger_entry (journal_id, account_number, direction, amount, currency)
+                         VALUES ($1, $2, $3, $4, $5)`,
+			journalId, e.AccountNumber, e.Direction, e.Amount, e.Currency)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return journalId, nil
+}
+
+// sets the cached balance of an account to the sum of its ledger entries
+func refreshBalance(ctx context.Context, tx *sql.Tx, number int64) (uint64, error) {
+	var balance int64
+	err := tx.QueryRowContext(ctx,
+		`UPDATE account SET balance = (
+                         SELECT COALESCE(SUM(CASE WHEN direction = 'credit' THEN amount ELSE -amount END), 0)
+                         FROM ledger_entry WHERE account_number = $1)
+                 WHERE number = $1
+                 RETURNING balance`, number).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if balance < 0 {
+		return 0, fmt.Errorf("ledger for account %d is overdrawn: %d", number, balance)
+	}
+
+	return uint64(balance), nil
+}
+
+// has to match the order scanIntoTransfer reads them in
+const transferColumns = `id, from_number, to_number, amount, currency, status, created_at,
+                         fx_rate, converted_amount, converted_currency, fx_quote_id, auth_factor, reversal_of,
+                         reason_code,
+                         (SELECT COALESCE(SUM(r.amount), 0) FROM transfer r WHERE r.reversal_of = transfer.id)`
+
+func scanIntoTransfer(rows *sql.Rows) (*Transfer, error) {
+	t := new(Transfer)
+	var fxRate, convertedAmount sql.NullInt64
+	var convertedCurrency, quoteId, authFactor, reasonCode sql.NullString
+	var reversalOf sql.NullInt64
+	err := rows.Scan(
+		&t.Id,
+		&t.FromNumber,
+		&t.ToNumber,
+		&t.Amount,
+		&t.Currency,
+		&t.Status,
+		&t.CreatedAt,
+		&fxRate,
+		&convertedAmount,
+		&convertedCurrency,
+		&quoteId,
+		&authFactor,
+		&reversalOf,
+		&reasonCode,
+		&t.Reversed)
+	if err != nil {
+		return nil, err
+	}
+	t.AuthFactor = authFactor.String
+	t.ReversalOf = reversalOf.Int64
+	t.ReasonCode = reasonCode.String
+
+	if fxRate.Valid {
+		t.FX = &FXDetails{
+			Rate: Rate(fxRate.Int64),
+			Converted: Money{
+				Amount:   uint64(convertedAmount.Int64),
+				Currency: Currency(convertedCurrency.String),
+			},
+			QuoteId: quoteId.String,
+		}
+	}
+
+	return t, nil
+}
+
+// has to match the order scanIntoAccount reads them in
+const accountColumns = `id, first_name, last_name, number, encrypted_password,
+                        balance, currency, role, created_at, password_changed_at, status, closed_at,
+                        version,
+                        (SELECT COALESCE(SUM(h.amount), 0) FROM reversal_hold h WHERE h.account_number = account.number)`
+
+func scanIntoAccount(rows *sql.Rows) (*Account, error) {
 	account := new(Account)
 	err := rows.Scan(
 		&account.Id,
@@ -188,8 +1393,719 @@ func scanIntoAccount(rows *sql.Rows) (*Account, error) {
 		&account.Number,
 		&account.EncryptedPassword,
 		&account.Balance,
+		&account.Currency,
 		&account.Role,
-		&account.CreatedAt)
+		&account.CreatedAt,
+		&account.PasswordChangedAt,
+		&account.Status,
+		&account.ClosedAt,
+		&account.Version,
+		&account.Held)
 
 	return account, err
 }
+
+func (s *PostgressStore) CreateRefreshToken(t *RefreshToken) error {
+	_, err := s.db.Exec(
+		`INSERT INTO refresh_token (token_hash, family_id, account_number, created_at, expires_at, auth_methods)
+                 VALUES ($1, $2, $3, $4, $5, $6)`,
+		t.TokenHash, t.FamilyId, t.AccountNumber, t.CreatedAt, t.ExpiresAt, pq.Array(t.AuthMethods))
+	return err
+}
+
+// revokes the presented token and stores next in the same family. When the
+// presented token was already revoked the rest of its family is revoked too,
+// that commits before ErrRefreshTokenReused is returned.
+func (s *PostgressStore) RotateRefreshToken(tokenHash string, next *RefreshToken) (*RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	current := &RefreshToken{TokenHash: tokenHash}
+	err = tx.QueryRowContext(ctx,
+		`SELECT family_id, account_number, created_at, expires_at, revoked_at, auth_methods
+                 FROM refresh_token WHERE token_hash = $1 FOR UPDATE`, tokenHash).Scan(
+		&current.FamilyId,
+		&current.AccountNumber,
+		&current.CreatedAt,
+		&current.ExpiresAt,
+		&current.RevokedAt,
+		pq.Array(&current.AuthMethods))
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if current.RevokedAt != nil {
+		if err := revokeRefreshFamily(ctx, tx, current.FamilyId, now); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	if !now.Before(current.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE refresh_token SET revoked_at = $1 WHERE token_hash = $2", now, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+
+	next.FamilyId = current.FamilyId
+	next.AccountNumber = current.AccountNumber
+	next.AuthMethods = current.AuthMethods
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO refresh_token (token_hash, family_id, account_number, created_at, expires_at, auth_methods)
+                 VALUES ($1, $2, $3, $4, $5, $6)`,
+		next.TokenHash, next.FamilyId, next.AccountNumber, next.CreatedAt, next.ExpiresAt, pq.Array(next.AuthMethods))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return current, nil
+}
+
+// revokes every token in the family of the given one
+func (s *PostgressStore) RevokeRefreshToken(tokenHash string) error {
+	result, err := s.db.Exec(
+		`UPDATE refresh_token SET revoked_at = $1
+                 WHERE revoked_at IS NULL
+                 AND family_id = (SELECT family_id FROM refresh_token WHERE token_hash = $2)`,
+		time.Now().UTC(), tokenHash)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrInvalidRefreshToken
+	}
+
+	return nil
+}
+
+func revokeRefreshFamily(ctx context.Context, tx *sql.Tx, familyId string, now time.Time) error {
+	_, err := tx.ExecContext(ctx,
+		"UPDATE refresh_token SET revoked_at = $1 WHERE family_id = $2 AND revoked_at IS NULL",
+		now, familyId)
+	return err
+}
+
+func (s *PostgressStore) RevokeToken(jti string, expiresAt time.Time) error {
+	_, err := s.db.Exec(
+		"INSERT INTO revoked_token (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING",
+		jti, expiresAt)
+	return err
+}
+
+// revokes a single use token, only the first caller gets true
+func (s *PostgressStore) ConsumeToken(jti string, expiresAt time.Time) (bool, error) {
+	result, err := s.db.Exec(
+		"INSERT INTO revoked_token (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING",
+		jti, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (s *PostgressStore) IsTokenRevoked(jti string) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM revoked_token WHERE jti = $1)", jti).Scan(&revoked)
+	return revoked, err
+}
+
+// drops refresh tokens and revocations once the tokens they cover have expired
+func (s *PostgressStore) PurgeExpiredTokens(now time.Time) (int64, error) {
+	refresh, err := s.db.Exec("DELETE FROM refresh_token WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked, err := s.db.Exec("DELETE FROM revoked_token WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+
+	resets, err := s.db.Exec("DELETE FROM password_reset_token WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+
+	refreshPurged, _ := refresh.RowsAffected()
+	revokedPurged, _ := revoked.RowsAffected()
+	resetsPurged, _ := resets.RowsAffected()
+	return refreshPurged + revokedPurged + resetsPurged, nil
+}
+
+func (s *PostgressStore) GetLoginAttempts(key string) (*LoginAttempts, error) {
+	attempts := &LoginAttempts{Key: key}
+	err := s.db.QueryRow(
+		"SELECT failures, last_failure_at FROM login_attempt WHERE key = $1", key).Scan(
+		&attempts.Failures,
+		&attempts.LastFailureAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+// counts a failure at the given time, failures from before since start over
+func (s *PostgressStore) RecordLoginFailure(key string, at time.Time, since time.Time) (*LoginAttempts, error) {
+	attempts := &LoginAttempts{Key: key}
+	err := s.db.QueryRow(
+		`INSERT INTO login_attempt (key, failures, last_failure_at)
+                 VALUES ($1, 1, $2)
+                 ON CONFLICT (key) DO UPDATE SET
+                         failures = CASE WHEN login_attempt.last_failure_at < $3 THEN 1
+                                         ELSE login_attempt.failures + 1 END,
+                         last_failure_at = EXCLUDED.last_failure_at
+                 RETURNING failures, last_failure_at`,
+		key, at, since).Scan(&attempts.Failures, &attempts.LastFailureAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+// the key doubles as the audit target, account:<number> or ip:<address>
+func (s *PostgressStore) ResetLoginAttempts(key string, audit *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var failures int
+	err = tx.QueryRowContext(ctx, "DELETE FROM login_attempt WHERE key = $1 RETURNING failures", key).Scan(&failures)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if audit != nil {
+		audit.Target = key
+		audit.Before = snapshot(loginAttemptsSnapshot{Failures: failures})
+		audit.After = snapshot(loginAttemptsSnapshot{})
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgressStore) PurgeLoginAttempts(before time.Time) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM login_attempt WHERE last_failure_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// replaces a pending enrollment, an enabled secret is never overwritten
+func (s *PostgressStore) SaveMFASecret(m *MFASecret, audit *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var before mfaSnapshot
+	err = tx.QueryRowContext(ctx,
+		"SELECT created_at, enabled_at FROM account_mfa WHERE account_number = $1 FOR UPDATE",
+		m.AccountNumber).Scan(&before.EnrolledAt, &before.EnabledAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if before.EnabledAt != nil {
+		return ErrMFAAlreadyEnabled
+	}
+
+	result, err := tx.ExecContext(ctx,
+		`INSERT INTO account_mfa (account_number, encrypted_secret, created_at)
+                 VALUES ($1, $2, $3)
+                 ON CONFLICT (account_number) DO UPDATE SET
+                         encrypted_secret = EXCLUDED.encrypted_secret,
+                         created_at = EXCLUDED.created_at,
+                         last_used_step = 0
+                 WHERE account_mfa.enabled_at IS NULL`,
+		m.AccountNumber, m.EncryptedSecret, m.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrMFAAlreadyEnabled
+	}
+
+	if audit != nil {
+		audit.Target = accountTarget(m.AccountNumber)
+		audit.Before = snapshot(before)
+		audit.After = snapshot(mfaSnapshot{EnrolledAt: &m.CreatedAt})
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgressStore) GetMFASecret(number int64) (*MFASecret, error) {
+	m := &MFASecret{AccountNumber: number}
+	err := s.db.QueryRow(
+		`SELECT encrypted_secret, created_at, enabled_at, last_used_step
+                 FROM account_mfa WHERE account_number = $1`, number).Scan(
+		&m.EncryptedSecret,
+		&m.CreatedAt,
+		&m.EnabledAt,
+		&m.LastUsedStep)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("mfa for account %d: %w", number, ErrMFANotEnrolled)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (s *PostgressStore) EnableMFA(number int64, step int64, audit *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var after mfaSnapshot
+	err = tx.QueryRowContext(ctx,
+		`UPDATE account_mfa SET enabled_at = NOW(), last_used_step = $2
+                 WHERE account_number = $1 AND enabled_at IS NULL
+                 RETURNING created_at, enabled_at`, number, step).Scan(&after.EnrolledAt, &after.EnabledAt)
+	if err == sql.ErrNoRows {
+		return ErrMFAAlreadyEnabled
+	}
+	if err != nil {
+		return err
+	}
+
+	if audit != nil {
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(mfaSnapshot{EnrolledAt: after.EnrolledAt})
+		audit.After = snapshot(after)
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// records that the code for step was used, later steps only
+func (s *PostgressStore) UseMFAStep(number int64, step int64) error {
+	result, err := s.db.Exec(
+		`UPDATE account_mfa SET last_used_step = $2
+                 WHERE account_number = $1 AND last_used_step < $2`, number, step)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrMFACodeReused
+	}
+
+	return nil
+}
+
+// stores a new password hash and revokes every refresh token of the account,
+// access tokens issued before changedAt are rejected by the auth middleware
+func (s *PostgressStore) SetPassword(number int64, hash string, changedAt time.Time, audit *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	acc, err := lockFullAccount(ctx, tx, number)
+	if err != nil {
+		return err
+	}
+
+	if err := setPassword(ctx, tx, number, hash, changedAt); err != nil {
+		return err
+	}
+
+	if audit != nil {
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(passwordSnapshot{PasswordChangedAt: acc.PasswordChangedAt})
+		audit.After = snapshot(passwordSnapshot{PasswordChangedAt: &changedAt})
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func setPassword(ctx context.Context, tx *sql.Tx, number int64, hash string, changedAt time.Time) error {
+	result, err := tx.ExecContext(ctx,
+		"UPDATE account SET encrypted_password = $2, password_changed_at = $3 WHERE number = $1",
+		number, hash, changedAt)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("account number not found for number %d: %w", number, ErrAccountNotFound)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE refresh_token SET revoked_at = $2 WHERE account_number = $1 AND revoked_at IS NULL",
+		number, changedAt)
+	return err
+}
+
+// swaps the hash for one with a different cost, unless the password was
+// changed in the meantime
+func (s *PostgressStore) RehashPassword(number int64, oldHash string, newHash string) error {
+	_, err := s.db.Exec(
+		"UPDATE account SET encrypted_password = $3 WHERE number = $1 AND encrypted_password = $2",
+		number, oldHash, newHash)
+	return err
+}
+
+// only the newest reset token of an account can be used
+func (s *PostgressStore) CreatePasswordReset(reset *PasswordReset, audit *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		"DELETE FROM password_reset_token WHERE account_number = $1 AND used_at IS NULL",
+		reset.AccountNumber)
+	if err != nil {
+		return err
+	}
+	pending, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO password_reset_token (token_hash, account_number, created_by, created_at, expires_at)
+                 VALUES ($1, $2, $3, $4, $5)`,
+		reset.TokenHash, reset.AccountNumber, reset.CreatedBy, reset.CreatedAt, reset.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	if audit != nil {
+		audit.Target = accountTarget(reset.AccountNumber)
+		audit.Before = snapshot(resetTokenSnapshot{Pending: pending})
+		audit.After = snapshot(resetTokenSnapshot{Pending: 1, ExpiresAt: &reset.ExpiresAt})
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// uses up the reset token and sets the password, returns the account number
+func (s *PostgressStore) ResetPassword(tokenHash string, hash string, now time.Time, audit *AuditEntry) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var number, createdBy int64
+	err = tx.QueryRowContext(ctx,
+		`UPDATE password_reset_token SET used_at = $2
+                 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+                 RETURNING account_number, created_by`, tokenHash, now).Scan(&number, &createdBy)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	acc, err := lockFullAccount(ctx, tx, number)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := setPassword(ctx, tx, number, hash, now); err != nil {
+		return 0, err
+	}
+
+	if audit != nil {
+		if audit.ActorNumber == 0 {
+			audit.ActorNumber, audit.ActorRole = number, acc.Role
+		}
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(passwordSnapshot{PasswordChangedAt: acc.PasswordChangedAt})
+		audit.After = snapshot(passwordSnapshot{PasswordChangedAt: &now, ResetBy: createdBy})
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return 0, fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return number, tx.Commit()
+}
+
+const roleQuery = `SELECT r.name, r.description, r.require_mfa, r.builtin,
+                          COALESCE(array_agg(p.permission ORDER BY p.permission) FILTER (WHERE p.permission IS NOT NULL), '{}')
+                   FROM role r LEFT JOIN role_permission p ON p.role_name = r.name`
+
+func scanIntoRole(rows *sql.Rows) (*Role, error) {
+	role := new(Role)
+	var permissions []string
+	err := rows.Scan(
+		&role.Name,
+		&role.Description,
+		&role.RequireMFA,
+		&role.Builtin,
+		pq.Array(&permissions))
+	if err != nil {
+		return nil, err
+	}
+
+	role.Permissions = make([]Permission, len(permissions))
+	for i, p := range permissions {
+		role.Permissions[i] = Permission(p)
+	}
+
+	return role, nil
+}
+
+func (s *PostgressStore) GetRole(name string) (*Role, error) {
+	rows, err := s.db.Query(roleQuery+" WHERE r.name = $1 GROUP BY r.name", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		return scanIntoRole(rows)
+	}
+
+	return nil, fmt.Errorf("role %q: %w", name, ErrRoleNotFound)
+}
+
+func (s *PostgressStore) GetRoles() ([]*Role, error) {
+	rows, err := s.db.Query(roleQuery + " GROUP BY r.name ORDER BY r.name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+	for rows.Next() {
+		role, err := scanIntoRole(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+// locks the role row so its permissions can't change under an audited write
+func lockRole(ctx context.Context, tx *sql.Tx, name string) (*Role, error) {
+	var locked string
+	err := tx.QueryRowContext(ctx, "SELECT name FROM role WHERE name = $1 FOR UPDATE", name).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("role %q: %w", name, ErrRoleNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, roleQuery+" WHERE r.name = $1 GROUP BY r.name", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		return scanIntoRole(rows)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("role %q: %w", name, ErrRoleNotFound)
+}
+
+// creates the role or replaces its description and permissions, the builtin
+// flag is left alone
+func (s *PostgressStore) SaveRole(role *Role, audit *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	existing, err := lockRole(ctx, tx, role.Name)
+	if err != nil && !errors.Is(err, ErrRoleNotFound) {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO role (name, description, require_mfa) VALUES ($1, $2, $3)
+                 ON CONFLICT (name) DO UPDATE SET
+                         description = EXCLUDED.description,
+                         require_mfa = EXCLUDED.require_mfa`,
+		role.Name, role.Description, role.RequireMFA)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM role_permission WHERE role_name = $1", role.Name); err != nil {
+		return err
+	}
+
+	for _, p := range role.Permissions {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO role_permission (role_name, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			role.Name, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	if audit != nil {
+		saved, err := lockRole(ctx, tx, role.Name)
+		if err != nil {
+			return err
+		}
+		audit.Target = roleTarget(role.Name)
+		if existing != nil {
+			audit.Before = snapshot(existing)
+		}
+		audit.After = snapshot(saved)
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgressStore) DeleteRole(name string, audit *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	existing, err := lockRole(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM role WHERE name = $1", name)
+	if isForeignKeyViolation(err) {
+		return fmt.Errorf("role %q: %w", name, ErrRoleInUse)
+	}
+	if err != nil {
+		return err
+	}
+
+	if audit != nil {
+		audit.Target = roleTarget(name)
+		audit.Before = snapshot(existing)
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgressStore) SetAccountRole(number int64, role string, audit *AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	acc, err := lockFullAccount(ctx, tx, number)
+	if err != nil {
+		return err
+	}
+
+	before := *acc
+	_, err = tx.ExecContext(ctx, "UPDATE account SET role = $2, version = version + 1 WHERE number = $1", number, role)
+	if isForeignKeyViolation(err) {
+		return fmt.Errorf("role %q: %w", role, ErrRoleNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	acc.Role = role
+	acc.Version++
+
+	if audit != nil {
+		audit.Target = accountTarget(number)
+		audit.Before = snapshot(&before)
+		audit.After = snapshot(acc)
+		if err := appendAudit(ctx, tx, audit); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
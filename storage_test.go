@@ -1,15 +1,85 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func TestCreateAccount(t *testing.T) {
-	store, _ := NewPostgressStore()
-	store.Init()
+// every Storage implementation has to pass the same suite
+func runStorageSuite(t *testing.T, newStore func(t *testing.T) Storage) {
+	tests := map[string]func(*testing.T, Storage){
+		"CreateAccount":       testCreateAccount,
+		"AccountNumberTaken":  testAccountNumberTaken,
+		"GetAccounts":         testGetAccounts,
+		"TransferMoney":       testTransferMoney,
+		"CrossCurrency":       testCrossCurrencyTransfer,
+		"FXQuoteTransfer":     testFXQuoteTransfer,
+		"ConcurrentTransfers": testConcurrentTransfers,
+		"IdempotencyKeys":     testIdempotencyKeys,
+		"RefreshTokens":       testRefreshTokens,
+		"LoginAttempts":       testLoginAttempts,
+		"MFASecrets":          testMFASecrets,
+		"Passwords":           testPasswords,
+		"Roles":               testRoles,
+		"Reversals":           testReversals,
+		"ReversalHolds":       testReversalHolds,
+		"AuditLog":            testAuditLog,
+		"AccountStatus":       testAccountStatus,
+		"UpdateAccount":       testUpdateAccount,
+		"ListAccounts":        testListAccounts,
+		"CashMovements":       testCashMovements,
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test(t, newStore(t))
+		})
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	runStorageSuite(t, func(t *testing.T) Storage {
+		return NewMemoryStore()
+	})
+}
+
+// needs a running postgres (DATABASE_URL or the local default), skipped when
+// it isn't reachable
+func TestPostgressStore(t *testing.T) {
+	runStorageSuite(t, func(t *testing.T) Storage {
+		cfg := defaultConfig()
+		if err := applyConfigEnv(cfg); err != nil {
+			t.Fatalf("Error reading config: %v", err)
+		}
+
+		store, err := NewPostgressStore(cfg.Database)
+		if err != nil {
+			t.Skipf("postgres not available: %v", err)
+		}
+
+		migrator, err := store.Migrator()
+		if err != nil {
+			t.Fatalf("Error loading migrations: %v", err)
+		}
+
+		if err := migrator.Up(); err != nil {
+			t.Fatalf("Error migrating: %v", err)
+		}
+
+		return store
+	})
+}
+
+func testCreateAccount(t *testing.T, store Storage) {
 
 	accountNumber := int64(1337)
 	account := &Account{
@@ -22,25 +92,36 @@ func TestCreateAccount(t *testing.T) {
 		CreatedAt:         time.Now(),
 	}
 
-	store.CreateAccount(account)
+	store.CreateAccount(account, nil)
 
-	storedAccount, _ := store.GetAccountByNumber(accountNumber)
+	storedAccount, _ := store.GetAccountByNumber(account.Number)
 	assert.Equal(t, account.FirstName, storedAccount.FirstName)
 	assert.Equal(t, account.LastName, storedAccount.LastName)
 	assert.Equal(t, account.Number, storedAccount.Number)
 	assert.Equal(t, account.Balance, storedAccount.Balance)
 	assert.Equal(t, account.Role, storedAccount.Role)
+	assert.Equal(t, AccountActive, storedAccount.Status)
+	assert.Nil(t, storedAccount.ClosedAt)
+}
 
-	store.DeleteAccount(account.Id)
+func testAccountNumberTaken(t *testing.T, store Storage) {
+	first, _ := NewAccount("Test", "NumberTakenFirst", "secret123", "user", 0, bcrypt.DefaultCost)
+	second, _ := NewAccount("Test", "NumberTakenSecond", "secret123", "user", 0, bcrypt.DefaultCost)
+	second.Number = first.Number
 
-	_, err := store.GetAccountByNumber(accountNumber)
-	assert.Error(t, err)
-}
+	assert.NoError(t, store.CreateAccount(first, nil))
+	assert.NoError(t, store.CreateAccount(second, nil))
+
+	//the second account got a fresh number instead of a duplicate
+	assert.NotEqual(t, first.Number, second.Number)
+	assert.True(t, validAccountNumber(second.Number))
 
-func TestGetAccounts(t *testing.T) {
+	storedAccount, err := store.GetAccountByNumber(first.Number)
+	assert.NoError(t, err)
+	assert.Equal(t, first.LastName, storedAccount.LastName)
+}
 
-	store, _ := NewPostgressStore()
-	store.Init()
+func testGetAccounts(t *testing.T, store Storage) {
 
 	firstAccountNumber := int64(1337)
 	firstAccount := &Account{
@@ -63,14 +144,14 @@ func TestGetAccounts(t *testing.T) {
 		CreatedAt:         time.Now(),
 	}
 
-	store.CreateAccount(firstAccount)
-	store.CreateAccount(secondAccount)
+	store.CreateAccount(firstAccount, nil)
+	store.CreateAccount(secondAccount, nil)
 
-	accounts, _ := store.GetAccounts()
+	accounts, _ := store.GetAccounts(AccountFilter{})
 
 	var foundFirstAccount *Account
 	for _, acc := range accounts {
-		if acc.Number == firstAccountNumber {
+		if acc.Number == firstAccount.Number {
 			foundFirstAccount = acc
 			break
 		}
@@ -78,7 +159,7 @@ func TestGetAccounts(t *testing.T) {
 
 	var foundSecondAccount *Account
 	for _, acc := range accounts {
-		if acc.Number == secondAccountNumber {
+		if acc.Number == secondAccount.Number {
 			foundSecondAccount = acc
 			break
 		}
@@ -88,14 +169,9 @@ func TestGetAccounts(t *testing.T) {
 	assert.Equal(t, firstAccount.LastName, foundFirstAccount.LastName)
 	assert.Equal(t, secondAccount.Number, foundSecondAccount.Number)
 	assert.Equal(t, secondAccount.LastName, foundSecondAccount.LastName)
-
-	store.DeleteAccount(firstAccount.Id)
-	store.DeleteAccount(secondAccount.Id)
 }
 
-func TestTransferMoney(t *testing.T) {
-	store, _ := NewPostgressStore()
-	store.Init()
+func testTransferMoney(t *testing.T, store Storage) {
 
 	fromAccountNumber := int64(1337)
 	fromAccount := &Account{
@@ -118,10 +194,18 @@ func TestTransferMoney(t *testing.T) {
 		CreatedAt:         time.Now(),
 	}
 
-	store.CreateAccount(fromAccount)
-	store.CreateAccount(toAccount)
+	store.CreateAccount(fromAccount, nil)
+	store.CreateAccount(toAccount, nil)
+
+	transfer := &Transfer{FromNumber: fromAccount.Number, ToNumber: toAccount.Number, Money: Money{Amount: 10}, AuthFactor: authMethodOTP}
+	err := store.TransferMoney(transfer, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, TransferCompleted, transfer.Status)
+	assert.Equal(t, DefaultCurrency, transfer.Currency)
 
-	store.TransferMoney(fromAccount, toAccount, 10)
+	//can't send more than the balance
+	err = store.TransferMoney(&Transfer{FromNumber: toAccount.Number, ToNumber: fromAccount.Number, Money: Money{Amount: 1000}}, nil)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
 
 	fromAccountUpdate, _ := store.GetAccountByNumber(fromAccount.Number)
 	toAccountUpdate, _ := store.GetAccountByNumber(toAccount.Number)
@@ -130,7 +214,859 @@ func TestTransferMoney(t *testing.T) {
 	assert.Equal(t, fromAccount.Balance-10, fromAccountUpdate.Balance)
 	assert.Equal(t, toAccount.Balance+10, toAccountUpdate.Balance)
 
-	store.DeleteAccount(fromAccount.Id)
-	store.DeleteAccount(toAccount.Id)
+	//the ledger should agree with the cached balances
+	fromBalance, err := store.RecomputeBalance(fromAccount.Number)
+	assert.NoError(t, err)
+	assert.Equal(t, fromAccountUpdate.Balance, fromBalance)
+
+	toBalance, err := store.RecomputeBalance(toAccount.Number)
+	assert.NoError(t, err)
+	assert.Equal(t, toAccountUpdate.Balance, toBalance)
+
+	//the transfer shows up first in both histories
+	outgoing, err := store.GetTransfers(TransferFilter{AccountNumber: fromAccount.Number, Direction: DirectionOutgoing, Limit: 1})
+	assert.NoError(t, err)
+	assert.Len(t, outgoing, 1)
+	assert.Equal(t, transfer.Id, outgoing[0].Id)
+	assert.Equal(t, authMethodOTP, outgoing[0].AuthFactor)
+
+	incoming, err := store.GetTransfers(TransferFilter{AccountNumber: toAccount.Number, Direction: DirectionIncoming, Limit: 1})
+	assert.NoError(t, err)
+	assert.Len(t, incoming, 1)
+	assert.Equal(t, transfer.Id, incoming[0].Id)
+	assert.Equal(t, uint64(10), incoming[0].Amount)
+}
+
+func testCrossCurrencyTransfer(t *testing.T, store Storage) {
+	dollars, _ := NewAccount("Test", "CrossCurrencyUSD", "secret123", "user", 1000, bcrypt.DefaultCost)
+	euros, _ := NewAccount("Test", "CrossCurrencyEUR", "secret123", "user", 1000, bcrypt.DefaultCost)
+	euros.Currency = "EUR"
+
+	store.CreateAccount(dollars, nil)
+	store.CreateAccount(euros, nil)
+
+	err := store.TransferMoney(&Transfer{FromNumber: dollars.Number, ToNumber: euros.Number, Money: Money{Amount: 10}}, nil)
+	assert.ErrorIs(t, err, ErrCurrencyMismatch)
+
+	//the amount has to be in the source account's currency
+	other, _ := NewAccount("Test", "CrossCurrencyUSD2", "secret123", "user", 0, bcrypt.DefaultCost)
+	store.CreateAccount(other, nil)
+
+	err = store.TransferMoney(&Transfer{FromNumber: dollars.Number, ToNumber: other.Number, Money: Money{Amount: 10, Currency: "EUR"}}, nil)
+	assert.ErrorIs(t, err, ErrCurrencyMismatch)
+
+	storedEuros, err := store.GetAccountByNumber(euros.Number)
+	assert.NoError(t, err)
+	assert.Equal(t, Currency("EUR"), storedEuros.Currency)
+	assert.Equal(t, uint64(1000), storedEuros.Balance)
+}
+
+func testFXQuoteTransfer(t *testing.T, store Storage) {
+	dollars, _ := NewAccount("Test", "FXQuoteUSD", "secret123", "user", 10000, bcrypt.DefaultCost)
+	euros, _ := NewAccount("Test", "FXQuoteEUR", "secret123", "user", 0, bcrypt.DefaultCost)
+	euros.Currency = "EUR"
+
+	require.NoError(t, store.CreateAccount(dollars, nil))
+	require.NoError(t, store.CreateAccount(euros, nil))
+
+	fx := NewFXService(NewStaticRateProvider(map[[2]Currency]Rate{
+		{"USD", "EUR"}: Rate(920_000_000),
+	}), 0, time.Minute)
+
+	quote, err := fx.Quote(dollars, euros, 1000)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateFXQuote(quote))
+
+	transfer := &Transfer{
+		FromNumber: dollars.Number,
+		ToNumber:   euros.Number,
+		Money:      quote.Money,
+		FX:         &FXDetails{Rate: quote.Rate, Converted: quote.Converted, QuoteId: quote.Id},
+	}
+	require.NoError(t, store.TransferMoney(transfer, nil))
+
+	storedDollars, _ := store.GetAccountByNumber(dollars.Number)
+	storedEuros, _ := store.GetAccountByNumber(euros.Number)
+	assert.Equal(t, uint64(9000), storedDollars.Balance)
+	assert.Equal(t, uint64(920), storedEuros.Balance)
+
+	//the rate and both amounts are kept on the transfer
+	transfers, err := store.GetTransfers(TransferFilter{AccountNumber: euros.Number})
+	require.NoError(t, err)
+	require.Len(t, transfers, 1)
+	require.NotNil(t, transfers[0].FX)
+	assert.Equal(t, quote.Rate, transfers[0].FX.Rate)
+	assert.Equal(t, Money{Amount: 920, Currency: "EUR"}, transfers[0].FX.Converted)
+
+	used, err := store.GetFXQuote(quote.Id)
+	require.NoError(t, err)
+	assert.NotNil(t, used.UsedAt)
+
+	//a quote only pays out once
+	again := &Transfer{
+		FromNumber: dollars.Number,
+		ToNumber:   euros.Number,
+		Money:      quote.Money,
+		FX:         &FXDetails{Rate: quote.Rate, Converted: quote.Converted, QuoteId: quote.Id},
+	}
+	assert.ErrorIs(t, store.TransferMoney(again, nil), ErrQuoteUsed)
+}
+
+func testConcurrentTransfers(t *testing.T, store Storage) {
+
+	first := &Account{
+		FirstName:         "Test",
+		LastName:          "ConcurrentFirst",
+		Number:            1337,
+		EncryptedPassword: "secret123",
+		Balance:           1000,
+		Role:              "user",
+		CreatedAt:         time.Now(),
+	}
+	second := &Account{
+		FirstName:         "Test",
+		LastName:          "ConcurrentSecond",
+		Number:            1338,
+		EncryptedPassword: "secret123",
+		Balance:           1000,
+		Role:              "user",
+		CreatedAt:         time.Now(),
+	}
+
+	store.CreateAccount(first, nil)
+	store.CreateAccount(second, nil)
+
+	//hammer both accounts from both directions, far more than they can afford
+	var wg sync.WaitGroup
+	var sentFromFirst, sentFromSecond atomic.Uint64
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			transfer := &Transfer{FromNumber: first.Number, ToNumber: second.Number, Money: Money{Amount: 25}}
+			sent := &sentFromFirst
+			if i%2 == 1 {
+				transfer = &Transfer{FromNumber: second.Number, ToNumber: first.Number, Money: Money{Amount: 35}}
+				sent = &sentFromSecond
+			}
+
+			if err := store.TransferMoney(transfer, nil); err == nil {
+				sent.Add(transfer.Amount)
+			} else {
+				assert.ErrorIs(t, err, ErrInsufficientFunds)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	firstUpdate, _ := store.GetAccountByNumber(first.Number)
+	secondUpdate, _ := store.GetAccountByNumber(second.Number)
+
+	//no money was created or lost
+	assert.Equal(t, uint64(2000), firstUpdate.Balance+secondUpdate.Balance)
+	assert.Equal(t, 1000-sentFromFirst.Load()+sentFromSecond.Load(), firstUpdate.Balance)
+
+	firstLedger, err := store.RecomputeBalance(first.Number)
+	assert.NoError(t, err)
+	assert.Equal(t, firstUpdate.Balance, firstLedger)
+}
+
+func testIdempotencyKeys(t *testing.T, store Storage) {
+
+	now := time.Now().UTC()
+	rec := &IdempotencyRecord{
+		Key:         "test:idempotency",
+		RequestHash: "hash",
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(time.Minute),
+	}
+	store.ReleaseIdempotencyKey(rec.Key)
+
+	existing, err := store.ReserveIdempotencyKey(rec)
+	assert.NoError(t, err)
+	assert.Nil(t, existing)
+
+	rec.StatusCode = 200
+	rec.ResponseBody = []byte(`{"ok":true}`)
+	assert.NoError(t, store.CompleteIdempotencyKey(rec))
+
+	existing, err = store.ReserveIdempotencyKey(rec)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, existing.StatusCode)
+	assert.Equal(t, rec.ResponseBody, existing.ResponseBody)
+
+	//once expired the key can be claimed again
+	later := &IdempotencyRecord{
+		Key:         rec.Key,
+		RequestHash: "other",
+		CreatedAt:   now.Add(2 * time.Minute),
+		ExpiresAt:   now.Add(3 * time.Minute),
+	}
+	existing, err = store.ReserveIdempotencyKey(later)
+	assert.NoError(t, err)
+	assert.Nil(t, existing)
+
+	store.ReleaseIdempotencyKey(rec.Key)
+}
+
+func testRefreshTokens(t *testing.T, store Storage) {
+	plain, first, err := newRefreshToken(1337, time.Hour)
+	require.NoError(t, err)
+	first.AuthMethods = []string{authMethodPassword, authMethodOTP}
+	require.NoError(t, store.CreateRefreshToken(first))
+
+	_, second, err := newRefreshToken(0, time.Hour)
+	require.NoError(t, err)
+
+	previous, err := store.RotateRefreshToken(hashToken(plain), second)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1337), previous.AccountNumber)
+	assert.Equal(t, first.FamilyId, second.FamilyId)
+	assert.Equal(t, first.AuthMethods, second.AuthMethods)
+
+	//the rotated token can't be used again, and using it kills the family
+	_, third, _ := newRefreshToken(0, time.Hour)
+	_, err = store.RotateRefreshToken(hashToken(plain), third)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+
+	_, err = store.RotateRefreshToken(second.TokenHash, third)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+
+	_, err = store.RotateRefreshToken(hashToken("unknown"), third)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	expiresAt := time.Now().Add(time.Minute).UTC()
+	require.NoError(t, store.RevokeToken("suite-jti", expiresAt))
+	revoked, err := store.IsTokenRevoked("suite-jti")
+	require.NoError(t, err)
+	assert.True(t, revoked)
+
+	_, err = store.PurgeExpiredTokens(expiresAt.Add(2 * time.Hour))
+	require.NoError(t, err)
+	revoked, err = store.IsTokenRevoked("suite-jti")
+	require.NoError(t, err)
+	assert.False(t, revoked)
+}
+
+func testLoginAttempts(t *testing.T, store Storage) {
+	key := "account:suite"
+	defer store.ResetLoginAttempts(key, nil)
+
+	attempts, err := store.GetLoginAttempts(key)
+	require.NoError(t, err)
+	assert.Equal(t, 0, attempts.Failures)
+
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 3; i++ {
+		attempts, err = store.RecordLoginFailure(key, start.Add(time.Duration(i)*time.Minute), start)
+		require.NoError(t, err)
+		assert.Equal(t, i, attempts.Failures)
+	}
+
+	//failures from before the window start over
+	later := start.Add(2 * time.Hour)
+	attempts, err = store.RecordLoginFailure(key, later, later.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+
+	audit := &AuditEntry{Action: auditAccountUnlock, CreatedAt: time.Now().UTC()}
+	require.NoError(t, store.ResetLoginAttempts(key, audit))
+	attempts, err = store.GetLoginAttempts(key)
+	require.NoError(t, err)
+	assert.Equal(t, 0, attempts.Failures)
+	assert.Equal(t, key, audit.Target)
+	assert.JSONEq(t, `{"failures": 1}`, string(audit.Before))
+}
+
+func testMFASecrets(t *testing.T, store Storage) {
+	number := time.Now().UnixNano() % 1_000_000_000
+
+	_, err := store.GetMFASecret(number)
+	assert.ErrorIs(t, err, ErrMFANotEnrolled)
+
+	//enrolling again before verifying replaces the pending secret
+	require.NoError(t, store.SaveMFASecret(&MFASecret{AccountNumber: number, EncryptedSecret: []byte("first"), CreatedAt: time.Now().UTC()}, nil))
+	require.NoError(t, store.SaveMFASecret(&MFASecret{AccountNumber: number, EncryptedSecret: []byte("second"), CreatedAt: time.Now().UTC()}, nil))
+
+	mfa, err := store.GetMFASecret(number)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second"), mfa.EncryptedSecret)
+	assert.Nil(t, mfa.EnabledAt)
+
+	audit := &AuditEntry{Action: auditMFAEnable, CreatedAt: time.Now().UTC()}
+	require.NoError(t, store.EnableMFA(number, 100, audit))
+	mfa, err = store.GetMFASecret(number)
+	require.NoError(t, err)
+	assert.NotNil(t, mfa.EnabledAt)
+	assert.Equal(t, accountTarget(number), audit.Target)
+	assert.Contains(t, string(audit.Before), `"enabledAt":null`)
+	assert.NotContains(t, string(audit.After), `"enabledAt":null`)
+	assert.NotContains(t, string(audit.After), "second")
+	assert.Equal(t, int64(100), mfa.LastUsedStep)
+
+	err = store.SaveMFASecret(&MFASecret{AccountNumber: number, EncryptedSecret: []byte("third"), CreatedAt: time.Now().UTC()}, nil)
+	assert.ErrorIs(t, err, ErrMFAAlreadyEnabled)
+
+	//steps only move forward
+	assert.ErrorIs(t, store.UseMFAStep(number, 100), ErrMFACodeReused)
+	require.NoError(t, store.UseMFAStep(number, 101))
+	assert.ErrorIs(t, store.UseMFAStep(number, 101), ErrMFACodeReused)
+}
+
+func testPasswords(t *testing.T, store Storage) {
+	acc, err := NewAccount("Pass", "Word", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(acc, nil))
+
+	_, token, err := newRefreshToken(acc.Number, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateRefreshToken(token))
+
+	changedAt := time.Now().UTC().Truncate(time.Millisecond)
+	audit := &AuditEntry{Action: auditPasswordChange, CreatedAt: changedAt}
+	require.NoError(t, store.SetPassword(acc.Number, "first-hash", changedAt, audit))
+	assert.Equal(t, accountTarget(acc.Number), audit.Target)
+	assert.Contains(t, string(audit.Before), `"passwordChangedAt":null`)
+	assert.NotContains(t, string(audit.After), "first-hash")
+
+	stored, err := store.GetAccountByNumber(acc.Number)
+	require.NoError(t, err)
+	assert.Equal(t, "first-hash", stored.EncryptedPassword)
+	require.NotNil(t, stored.PasswordChangedAt)
+	assert.WithinDuration(t, changedAt, *stored.PasswordChangedAt, time.Millisecond)
+
+	//the change revoked the refresh token
+	_, next, _ := newRefreshToken(0, time.Hour)
+	_, err = store.RotateRefreshToken(token.TokenHash, next)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+
+	//a rehash loses against a password change that happened first
+	require.NoError(t, store.RehashPassword(acc.Number, "stale-hash", "rehashed"))
+	require.NoError(t, store.RehashPassword(acc.Number, "first-hash", "rehashed"))
+	stored, _ = store.GetAccountByNumber(acc.Number)
+	assert.Equal(t, "rehashed", stored.EncryptedPassword)
+
+	now := time.Now().UTC()
+	newReset := func(hash string) *PasswordReset {
+		return &PasswordReset{TokenHash: hash, AccountNumber: acc.Number, CreatedBy: 1, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	}
+	old, current := newReset(hashToken(randomTestToken(t))), newReset(hashToken(randomTestToken(t)))
+	require.NoError(t, store.CreatePasswordReset(old, nil))
+	audit = &AuditEntry{Action: auditResetToken, CreatedAt: now}
+	require.NoError(t, store.CreatePasswordReset(current, audit))
+	assert.JSONEq(t, `{"pending": 1}`, string(audit.Before))
+	assert.NotContains(t, string(audit.After), current.TokenHash)
+
+	//only the newest token works, and only once
+	_, err = store.ResetPassword(old.TokenHash, "reset-hash", now, nil)
+	assert.ErrorIs(t, err, ErrInvalidResetToken)
+	_, err = store.ResetPassword(current.TokenHash, "reset-hash", now.Add(2*time.Hour), nil)
+	assert.ErrorIs(t, err, ErrInvalidResetToken)
+
+	audit = &AuditEntry{Action: auditPasswordReset, CreatedAt: now}
+	number, err := store.ResetPassword(current.TokenHash, "reset-hash", now, audit)
+	require.NoError(t, err)
+	assert.Equal(t, acc.Number, number)
+	assert.Equal(t, acc.Number, audit.ActorNumber)
+	assert.Equal(t, accountTarget(acc.Number), audit.Target)
+	assert.Contains(t, string(audit.After), `"resetBy":1`)
+	assert.NotContains(t, string(audit.After), "reset-hash")
+	stored, _ = store.GetAccountByNumber(acc.Number)
+	assert.Equal(t, "reset-hash", stored.EncryptedPassword)
+
+	_, err = store.ResetPassword(current.TokenHash, "again", now, nil)
+	assert.ErrorIs(t, err, ErrInvalidResetToken)
+}
+
+func testRoles(t *testing.T, store Storage) {
+	//the built in roles are there from the start
+	admin, err := store.GetRole(roleAdmin)
+	require.NoError(t, err)
+	assert.True(t, admin.Builtin)
+	assert.True(t, admin.RequireMFA)
+	assert.ElementsMatch(t, allPermissions, admin.Permissions)
+
+	_, err = store.GetRole("no-such-role")
+	assert.ErrorIs(t, err, ErrRoleNotFound)
+
+	acc, err := NewAccount("Role", "Test", "secret123", "no-such-role", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	assert.ErrorIs(t, store.CreateAccount(acc, nil), ErrRoleNotFound)
+
+	name := "test-" + strings.ToLower(randomTestToken(t))
+	role := &Role{Name: name, Description: "test", Permissions: []Permission{PermTransfersRead, PermAccountsRead}}
+	require.NoError(t, store.SaveRole(role, nil))
+
+	stored, err := store.GetRole(name)
+	require.NoError(t, err)
+	assert.False(t, stored.Builtin)
+	assert.Equal(t, []Permission{PermAccountsRead, PermTransfersRead}, stored.Permissions)
+
+	//saving again replaces the permissions
+	role.Permissions = []Permission{PermAccountsUnlock}
+	role.RequireMFA = true
+	audit := &AuditEntry{ActorNumber: 42, ActorRole: "admin", Action: auditRoleSave, CreatedAt: time.Now().UTC()}
+	require.NoError(t, store.SaveRole(role, audit))
+	assert.Equal(t, roleTarget(name), audit.Target)
+	assert.Contains(t, string(audit.Before), string(PermTransfersRead))
+	assert.Contains(t, string(audit.After), string(PermAccountsUnlock))
+	stored, _ = store.GetRole(name)
+	assert.Equal(t, []Permission{PermAccountsUnlock}, stored.Permissions)
+	assert.True(t, stored.RequireMFA)
+
+	roles, err := store.GetRoles()
+	require.NoError(t, err)
+	names := []string{}
+	for _, r := range roles {
+		names = append(names, r.Name)
+	}
+	assert.Contains(t, names, name)
+	assert.Contains(t, names, "teller")
+
+	acc, err = NewAccount("Role", "Test", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, err)
+	require.NoError(t, store.CreateAccount(acc, nil))
+
+	assert.ErrorIs(t, store.SetAccountRole(acc.Number, "no-such-role", nil), ErrRoleNotFound)
+	assert.ErrorIs(t, store.SetAccountRole(-1, name, nil), ErrAccountNotFound)
+	audit = &AuditEntry{ActorNumber: 42, ActorRole: "admin", Action: auditAccountRole, CreatedAt: time.Now().UTC()}
+	require.NoError(t, store.SetAccountRole(acc.Number, name, audit))
+	assert.Contains(t, string(audit.Before), `"role":"user"`)
+	assert.Contains(t, string(audit.After), fmt.Sprintf(`"role":%q`, name))
+	storedAcc, err := store.GetAccountByNumber(acc.Number)
+	require.NoError(t, err)
+	assert.Equal(t, name, storedAcc.Role)
+
+	//a role can't be deleted while an account has it
+	assert.ErrorIs(t, store.DeleteRole(name, nil), ErrRoleInUse)
+	require.NoError(t, store.SetAccountRole(acc.Number, roleUser, nil))
+	require.NoError(t, store.DeleteRole(name, nil))
+	_, err = store.GetRole(name)
+	assert.ErrorIs(t, err, ErrRoleNotFound)
+	assert.ErrorIs(t, store.DeleteRole(name, nil), ErrRoleNotFound)
+}
+
+func testReversals(t *testing.T, store Storage) {
+	from, _ := NewAccount("Test", "ReversalFrom", "secret123", "user", 100, bcrypt.DefaultCost)
+	to, _ := NewAccount("Test", "ReversalTo", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, store.CreateAccount(from, nil))
+	require.NoError(t, store.CreateAccount(to, nil))
+
+	_, err := store.GetTransfer(-1)
+	assert.ErrorIs(t, err, ErrTransferNotFound)
+
+	transfer := &Transfer{FromNumber: from.Number, ToNumber: to.Number, Money: Money{Amount: 40}}
+	require.NoError(t, store.TransferMoney(transfer, nil))
+
+	found, err := store.GetTransfer(transfer.Id)
+	require.NoError(t, err)
+	assert.Equal(t, from.Number, found.FromNumber)
+	assert.Equal(t, uint64(40), found.Amount)
+	assert.Zero(t, found.ReversalOf)
+
+	//reversed in two parts, never more than it moved
+	partial := reversalOf(found, 15)
+	require.NoError(t, store.TransferMoney(partial, nil))
+	err = store.TransferMoney(reversalOf(found, 26), nil)
+	assert.ErrorIs(t, err, ErrReversalTooLarge)
+
+	found, err = store.GetTransfer(transfer.Id)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(15), found.Reversed)
+
+	reversal := reversalOf(found, 25)
+	require.NoError(t, store.TransferMoney(reversal, nil))
+	found, err = store.GetTransfer(reversal.Id)
+	require.NoError(t, err)
+	assert.Equal(t, transfer.Id, found.ReversalOf)
+	assert.Equal(t, to.Number, found.FromNumber)
+
+	history, err := store.GetTransfers(TransferFilter{AccountNumber: from.Number, Direction: DirectionOutgoing})
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, uint64(40), history[0].Reversed)
+
+	stored, _ := store.GetAccountByNumber(from.Number)
+	assert.Equal(t, uint64(100), stored.Balance)
+
+	//nothing is left to reverse, and reversals can't be reversed
+	err = store.TransferMoney(reversalOf(transfer, 1), nil)
+	assert.ErrorIs(t, err, ErrTransferReversed)
+	err = store.TransferMoney(reversalOf(found, 1), nil)
+	assert.ErrorIs(t, err, ErrReversalReversed)
+	err = store.TransferMoney(&Transfer{FromNumber: from.Number, ToNumber: to.Number, Money: Money{Amount: 1}, ReversalOf: -1}, nil)
+	assert.ErrorIs(t, err, ErrTransferNotFound)
+
+	action := &StaffAction{ActorNumber: from.Number, ActorRole: "support", Action: staffActionReverseTransfer,
+		TargetNumber: to.Number, TransferId: transfer.Id, Reason: "test", CreatedAt: time.Now().UTC()}
+	require.NoError(t, store.RecordStaffAction(action))
+	assert.NotZero(t, action.Id)
+}
+
+func testReversalHolds(t *testing.T, store Storage) {
+	from, _ := NewAccount("Test", "HoldFrom", "secret123", "user", 100, bcrypt.DefaultCost)
+	to, _ := NewAccount("Test", "HoldTo", "secret123", "user", 0, bcrypt.DefaultCost)
+	other, _ := NewAccount("Test", "HoldOther", "secret123", "user", 0, bcrypt.DefaultCost)
+	for _, acc := range []*Account{from, to, other} {
+		require.NoError(t, store.CreateAccount(acc, nil))
+	}
+
+	transfer := &Transfer{FromNumber: from.Number, ToNumber: to.Number, Money: Money{Amount: 60}}
+	require.NoError(t, store.TransferMoney(transfer, nil))
+	require.NoError(t, store.TransferMoney(&Transfer{FromNumber: to.Number, ToNumber: other.Number, Money: Money{Amount: 60}}, nil))
+
+	//without the hold policy nothing moves, with it nothing is booked either
+	//but the whole amount is held
+	_, err := store.ReverseTransfer(reversalOf(transfer, 60), false, nil, nil)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+
+	reversal := reversalOf(transfer, 60)
+	shortfall, err := store.ReverseTransfer(reversal, true, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(60), shortfall)
+	assert.Zero(t, reversal.Id)
+
+	stored, _ := store.GetAccountByNumber(to.Number)
+	assert.Equal(t, uint64(60), stored.Held)
+
+	//a top up is taken back as far as it goes
+	require.NoError(t, store.TransferMoney(&Transfer{FromNumber: other.Number, ToNumber: to.Number, Money: Money{Amount: 25}}, nil))
+	err = store.TransferMoney(&Transfer{FromNumber: to.Number, ToNumber: other.Number, Money: Money{Amount: 1}}, nil)
+	assert.ErrorIs(t, err, ErrFundsHeld)
+
+	reversal = reversalOf(transfer, 60)
+	action := &StaffAction{ActorNumber: from.Number, ActorRole: "support", Action: staffActionReverseTransfer,
+		TargetNumber: to.Number, TransferId: transfer.Id, Reason: "test", CreatedAt: time.Now().UTC()}
+	shortfall, err = store.ReverseTransfer(reversal, true, action, nil)
+	require.NoError(t, err)
+	assert.NotZero(t, action.Id)
+	assert.Equal(t, uint64(35), shortfall)
+	assert.NotZero(t, reversal.Id)
+	assert.Equal(t, uint64(25), reversal.Amount)
+
+	stored, _ = store.GetAccountByNumber(to.Number)
+	assert.Zero(t, stored.Balance)
+	assert.Equal(t, uint64(35), stored.Held)
+	_, err = store.CloseAccount(to.Number, other.Number, nil)
+	assert.ErrorIs(t, err, ErrFundsHeld)
+
+	//collecting the rest lifts the hold
+	require.NoError(t, store.TransferMoney(&Transfer{FromNumber: other.Number, ToNumber: to.Number, Money: Money{Amount: 35}}, nil))
+	shortfall, err = store.ReverseTransfer(reversalOf(transfer, 35), false, nil, nil)
+	require.NoError(t, err)
+	assert.Zero(t, shortfall)
+
+	stored, _ = store.GetAccountByNumber(to.Number)
+	assert.Zero(t, stored.Held)
+	stored, _ = store.GetAccountByNumber(from.Number)
+	assert.Equal(t, uint64(100), stored.Balance)
+	found, err := store.GetTransfer(transfer.Id)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(60), found.Reversed)
+
+	//a hold can't be collected from money held for another transfer
+	first := &Transfer{FromNumber: from.Number, ToNumber: to.Number, Money: Money{Amount: 30}}
+	second := &Transfer{FromNumber: from.Number, ToNumber: to.Number, Money: Money{Amount: 30}}
+	require.NoError(t, store.TransferMoney(first, nil))
+	require.NoError(t, store.TransferMoney(second, nil))
+	require.NoError(t, store.TransferMoney(&Transfer{FromNumber: to.Number, ToNumber: other.Number, Money: Money{Amount: 50}}, nil))
+
+	shortfall, err = store.ReverseTransfer(reversalOf(first, 30), true, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20), shortfall)
+	require.NoError(t, store.TransferMoney(&Transfer{FromNumber: other.Number, ToNumber: to.Number, Money: Money{Amount: 5}}, nil))
+
+	_, err = store.ReverseTransfer(reversalOf(second, 5), false, nil, nil)
+	assert.ErrorIs(t, err, ErrFundsHeld)
+	reversal = reversalOf(second, 30)
+	shortfall, err = store.ReverseTransfer(reversal, true, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(30), shortfall)
+	assert.Zero(t, reversal.Id)
+
+	stored, _ = store.GetAccountByNumber(to.Number)
+	assert.Equal(t, uint64(5), stored.Balance)
+	assert.Equal(t, uint64(50), stored.Held)
+}
+
+func testAuditLog(t *testing.T, store Storage) {
+	newAudit := func(action string) *AuditEntry {
+		return &AuditEntry{ActorNumber: 42, ActorRole: "admin", Action: action,
+			RequestId: randomTestToken(t), IP: "192.0.2.1", CreatedAt: time.Now().UTC()}
+	}
+
+	from, _ := NewAccount("Test", "AuditFrom", "secret123", "user", 100, bcrypt.DefaultCost)
+	to, _ := NewAccount("Test", "AuditTo", "secret123", "user", 0, bcrypt.DefaultCost)
+	created := newAudit(auditAccountCreate)
+	require.NoError(t, store.CreateAccount(from, created))
+	require.NoError(t, store.CreateAccount(to, nil))
+	assert.NotZero(t, created.Id)
+	assert.Equal(t, accountTarget(from.Number), created.Target)
+
+	transfer := &Transfer{FromNumber: from.Number, ToNumber: to.Number, Money: Money{Amount: 30}}
+	moved := newAudit(auditTransferCreate)
+	require.NoError(t, store.TransferMoney(transfer, moved))
+
+	//failed changes leave no trace
+	failed := newAudit(auditTransferCreate)
+	err := store.TransferMoney(&Transfer{FromNumber: to.Number, ToNumber: from.Number, Money: Money{Amount: 1000}}, failed)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+
+	frozen := newAudit(auditAccountFreeze)
+	require.NoError(t, store.SetAccountStatus(to.Number, AccountFrozen, frozen))
+
+	entries, err := store.GetAuditLog(AuditFilter{Target: transferTarget(transfer.Id)})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	entry := entries[0]
+	assert.Equal(t, moved.Id, entry.Id)
+	assert.Equal(t, int64(42), entry.ActorNumber)
+	assert.Equal(t, "192.0.2.1", entry.IP)
+	assert.Equal(t, moved.RequestId, entry.RequestId)
+	assert.JSONEq(t, fmt.Sprintf(`{"balances": {"%d": 100, "%d": 0}}`, from.Number, to.Number), string(entry.Before))
+
+	var after transferSnapshot
+	require.NoError(t, json.Unmarshal(entry.After, &after))
+	assert.Equal(t, transfer.Id, after.Transfer.Id)
+	assert.Equal(t, uint64(70), after.Balances[from.Number])
+	assert.Equal(t, uint64(30), after.Balances[to.Number])
+
+	//the stored entry still matches its hash
+	assert.Equal(t, entry.Hash, entry.computeHash())
+	assert.NotEmpty(t, entry.PrevHash)
+
+	entries, err = store.GetAuditLog(AuditFilter{Target: accountTarget(to.Number), Action: auditAccountFreeze})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Contains(t, string(entries[0].Before), `"status":"active"`)
+	assert.Contains(t, string(entries[0].After), `"status":"frozen"`)
+
+	entries, err = store.GetAuditLog(AuditFilter{ActorNumber: 42, BeforeId: frozen.Id, Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, moved.Id, entries[0].Id)
+	assert.Equal(t, created.Id, entries[1].Id)
+	assert.Equal(t, entries[1].Hash, moved.PrevHash)
+}
+
+func testAccountStatus(t *testing.T, store Storage) {
+	from, _ := NewAccount("Test", "StatusFrom", "secret123", "user", 100, bcrypt.DefaultCost)
+	to, _ := NewAccount("Test", "StatusTo", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, store.CreateAccount(from, nil))
+	require.NoError(t, store.CreateAccount(to, nil))
+
+	//frozen accounts can neither send nor receive
+	require.NoError(t, store.SetAccountStatus(to.Number, AccountFrozen, nil))
+	err := store.TransferMoney(&Transfer{FromNumber: from.Number, ToNumber: to.Number, Money: Money{Amount: 10}}, nil)
+	assert.ErrorIs(t, err, ErrAccountFrozen)
+	err = store.TransferMoney(&Transfer{FromNumber: to.Number, ToNumber: from.Number, Money: Money{Amount: 10}}, nil)
+	assert.ErrorIs(t, err, ErrAccountFrozen)
+
+	_, err = store.CloseAccount(from.Number, to.Number, nil)
+	assert.ErrorIs(t, err, ErrInvalidPayoutAccount)
+
+	require.NoError(t, store.SetAccountStatus(to.Number, AccountActive, nil))
+	require.NoError(t, store.TransferMoney(&Transfer{FromNumber: from.Number, ToNumber: to.Number, Money: Money{Amount: 10}}, nil))
+
+	//money left needs somewhere to go
+	_, err = store.CloseAccount(from.Number, 0, nil)
+	assert.ErrorIs(t, err, ErrBalanceNotZero)
+	_, err = store.CloseAccount(from.Number, from.Number, nil)
+	assert.ErrorIs(t, err, ErrInvalidPayoutAccount)
+	_, err = store.CloseAccount(from.Number, 1, nil)
+	assert.ErrorIs(t, err, ErrInvalidPayoutAccount)
+
+	payout, err := store.CloseAccount(from.Number, to.Number, nil)
+	require.NoError(t, err)
+	require.NotNil(t, payout)
+	assert.Equal(t, uint64(90), payout.Amount)
+
+	//closed accounts stay readable
+	closed, err := store.GetAccountByNumber(from.Number)
+	require.NoError(t, err)
+	assert.Equal(t, AccountClosed, closed.Status)
+	assert.NotNil(t, closed.ClosedAt)
+	assert.Zero(t, closed.Balance)
+	balance, err := store.RecomputeBalance(from.Number)
+	require.NoError(t, err)
+	assert.Zero(t, balance)
+
+	stored, _ := store.GetAccountByNumber(to.Number)
+	assert.Equal(t, uint64(100), stored.Balance)
+
+	_, err = store.CloseAccount(from.Number, to.Number, nil)
+	assert.ErrorIs(t, err, ErrAccountClosed)
+	assert.ErrorIs(t, store.SetAccountStatus(from.Number, AccountActive, nil), ErrAccountClosed)
+	err = store.TransferMoney(&Transfer{FromNumber: to.Number, ToNumber: from.Number, Money: Money{Amount: 10}}, nil)
+	assert.ErrorIs(t, err, ErrAccountClosed)
+
+	//an empty account closes without a payout
+	_, err = store.CloseAccount(to.Number, 0, nil)
+	assert.ErrorIs(t, err, ErrBalanceNotZero)
+	empty, _ := NewAccount("Test", "StatusEmpty", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, store.CreateAccount(empty, nil))
+	payout, err = store.CloseAccount(empty.Number, 0, nil)
+	require.NoError(t, err)
+	assert.Nil(t, payout)
+}
+
+func testUpdateAccount(t *testing.T, store Storage) {
+	acc, _ := NewAccount("Test", "Update", "secret123", "user", 50, bcrypt.DefaultCost)
+	require.NoError(t, store.CreateAccount(acc, nil))
+	assert.Equal(t, int64(1), acc.Version)
+
+	byId, err := store.GetAccountById(acc.Id)
+	require.NoError(t, err)
+	assert.Equal(t, acc.Number, byId.Number)
+	_, err = store.GetAccountById(-1)
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+
+	update := *byId
+	update.FirstName = "Renamed"
+	update.Role = "teller"
+	update.Balance = 1_000_000
+	audit := &AuditEntry{ActorNumber: 42, ActorRole: "admin", Action: auditAccountUpdate, CreatedAt: time.Now().UTC()}
+	require.NoError(t, store.UpdateAccount(&update, audit))
+	assert.Equal(t, int64(2), update.Version)
+	assert.Equal(t, uint64(50), update.Balance)
+	assert.Contains(t, string(audit.Before), `"firstName":"Test"`)
+	assert.Contains(t, string(audit.After), `"firstName":"Renamed"`)
+
+	stored, _ := store.GetAccountByNumber(acc.Number)
+	assert.Equal(t, "Renamed", stored.FirstName)
+	assert.Equal(t, "teller", stored.Role)
+	assert.Equal(t, uint64(50), stored.Balance)
+	assert.Equal(t, int64(2), stored.Version)
+
+	//the copy read before the update is stale now
+	byId.LastName = "Stale"
+	assert.ErrorIs(t, store.UpdateAccount(byId, nil), ErrVersionConflict)
+
+	stored.Role = "no-such-role"
+	assert.ErrorIs(t, store.UpdateAccount(stored, nil), ErrRoleNotFound)
+
+	//other changes move the version too
+	require.NoError(t, store.SetAccountStatus(acc.Number, AccountFrozen, nil))
+	stored, _ = store.GetAccountByNumber(acc.Number)
+	assert.Equal(t, int64(3), stored.Version)
+
+	missing := *stored
+	missing.Number = -1
+	assert.ErrorIs(t, store.UpdateAccount(&missing, nil), ErrAccountNotFound)
+}
+
+func testListAccounts(t *testing.T, store Storage) {
+	//a fresh name keeps the filter to this run's accounts
+	prefix := "List" + randomTestToken(t)
+	start := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	balances := []uint64{300, 100, 0, 200, 100}
+	accounts := make([]*Account, len(balances))
+	for i, balance := range balances {
+		acc, _ := NewAccount(fmt.Sprintf("%s%d", prefix, i), fmt.Sprintf("Holder%d", len(balances)-i), "secret123", "user", balance, bcrypt.DefaultCost)
+		acc.CreatedAt = start.Add(time.Duration(i) * time.Second)
+		require.NoError(t, store.CreateAccount(acc, nil))
+		accounts[i] = acc
+	}
+	require.NoError(t, store.SetAccountStatus(accounts[4].Number, AccountFrozen, nil))
+
+	numbers := func(found []*Account) []int64 {
+		n := []int64{}
+		for _, acc := range found {
+			n = append(n, acc.Number)
+		}
+		return n
+	}
+	list := func(filter AccountFilter) []int64 {
+		filter.NamePrefix = strings.ToLower(prefix)
+		found, err := store.GetAccounts(filter)
+		require.NoError(t, err)
+		return numbers(found)
+	}
+
+	assert.Equal(t, numbers(accounts), list(AccountFilter{}))
+	assert.Equal(t, []int64{accounts[4].Number, accounts[3].Number}, list(AccountFilter{Descending: true, Limit: 2}))
+	assert.Equal(t, []int64{accounts[4].Number}, list(AccountFilter{Status: AccountFrozen}))
+	assert.Empty(t, list(AccountFilter{Role: "admin"}))
+	assert.Equal(t, []int64{accounts[1].Number, accounts[2].Number},
+		list(AccountFilter{CreatedFrom: accounts[1].CreatedAt, CreatedTo: accounts[3].CreatedAt}))
+
+	noMoney := uint64(0)
+	assert.Equal(t, []int64{accounts[2].Number}, list(AccountFilter{MaxBalance: &noMoney}))
+	assert.Equal(t, []int64{accounts[0].Number, accounts[3].Number}, list(AccountFilter{MinBalance: 200}))
+
+	//ties on the sort key are broken by id
+	byBalance := AccountFilter{Sort: SortBalance, Descending: true, Limit: 2}
+	assert.Equal(t, []int64{accounts[0].Number, accounts[3].Number}, list(byBalance))
+	byBalance.After = accounts[3]
+	assert.Equal(t, []int64{accounts[4].Number, accounts[1].Number}, list(byBalance))
+	byBalance.After = accounts[1]
+	assert.Equal(t, []int64{accounts[2].Number}, list(byBalance))
+
+	assert.Equal(t, []int64{accounts[4].Number, accounts[3].Number, accounts[2].Number, accounts[1].Number, accounts[0].Number},
+		list(AccountFilter{Sort: SortLastName}))
+	assert.Equal(t, []int64{accounts[3].Number, accounts[4].Number},
+		list(AccountFilter{Sort: SortLastName, Descending: true, After: accounts[2]}))
+
+	//the prefix is matched literally
+	found, err := store.GetAccounts(AccountFilter{NamePrefix: prefix[:4] + "%"})
+	require.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func randomTestToken(t *testing.T) string {
+	s, err := randomToken(8)
+	require.NoError(t, err)
+	return s
+}
+
+func testCashMovements(t *testing.T, store Storage) {
+	acc, _ := NewAccount("Test", "Cash", "secret123", "user", 0, bcrypt.DefaultCost)
+	require.NoError(t, store.CreateAccount(acc, nil))
+
+	deposit := &Transfer{FromNumber: cashAccountNumber, ToNumber: acc.Number, Money: Money{Amount: 500, Currency: acc.Currency}, ReasonCode: reasonCash}
+	audit := &AuditEntry{ActorNumber: 42, ActorRole: "teller", Action: auditAccountDeposit, CreatedAt: time.Now().UTC()}
+	require.NoError(t, store.Deposit(deposit, audit))
+	assert.NotZero(t, deposit.Id)
+	assert.Equal(t, accountTarget(acc.Number), audit.Target)
+
+	withdrawal := &Transfer{FromNumber: acc.Number, ToNumber: cashAccountNumber, Money: Money{Amount: 150, Currency: acc.Currency}, ReasonCode: reasonCash}
+	require.NoError(t, store.Withdraw(withdrawal, 200, nil))
+
+	//the balance still adds up from the ledger
+	stored, _ := store.GetAccountByNumber(acc.Number)
+	assert.Equal(t, uint64(350), stored.Balance)
+	balance, err := store.RecomputeBalance(acc.Number)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(350), balance)
+
+	//both show up in the history with their reason
+	history, err := store.GetTransfers(TransferFilter{AccountNumber: acc.Number, Direction: DirectionAll, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, reasonCash, history[0].ReasonCode)
+	assert.Equal(t, cashAccountNumber, history[0].ToNumber)
+	assert.Equal(t, cashAccountNumber, history[1].FromNumber)
+
+	//the limit counts what was withdrawn in the last day
+	err = store.Withdraw(&Transfer{FromNumber: acc.Number, ToNumber: cashAccountNumber, Money: Money{Amount: 60, Currency: acc.Currency}}, 200, nil)
+	assert.ErrorIs(t, err, ErrWithdrawalLimit)
+	require.NoError(t, store.Withdraw(&Transfer{FromNumber: acc.Number, ToNumber: cashAccountNumber, Money: Money{Amount: 50, Currency: acc.Currency}}, 200, nil))
+	require.NoError(t, store.Withdraw(&Transfer{FromNumber: acc.Number, ToNumber: cashAccountNumber, Money: Money{Amount: 60, Currency: acc.Currency}}, 0, nil))
+
+	err = store.Withdraw(&Transfer{FromNumber: acc.Number, ToNumber: cashAccountNumber, Money: Money{Amount: 1000, Currency: acc.Currency}}, 0, nil)
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	err = store.Deposit(&Transfer{FromNumber: cashAccountNumber, ToNumber: acc.Number, Money: Money{Amount: 10, Currency: "XXX"}}, nil)
+	assert.ErrorIs(t, err, ErrCurrencyMismatch)
+	err = store.Deposit(&Transfer{FromNumber: cashAccountNumber, ToNumber: -99, Money: Money{Amount: 10, Currency: acc.Currency}}, nil)
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+
+	require.NoError(t, store.SetAccountStatus(acc.Number, AccountFrozen, nil))
+	err = store.Deposit(&Transfer{FromNumber: cashAccountNumber, ToNumber: acc.Number, Money: Money{Amount: 10, Currency: acc.Currency}}, nil)
+	assert.ErrorIs(t, err, ErrAccountFrozen)
+	err = store.Withdraw(&Transfer{FromNumber: acc.Number, ToNumber: cashAccountNumber, Money: Money{Amount: 10, Currency: acc.Currency}}, 0, nil)
+	assert.ErrorIs(t, err, ErrAccountFrozen)
 
+	stored, _ = store.GetAccountByNumber(acc.Number)
+	assert.Equal(t, uint64(240), stored.Balance)
 }
@@ -18,12 +18,14 @@ export default function() {
 	const adminToken = logInUser(adminId)
 
 	//test - get accounts
-	const accountsUrl = 'http://host.docker.internal:3000/accounts';
-	const accountsPayload = JSON.stringify({
-		number: adminId
+	const accountsUrl = 'http://host.docker.internal:3000/accounts?sort=-created_at&limit=50';
+	const accountsRes = http.get(accountsUrl, {
+		headers: {
+			'x-jwt-token': adminToken,
+			'x-action-reason': 'k6 load test'
+		}
 	});
-
-	postRequest(accountsUrl, accountsPayload, adminToken)
+	check(accountsRes, { [`${accountsUrl} status is 200`]: (r) => r.status === 200 });
 
 	//test - transfer money
 	//create new accounts
@@ -64,7 +66,7 @@ export default function() {
 	const fromAccUpdated = postRequest(transferUrl, transferPayload, fromAccToken).json();
 	const toAccUpdated = getUpdatedToAcc(toAcc.number);
 
-	deleteAccounts(fromAcc.id, toAcc.id, adminId, adminToken)
+	closeAccounts(fromAcc.number, toAcc.number, adminId, adminToken)
 
 	expect(fromAcc.balance - transferAmount).to.equal(fromAccUpdated.balance)
 	expect(toAcc.balance + transferAmount).to.equal(toAccUpdated.balance)
@@ -116,24 +118,15 @@ function postRequest(endpoint, payload, token) {
 	return response;
 }
 
-function deleteAccounts(fromAccId, toAccId, adminId, adminToken) {
-	const deleteFromAccountUrl = `http://host.docker.internal:3000/account/${fromAccId}`;
-	const deleteToAccountUrl = `http://host.docker.internal:3000/account/${toAccId}`;
-	const deletePayload = JSON.stringify({
-		admin_account: adminId
-
+function closeAccounts(fromAccNumber, toAccNumber, adminId, adminToken) {
+	//accounts are closed rather than deleted, what is left goes back to the admin
+	const closePayload = JSON.stringify({
+		admin_account: adminId,
+		payout_account: adminId
 	});
-	const deleteParams = {
-		headers: {
-			'Content-Type': 'application/json',
-			'x-jwt-token': adminToken
-		}
-	};
 
-	let response = http.del(deleteFromAccountUrl, deletePayload, deleteParams);
-	check(response, { [`${deleteFromAccountUrl} status is 200`]: (r) => r.status === 200 });
-	response = http.del(deleteToAccountUrl, deletePayload, deleteParams);
-	check(response, { [`${deleteToAccountUrl} status is 200`]: (r) => r.status === 200 });
+	postRequest(`http://host.docker.internal:3000/account/${fromAccNumber}/close`, closePayload, adminToken)
+	postRequest(`http://host.docker.internal:3000/account/${toAccNumber}/close`, closePayload, adminToken)
 }
 
 function getRandomInt(min, max) {
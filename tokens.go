@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token already used")
+)
+
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+	tokenPurgeInterval     = time.Hour
+)
+
+// signs a short lived access token and starts a new refresh token family
+func (s *ApiServer) issueTokens(acc *Account, authMethods []string) (*LoginResponse, error) {
+	plain, refresh, err := newRefreshToken(acc.Number, s.refreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	refresh.AuthMethods = authMethods
+
+	if err := s.store.CreateRefreshToken(refresh); err != nil {
+		return nil, err
+	}
+
+	return s.loginResponse(acc, plain, authMethods)
+}
+
+func (s *ApiServer) loginResponse(acc *Account, refreshToken string, authMethods []string) (*LoginResponse, error) {
+	expiresAt := time.Now().Add(s.accessTokenTTL).UTC()
+	token, err := s.createJwt(acc, expiresAt, authMethods)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResponse{
+		Number:       acc.Number,
+		Token:        token,
+		ExpiresAt:    expiresAt,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// trades a refresh token for a new access token and a new refresh token,
+// the old refresh token stops working. Presenting an already rotated token
+// means it was copied, so the whole family gets revoked.
+func (s *ApiServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+	var req RefreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		return WriteJson(w, http.StatusBadRequest, ApiError{Error: "refresh token required"})
+	}
+
+	plain, next, err := newRefreshToken(0, s.refreshTokenTTL)
+	if err != nil {
+		fmt.Println("Error generating refresh token")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	previous, err := s.store.RotateRefreshToken(hashToken(req.RefreshToken), next)
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			fmt.Println("Refresh token reused, revoked its family")
+		}
+		if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+			return WriteJson(w, http.StatusUnauthorized, ApiError{Error: "invalid refresh token"})
+		}
+		fmt.Println("Error rotating refresh token")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	acc, err := s.store.GetAccountByNumber(previous.AccountNumber)
+	if err != nil || acc.Status == AccountClosed {
+		return WriteJson(w, http.StatusUnauthorized, ApiError{Error: "invalid refresh token"})
+	}
+
+	// refreshed tokens keep the factors of the original login
+	resp, err := s.loginResponse(acc, plain, previous.AuthMethods)
+	if err != nil {
+		fmt.Println("Error creating JWT")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	return WriteJson(w, http.StatusOK, resp)
+}
+
+// revokes the access token the request was made with and, when given, the
+// refresh token family it came from
+func (s *ApiServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	var req RefreshTokenRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return WriteJson(w, http.StatusBadRequest, ApiError{Error: "could not complete request"})
+		}
+	}
+
+	tokenId, _ := r.Context().Value("tokenId").(string)
+	expiresAt, _ := r.Context().Value("tokenExpiresAt").(time.Time)
+	if err := s.store.RevokeToken(tokenId, expiresAt); err != nil {
+		fmt.Println("Error revoking access token")
+		return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+	}
+
+	if req.RefreshToken != "" {
+		if err := s.store.RevokeRefreshToken(hashToken(req.RefreshToken)); err != nil && !errors.Is(err, ErrInvalidRefreshToken) {
+			fmt.Println("Error revoking refresh token")
+			return WriteJson(w, http.StatusInternalServerError, ApiError{Error: "could not complete request"})
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *ApiServer) purgeExpiredTokens() {
+	for range time.Tick(tokenPurgeInterval) {
+		if _, err := s.store.PurgeExpiredTokens(time.Now().UTC()); err != nil {
+			fmt.Println("Error purging expired tokens")
+		}
+	}
+}
+
+// returns the token to hand to the client and the record to store, only a
+// hash of the token ever reaches the database
+func newRefreshToken(accountNumber int64, ttl time.Duration) (string, *RefreshToken, error) {
+	plain, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	family, err := randomToken(16)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now().UTC()
+	return plain, &RefreshToken{
+		TokenHash:     hashToken(plain),
+		FamilyId:      family,
+		AccountNumber: accountNumber,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(ttl),
+	}, nil
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
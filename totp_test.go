@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	//SHA1 test vectors from RFC 6238 appendix B, last six digits
+	secret := []byte("12345678901234567890")
+	for unix, code := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		assert.Equal(t, code, totpCode(secret, totpStep(time.Unix(unix, 0))), "t=%d", unix)
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1234567890, 0)
+	step := totpStep(now)
+
+	//one step of drift either way is fine
+	for _, s := range []int64{step - 1, step, step + 1} {
+		got, ok := verifyTOTP(secret, totpCode(secret, s), now, 0)
+		assert.True(t, ok)
+		assert.Equal(t, s, got)
+	}
+
+	_, ok := verifyTOTP(secret, totpCode(secret, step+2), now, 0)
+	assert.False(t, ok)
+
+	//a step that was already used can't be used again
+	_, ok = verifyTOTP(secret, totpCode(secret, step), now, step)
+	assert.False(t, ok)
+
+	_, ok = verifyTOTP(secret, "12345", now, 0)
+	assert.False(t, ok)
+}
+
+func TestSecretBox(t *testing.T) {
+	box, err := NewSecretBox(make([]byte, 32))
+	require.NoError(t, err)
+
+	sealed, err := box.Seal([]byte("secret"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "secret")
+
+	opened, err := box.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), opened)
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = box.Open(sealed)
+	assert.Error(t, err)
+
+	_, err = NewSecretBox(make([]byte, 16))
+	assert.Error(t, err)
+}
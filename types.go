@@ -1,7 +1,8 @@
 package main
 
 import (
-	"math/rand"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -11,24 +12,250 @@ type HttpRequest interface {
 	GetAccountNumber() int64
 }
 
+// Amount is in minor units of the source account's currency, Currency is
+// optional but has to match the source account when given
 type TransferRequest struct {
+	FromNumber int64    `json:"from_number"`
+	ToNumber   int64    `json:"to_number"`
+	Amount     uint64   `json:"amount"`
+	Currency   Currency `json:"currency"`
+	Convert    bool     `json:"convert"`
+	QuoteId    string   `json:"quote_id"`
+}
+
+func (r *TransferRequest) GetAccountNumber() int64 {
+	return r.FromNumber
+}
+
+type FXQuoteRequest struct {
 	FromNumber int64  `json:"from_number"`
 	ToNumber   int64  `json:"to_number"`
 	Amount     uint64 `json:"amount"`
 }
 
-func (r *TransferRequest) GetAccountNumber() int64 {
+func (r *FXQuoteRequest) GetAccountNumber() int64 {
 	return r.FromNumber
 }
 
-type DeleteAccountRequest struct {
+// PayoutAccount receives what is left on the account, it can be left out
+// when the balance is zero
+type CloseAccountRequest struct {
+	AdminAccount  int64 `json:"admin_account"`
+	PayoutAccount int64 `json:"payout_account"`
+}
+
+func (r *CloseAccountRequest) GetAccountNumber() int64 {
+	return r.AdminAccount
+}
+
+type CloseAccountResponse struct {
+	Account *Account  `json:"account"`
+	Payout  *Transfer `json:"payout,omitempty"`
+}
+
+type AccountStatusRequest struct {
+	AdminAccount int64 `json:"admin_account"`
+}
+
+func (r *AccountStatusRequest) GetAccountNumber() int64 {
+	return r.AdminAccount
+}
+
+// only the fields that are set are changed
+type UpdateAccountRequest struct {
+	FirstName *string        `json:"firstName"`
+	LastName  *string        `json:"lastName"`
+	Role      *string        `json:"role"`
+	Status    *AccountStatus `json:"status"`
+}
+
+// Amount is what to take back from the recipient, in their currency. Zero
+// reverses whatever is left of the transfer.
+type ReverseTransferRequest struct {
+	Amount uint64         `json:"amount"`
+	Policy ReversalPolicy `json:"policy"`
+}
+
+// Reversal is nil when the recipient had nothing left to take back. With the
+// hold policy, Shortfall is what couldn't be taken back and Held says it is
+// now held on the recipient's account.
+type ReverseTransferResponse struct {
+	Reversal  *Transfer `json:"reversal"`
+	Shortfall uint64    `json:"shortfall,omitempty"`
+	Held      bool      `json:"held,omitempty"`
+	Remaining uint64    `json:"remaining"`
+}
+
+// Amount is in minor units of the account's currency, Currency is optional
+// but has to match the account when given
+type CashRequest struct {
+	AdminAccount int64    `json:"admin_account"`
+	Amount       uint64   `json:"amount"`
+	Currency     Currency `json:"currency"`
+	ReasonCode   string   `json:"reason_code"`
+}
+
+func (r *CashRequest) GetAccountNumber() int64 {
+	return r.AdminAccount
+}
+
+type CashResponse struct {
+	Transfer *Transfer `json:"transfer"`
+	Balance  uint64    `json:"balance"`
+}
+
+type UnlockAccountRequest struct {
+	AdminAccount int64  `json:"admin_account"`
+	IP           string `json:"ip"`
+}
+
+func (r *UnlockAccountRequest) GetAccountNumber() int64 {
+	return r.AdminAccount
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
 	AdminAccount int64 `json:"admin_account"`
 }
 
-func (r *DeleteAccountRequest) GetAccountNumber() int64 {
+func (r *PasswordResetRequest) GetAccountNumber() int64 {
 	return r.AdminAccount
 }
 
+type PasswordResetResponse struct {
+	Number     int64     `json:"number"`
+	ResetToken string    `json:"reset_token"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type ResetPasswordRequest struct {
+	ResetToken  string `json:"reset_token"`
+	NewPassword string `json:"new_password"`
+}
+
+// PasswordReset is a single use token an admin issued for an account, only
+// its hash is stored
+type PasswordReset struct {
+	TokenHash     string
+	AccountNumber int64
+	CreatedBy     int64
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+}
+
+// StaffAction records staff reading or changing an account that isn't
+// theirs. TargetNumber is 0 for actions on all accounts.
+type StaffAction struct {
+	Id           int64     `json:"id"`
+	ActorNumber  int64     `json:"actorNumber"`
+	ActorRole    string    `json:"actorRole"`
+	Action       string    `json:"action"`
+	TargetNumber int64     `json:"targetNumber,omitempty"`
+	TransferId   int64     `json:"transferId,omitempty"`
+	Reason       string    `json:"reason"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// AuditEntry is one state change in the append-only audit log. Every entry
+// carries the hash of the one before it, so editing or removing an entry
+// breaks the chain from there on.
+type AuditEntry struct {
+	Id int64 `json:"id"`
+	// 0 for changes made outside the api, like seeding
+	ActorNumber int64  `json:"actorNumber"`
+	ActorRole   string `json:"actorRole"`
+	Action      string `json:"action"`
+	// account:<number> or transfer:<id>
+	Target    string          `json:"target"`
+	RequestId string          `json:"requestId,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	IP        string          `json:"ip,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	PrevHash  string          `json:"prevHash"`
+	Hash      string          `json:"hash"`
+}
+
+// what GET /accounts can be sorted by
+type AccountSort string
+
+const (
+	SortCreatedAt AccountSort = "created_at"
+	SortBalance   AccountSort = "balance"
+	SortLastName  AccountSort = "last_name"
+	SortNumber    AccountSort = "number"
+)
+
+// zero values mean "no bound" except MaxBalance, where 0 is a real bound.
+// After is the last account of the previous page, only its Id and the sort
+// field are used.
+type AccountFilter struct {
+	Role        string
+	Status      AccountStatus
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	MinBalance  uint64
+	MaxBalance  *uint64
+	NamePrefix  string
+	Sort        AccountSort
+	Descending  bool
+	After       *Account
+	Limit       int
+}
+
+type AccountListResponse struct {
+	Accounts   []*Account `json:"accounts"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// zero values mean "no bound", BeforeId is the cursor of the previous page
+type AuditFilter struct {
+	ActorNumber int64
+	Action      string
+	Target      string
+	From        time.Time
+	To          time.Time
+	BeforeId    int64
+	Limit       int
+}
+
+type AuditLogResponse struct {
+	Entries    []*AuditEntry `json:"entries"`
+	NextCursor int64         `json:"nextCursor,omitempty"`
+}
+
+type AuditVerifyResponse struct {
+	Valid    bool  `json:"valid"`
+	Checked  int   `json:"checked"`
+	BrokenAt int64 `json:"brokenAt,omitempty"`
+}
+
+// Role is a named set of permissions, accounts have exactly one
+type Role struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `json:"permissions"`
+	// accounts with the role can't use the api until they enrolled in mfa
+	RequireMFA bool `json:"require_mfa"`
+	// built in roles can be edited but not deleted
+	Builtin bool `json:"builtin"`
+}
+
+type SaveRoleRequest struct {
+	Description string       `json:"description"`
+	Permissions []Permission `json:"permissions"`
+	RequireMFA  bool         `json:"require_mfa"`
+}
+
+type SetAccountRoleRequest struct {
+	Role string `json:"role"`
+}
+
 type GetAccountRequest struct {
 	Number int64 `json:"number"`
 }
@@ -42,7 +269,7 @@ type CreateAccountRequest struct {
 	LastName     string `json:"lastName"`
 	Password     string `json:"password"`
 	Role         string `json:"role"`
-	Balance      uint64 `json:"balance"`
+	Currency     string `json:"currency"`
 	AdminAccount int64  `json:"admin_account"`
 }
 
@@ -56,27 +283,302 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
-	Number int64  `json:"number"`
-	Token  string `json:"token"`
+	Number       int64     `json:"number"`
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+}
+
+// LoginAttempts counts failed logins for a key, see LoginConfig
+type LoginAttempts struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+}
+
+type MFAChallengeResponse struct {
+	MFARequired    bool      `json:"mfa_required"`
+	ChallengeToken string    `json:"challenge_token"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+type MFALoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+type MFAVerifyRequest struct {
+	Code string `json:"code"`
+}
+
+type MFAEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// either the password or a totp code, depending on what the account has
+type StepUpRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type StepUpResponse struct {
+	Token      string    `json:"step_up_token"`
+	AuthMethod string    `json:"auth_method"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type StepUpRequiredResponse struct {
+	Error          string   `json:"error"`
+	StepUpRequired bool     `json:"step_up_required"`
+	Methods        []string `json:"methods"`
+}
+
+// MFASecret is the TOTP secret of an account, encrypted with the server's
+// mfa key. It's pending until EnabledAt is set by a verified code.
+type MFASecret struct {
+	AccountNumber   int64
+	EncryptedSecret []byte
+	CreatedAt       time.Time
+	EnabledAt       *time.Time
+	LastUsedStep    int64
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshToken is the server side record of a refresh token, tokens rotated
+// from the same login share a FamilyId
+type RefreshToken struct {
+	TokenHash     string     `json:"-"`
+	FamilyId      string     `json:"family_id"`
+	AccountNumber int64      `json:"account_number"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	AuthMethods   []string   `json:"auth_methods"`
 }
 
 type Account struct {
-	Id                int       `json:"id"`
-	FirstName         string    `json:"firstName"`
-	LastName          string    `json:"lastName"`
-	Number            int64     `json:"number"`
-	EncryptedPassword string    `json:"-"`
-	Balance           uint64    `json:"balance"`
-	Role              string    `json:"role"`
-	CreatedAt         time.Time `json:"createdAt"`
+	Id                int    `json:"id"`
+	FirstName         string `json:"firstName"`
+	LastName          string `json:"lastName"`
+	Number            int64  `json:"number"`
+	EncryptedPassword string `json:"-"`
+	// Balance is a cached value, the ledger entries for the account are the
+	// source of truth (see Storage.RecomputeBalance)
+	Balance   uint64    `json:"balance"`
+	Currency  Currency  `json:"currency"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+	// tokens issued before this are no longer accepted
+	PasswordChangedAt *time.Time    `json:"-"`
+	Status            AccountStatus `json:"status"`
+	ClosedAt          *time.Time    `json:"closedAt,omitempty"`
+	// goes up whenever names, role or status change, see accountETag
+	Version int64 `json:"version"`
+	// what reversals still have to collect from the account, the balance
+	// can't be spent below it
+	Held uint64 `json:"held,omitempty"`
+}
+
+type TransferStatus string
+
+const (
+	TransferCompleted TransferStatus = "completed"
+)
+
+// the id of a transfer is the id of the journal that booked it
+type Transfer struct {
+	Id         int64 `json:"id"`
+	FromNumber int64 `json:"fromNumber"`
+	ToNumber   int64 `json:"toNumber"`
+	Money
+	FX        *FXDetails     `json:"fx,omitempty"`
+	Status    TransferStatus `json:"status"`
+	CreatedAt time.Time      `json:"createdAt"`
+	// pwd or otp when the transfer needed a step-up, session otherwise
+	AuthFactor string `json:"authFactor,omitempty"`
+	// the id of the transfer this one undoes
+	ReversalOf int64 `json:"reversalOf,omitempty"`
+	// how much of what the recipient got has been reversed so far
+	Reversed uint64 `json:"reversed,omitempty"`
+	// set on deposits and withdrawals, see cash.go
+	ReasonCode string `json:"reasonCode,omitempty"`
+}
+
+// set on transfers between accounts in different currencies, Money on the
+// transfer is what left the source account and Converted what arrived
+type FXDetails struct {
+	Rate      Rate   `json:"rate"`
+	Converted Money  `json:"converted"`
+	QuoteId   string `json:"quoteId,omitempty"`
+}
+
+// a rate fixed for one transfer until ExpiresAt, it can only be used once
+type FXQuote struct {
+	Id         string `json:"id"`
+	FromNumber int64  `json:"fromNumber"`
+	ToNumber   int64  `json:"toNumber"`
+	Money
+	Rate      Rate       `json:"rate"`
+	Converted Money      `json:"converted"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+}
+
+// checks the transfer against the currencies of the locked accounts and
+// fills in its currency when the caller left it empty
+func checkTransferCurrency(transfer *Transfer, from Currency, to Currency) error {
+	if transfer.Currency == "" {
+		transfer.Currency = from
+	}
+
+	if transfer.Currency != from {
+		return fmt.Errorf("transfer is in %s but account %d holds %s: %w",
+			transfer.Currency, transfer.FromNumber, from, ErrCurrencyMismatch)
+	}
+
+	target := from
+	if transfer.FX != nil {
+		target = transfer.FX.Converted.Currency
+	}
+
+	if to != target {
+		return fmt.Errorf("account %d holds %s but account %d holds %s: %w",
+			transfer.FromNumber, from, transfer.ToNumber, to, ErrCurrencyMismatch)
+	}
+
+	return nil
+}
+
+// cross-currency transfers go through the FX position account so the
+// journal balances in both currencies
+func transferEntries(transfer *Transfer) []LedgerEntry {
+	if transfer.FX == nil {
+		return []LedgerEntry{
+			{AccountNumber: transfer.FromNumber, Direction: Debit, Money: transfer.Money},
+			{AccountNumber: transfer.ToNumber, Direction: Credit, Money: transfer.Money},
+		}
+	}
+
+	return []LedgerEntry{
+		{AccountNumber: transfer.FromNumber, Direction: Debit, Money: transfer.Money},
+		{AccountNumber: fxPositionAccountNumber, Direction: Credit, Money: transfer.Money},
+		{AccountNumber: fxPositionAccountNumber, Direction: Debit, Money: transfer.FX.Converted},
+		{AccountNumber: transfer.ToNumber, Direction: Credit, Money: transfer.FX.Converted},
+	}
+}
+
+type TransferDirection string
+
+const (
+	DirectionAll      TransferDirection = "all"
+	DirectionIncoming TransferDirection = "in"
+	DirectionOutgoing TransferDirection = "out"
+)
+
+// zero values mean "no bound", BeforeId is the cursor of the previous page
+type TransferFilter struct {
+	AccountNumber int64
+	Direction     TransferDirection
+	From          time.Time
+	To            time.Time
+	BeforeId      int64
+	Limit         int
+}
+
+type TransactionHistoryResponse struct {
+	Transactions []*Transfer `json:"transactions"`
+	NextCursor   int64       `json:"nextCursor,omitempty"`
+}
+
+// a stored response for an Idempotency-Key, StatusCode is 0 while the first
+// request is still in flight
+type IdempotencyRecord struct {
+	Key          string
+	RequestHash  string
+	StatusCode   int
+	ResponseBody []byte
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+type EntryDirection string
+
+const (
+	Debit  EntryDirection = "debit"
+	Credit EntryDirection = "credit"
+)
+
+// system accounts only exist in the ledger, they never have a row in the
+// account table. Opening balances are booked against the first one so every
+// journal stays balanced, currency conversions go through the second and
+// money handed over the counter goes through the third.
+const (
+	openingBalanceAccountNumber int64 = -1
+	fxPositionAccountNumber     int64 = -2
+	cashAccountNumber           int64 = -3
+)
+
+// a single leg of a journal, every journal has debits == credits
+type LedgerEntry struct {
+	Id            int            `json:"id"`
+	JournalId     int64          `json:"journalId"`
+	AccountNumber int64          `json:"accountNumber"`
+	Direction     EntryDirection `json:"direction"`
+	Money
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// a journal has to balance in every currency it touches
+func validateJournal(entries []LedgerEntry) error {
+	if len(entries) < 2 {
+		return fmt.Errorf("journal needs at least two entries")
+	}
+
+	totals := map[Currency]int64{}
+	for _, e := range entries {
+		if e.Amount == 0 {
+			return fmt.Errorf("journal entry for account %d has zero amount", e.AccountNumber)
+		}
+
+		if _, err := ParseCurrency(string(e.Currency)); err != nil {
+			return err
+		}
+
+		switch e.Direction {
+		case Debit:
+			totals[e.Currency] -= int64(e.Amount)
+		case Credit:
+			totals[e.Currency] += int64(e.Amount)
+		default:
+			return fmt.Errorf("invalid entry direction %q", e.Direction)
+		}
+	}
+
+	for currency, total := range totals {
+		if total != 0 {
+			return fmt.Errorf("unbalanced journal: %s is off by %d", currency, total)
+		}
+	}
+
+	return nil
 }
 
 func (a *Account) ValidatePassword(password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(a.EncryptedPassword), []byte(password))
 }
 
-func NewAccount(firstName string, lastName string, password string, role string, balance uint64) (*Account, error) {
-	encpw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+func NewAccount(firstName string, lastName string, password string, role string, balance uint64, cost int) (*Account, error) {
+	encpw, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return nil, err
+	}
+
+	number, err := generateAccountNumber()
 	if err != nil {
 		return nil, err
 	}
@@ -84,10 +586,13 @@ func NewAccount(firstName string, lastName string, password string, role string,
 	return &Account{
 		FirstName:         firstName,
 		LastName:          lastName,
-		Number:            int64(rand.Intn(10000)),
+		Number:            number,
 		EncryptedPassword: string(encpw),
 		Balance:           balance,
+		Currency:          DefaultCurrency,
 		Role:              role,
 		CreatedAt:         time.Now().UTC(),
+		Status:            AccountActive,
+		Version:           1,
 	}, nil
 }
@@ -2,23 +2,32 @@ package main
 
 import (
 	"encoding/json"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestNewAccount(t *testing.T) {
-	acc, err := NewAccount("first", "test", "password", "user", 100)
+	acc, err := NewAccount("first", "test", "password", "user", 100, bcrypt.DefaultCost)
 
 	assert.Nil(t, err)
 	assert.Equal(t, acc.FirstName, "first")
 	assert.Equal(t, acc.LastName, "test")
 	assert.Equal(t, acc.Role, "user")
 	assert.Equal(t, acc.Balance, uint64(100))
+
+	//the password is hashed once, with the cost it was given
+	acc, err = NewAccount("first", "test", "password", "user", 0, bcrypt.MinCost)
+	assert.Nil(t, err)
+	cost, err := bcrypt.Cost([]byte(acc.EncryptedPassword))
+	assert.Nil(t, err)
+	assert.Equal(t, bcrypt.MinCost, cost)
 }
 
 func TestValidatePassword(t *testing.T) {
-	acc, _ := NewAccount("first", "test", "secret123", "user", 100)
+	acc, _ := NewAccount("first", "test", "secret123", "user", 100, bcrypt.DefaultCost)
 
 	err := acc.ValidatePassword("secret123")
 	assert.Nil(t, err)
@@ -33,10 +42,10 @@ func TestGetAccountNumber(t *testing.T) {
 	}
 	assert.Equal(t, transferReq.FromNumber, int64(1234))
 
-	deleteAccReq := DeleteAccountRequest{
+	closeAccReq := CloseAccountRequest{
 		AdminAccount: 987,
 	}
-	assert.Equal(t, deleteAccReq.AdminAccount, int64(987))
+	assert.Equal(t, closeAccReq.GetAccountNumber(), int64(987))
 
 	getAccReq := GetAccountRequest{
 		Number: 876,
@@ -50,15 +59,15 @@ func TestGetAccountNumber(t *testing.T) {
 }
 
 func TestNewAccountUniqueness(t *testing.T) {
-	acc1, _ := NewAccount("first", "test", "password", "user", 100)
-	acc2, _ := NewAccount("second", "test", "password", "user", 100)
+	acc1, _ := NewAccount("first", "test", "password", "user", 100, bcrypt.DefaultCost)
+	acc2, _ := NewAccount("second", "test", "password", "user", 100, bcrypt.DefaultCost)
 
 	assert.NotEqual(t, acc1.Number, acc2.Number)
 	assert.NotEqual(t, acc1.FirstName, acc2.FirstName)
 }
 
 func TestPasswordOmission(t *testing.T) {
-	acc, _ := NewAccount("first", "last", "secretpass123", "user", 100)
+	acc, _ := NewAccount("first", "last", "secretpass123", "user", 100, bcrypt.DefaultCost)
 
 	jsonAcc, err := json.Marshal(acc)
 	assert.Nil(t, err)
@@ -70,3 +79,53 @@ func TestPasswordOmission(t *testing.T) {
 
 	assert.NotContains(t, jsonStr, "secretpass123")
 }
+
+func TestValidateJournal(t *testing.T) {
+	balanced := []LedgerEntry{
+		{AccountNumber: 1, Direction: Debit, Money: Money{Amount: 10, Currency: "USD"}},
+		{AccountNumber: 2, Direction: Credit, Money: Money{Amount: 10, Currency: "USD"}},
+	}
+	assert.Nil(t, validateJournal(balanced))
+
+	unbalanced := []LedgerEntry{
+		{AccountNumber: 1, Direction: Debit, Money: Money{Amount: 10, Currency: "USD"}},
+		{AccountNumber: 2, Direction: Credit, Money: Money{Amount: 9, Currency: "USD"}},
+	}
+	assert.NotNil(t, validateJournal(unbalanced))
+
+	singleLeg := []LedgerEntry{
+		{AccountNumber: 1, Direction: Debit, Money: Money{Amount: 10, Currency: "USD"}},
+	}
+	assert.NotNil(t, validateJournal(singleLeg))
+
+	//totals have to match per currency, not just overall
+	mixed := []LedgerEntry{
+		{AccountNumber: 1, Direction: Debit, Money: Money{Amount: 10, Currency: "USD"}},
+		{AccountNumber: 2, Direction: Credit, Money: Money{Amount: 10, Currency: "EUR"}},
+	}
+	assert.NotNil(t, validateJournal(mixed))
+}
+
+func TestAccountNumberCheckDigit(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		number, err := generateAccountNumber()
+		assert.Nil(t, err)
+		assert.True(t, validAccountNumber(number))
+		assert.Len(t, strconv.FormatInt(number, 10), 10)
+	}
+
+	//known Luhn number
+	assert.True(t, validAccountNumber(79927398713))
+
+	//a single mistyped digit is caught
+	assert.False(t, validAccountNumber(79927398714))
+	//so is a swapped pair
+	assert.False(t, validAccountNumber(79927389713))
+	//and a dropped one
+	assert.True(t, validAccountNumber(1234567897))
+	assert.False(t, validAccountNumber(123456789))
+
+	//old four digit numbers have no check digit
+	assert.True(t, validAccountNumber(4821))
+	assert.False(t, validAccountNumber(0))
+}